@@ -0,0 +1,106 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// the -client-acl file: which client may access which feed. one rule per
+// line, "client-id feed allow|deny", both client-id and feed are globs
+// (see path.Match, a single "*" matches anything, even nested feeds):
+//
+//	# comment
+//	C=DE,O=Travelping,CN=box-1   /arm      allow
+//	C=DE,O=Travelping,CN=*       /beta*    deny
+//	*                            *         allow
+//
+// the feed is the path ClientIdMuxer maps the request to. the first
+// matching rule decides, without a matching rule access is denied.
+type ClientACL struct {
+	FileName string
+
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+type aclRule struct {
+	client string
+	feed   string
+	allow  bool
+}
+
+func LoadClientACL(fileName string) (*ClientACL, error) {
+	acl := &ClientACL{FileName: fileName}
+	return acl, acl.Reload()
+}
+
+// reads 'FileName' again. on error the current rules stay in place.
+func (acl *ClientACL) Reload() error {
+	file, err := os.Open(acl.FileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		rules   = make([]aclRule, 0)
+		scanner = bufio.NewScanner(file)
+		n       int
+	)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || (fields[2] != "allow" && fields[2] != "deny") {
+			return fmt.Errorf("%q, line %d: expected \"client-id feed allow|deny\", got %q", acl.FileName, n, line)
+		}
+		for _, glob := range fields[:2] {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("%q, line %d: invalid pattern %q", acl.FileName, n, glob)
+			}
+		}
+		rules = append(rules, aclRule{fields[0], fields[1], fields[2] == "allow"})
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	acl.mu.Lock()
+	acl.rules = rules
+	acl.mu.Unlock()
+	return nil
+}
+
+// reports if 'clientId' may access 'feed' (eg "/arm")
+func (acl *ClientACL) Allowed(clientId, feed string) bool {
+	feed = path.Clean("/" + feed)
+
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	for _, rule := range acl.rules {
+		if aclMatch(rule.client, clientId) && aclMatch(rule.feed, feed) {
+			return rule.allow
+		}
+	}
+	return false
+}
+
+func aclMatch(glob, name string) bool {
+	matched, _ := path.Match(glob, name)
+	return matched || glob == "*"
+}
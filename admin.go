@@ -0,0 +1,95 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// lets only requests carrying "Authorization: Bearer <token>" through
+// to 'handler'
+func requireAdminToken(handler http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kellner"`)
+			writeError(http.StatusUnauthorized, w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// re-reads the packages of all feeds of 'repo' (or just the one given
+// via ?feed=/prefix) and compares them against the checksums calculated
+// when they were scanned. the report is streamed, one line per package:
+//
+//	ok /arm/foo_1.0_arm.ipk
+//	FAILED /arm/bar_2.0_arm.ipk: sha256 mismatch: indexed ..., on disk ...
+//
+// followed by a summary line. as the status code is sent before the
+// first package is checked, it is 200 even if packages failed.
+func verifyHandler(repo *Repository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !repo.Ready() {
+			writeError(http.StatusServiceUnavailable, w, r)
+			return
+		}
+
+		feeds := repo.Feeds()
+		if prefix := r.URL.Query().Get("feed"); prefix != "" {
+			selected := feeds[:0]
+			for _, feed := range feeds {
+				if path.Clean(feed.Prefix) == path.Clean("/"+prefix) {
+					selected = append(selected, feed)
+				}
+			}
+			if len(selected) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			feeds = selected
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher, _ := w.(http.Flusher)
+
+		var (
+			start   = time.Now()
+			checked int
+			failed  int
+		)
+		for _, feed := range feeds {
+			packages := feed.Packages()
+			for _, name := range packages.SortedNames() {
+				pkgPath := path.Join(feed.Prefix, name)
+				if err := packages.Entries[name].Verify(feed.Dir); err != nil {
+					logErrorf("verifying %q: %v", pkgPath, err)
+					fmt.Fprintf(w, "FAILED %s: %v\n", pkgPath, err)
+					failed++
+				} else {
+					fmt.Fprintf(w, "ok %s\n", pkgPath)
+				}
+				checked++
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+		fmt.Fprintf(w, "checked %d packages in %d feeds in %s, %d failed\n",
+			checked, len(feeds), time.Since(start).Truncate(time.Millisecond), failed)
+	})
+}
@@ -0,0 +1,117 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	handler := requireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "s3cret")
+	for _, test := range []struct {
+		authorization string
+		code          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer s3cre", http.StatusUnauthorized},
+		{"Bearer s3cret2", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/admin/verify", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Authorization %q: got %d, expected %d", test.authorization, w.Code, test.code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: no WWW-Authenticate", test.authorization)
+		}
+	}
+}
+
+// packages changed on disk after the scan are reported
+func TestVerifyHandler(t *testing.T) {
+	root := mkdirs(t, "arm", "mips")
+	writeIpk(t, filepath.Join(root, "arm"), "good_1.0_arm.ipk", testControl("good", "1.0", "arm"))
+	var (
+		corrupted = writeIpk(t, filepath.Join(root, "arm"), "bad_1.0_arm.ipk", testControl("bad", "1.0", "arm"))
+		truncated = writeIpk(t, filepath.Join(root, "mips"), "short_1.0_mips.ipk", testControl("short", "1.0", "mips"))
+	)
+	repo := testRepository(Mount{root, ""})
+	repo.ScanOpts.Sha256 = true
+	handler := verifyHandler(repo)
+	if code := getStatus(handler, "/admin/verify"); code != http.StatusServiceUnavailable {
+		t.Errorf("GET /admin/verify before the scan: got %d, expected 503", code)
+	}
+	repo.Scan()
+
+	content := readTestFile(t, corrupted)
+	content[len(content)-1] ^= 0xff // same size
+	writeTestFile(t, corrupted, string(content))
+	if err := os.Truncate(truncated, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query    string
+		code     int
+		expected []string  // the lines, without the summary
+		summary  [2]string // its start and end
+	}{
+		{"", http.StatusOK, []string{
+			"FAILED /arm/bad_1.0_arm.ipk: sha256 mismatch",
+			"ok /arm/good_1.0_arm.ipk",
+			"FAILED /mips/short_1.0_mips.ipk: size changed",
+		}, [2]string{"checked 3 packages in 2 feeds in ", ", 2 failed"}},
+		{"?feed=/arm", http.StatusOK, []string{
+			"FAILED /arm/bad_1.0_arm.ipk: sha256 mismatch",
+			"ok /arm/good_1.0_arm.ipk",
+		}, [2]string{"checked 2 packages in 1 feeds in ", ", 1 failed"}},
+		{"?feed=arm/", http.StatusOK, nil, [2]string{"checked 2 packages in 1 feeds in ", ", 1 failed"}},
+		{"?feed=/x86", http.StatusNotFound, nil, [2]string{}},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/verify"+test.query, nil))
+		if w.Code != test.code {
+			t.Errorf("GET /admin/verify%s: got %d, expected %d", test.query, w.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		if summary := lines[len(lines)-1]; !strings.HasPrefix(summary, test.summary[0]) || !strings.HasSuffix(summary, test.summary[1]) {
+			t.Errorf("GET /admin/verify%s: got the summary %q, expected %q...%q", test.query, summary, test.summary[0], test.summary[1])
+		}
+		if test.expected == nil {
+			continue
+		}
+		lines = lines[:len(lines)-1]
+		if len(lines) != len(test.expected) {
+			t.Errorf("GET /admin/verify%s: got %q, expected %q", test.query, lines, test.expected)
+			continue
+		}
+		for i, line := range lines {
+			if !strings.HasPrefix(line, test.expected[i]) {
+				t.Errorf("GET /admin/verify%s: got %q, expected %q...", test.query, line, test.expected[i])
+			}
+		}
+	}
+}
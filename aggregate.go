@@ -0,0 +1,144 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serves "/Packages" (and its compressed variants) listing the packages
+// of all feeds of a Repository. the "Filename" of each entry is the path
+// of the package relative to "/", eg. "arm/foo_1.0_arm.ipk".
+//
+// the index is built on demand and rebuilt only if the index of any feed
+// changed since, eg. after a rescan or a rebuild of a watched feed.
+type aggregateIndex struct {
+	repo        *Repository
+	compressors []Compressor
+
+	mu      sync.Mutex
+	sources []*PackageIndex // the feed indices the files were built from
+	modtime time.Time
+	files   map[string][]byte // by name, eg "Packages.gz"
+}
+
+// the names of the files served by the aggregated index
+func (agg *aggregateIndex) names() []string {
+	names := []string{FormatPackages}
+	for _, compressor := range agg.compressors {
+		names = append(names, FormatPackages+compressor.Ext)
+	}
+	return names
+}
+
+func (agg *aggregateIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the feeds of the initial scan are known only once it is done
+	if !agg.repo.Ready() {
+		writeError(http.StatusServiceUnavailable, w, r)
+		return
+	}
+	modtime, files := agg.current()
+	content, ok := files[path.Base(r.URL.Path)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", contentETag(content))
+	http.ServeContent(w, r, path.Base(r.URL.Path), modtime, bytes.NewReader(content))
+}
+
+// returns the files, rebuilt if the feeds changed
+func (agg *aggregateIndex) current() (time.Time, map[string][]byte) {
+	feeds := agg.repo.Feeds()
+	sources := make([]*PackageIndex, len(feeds))
+	for i, feed := range feeds {
+		sources[i] = feed.Packages()
+	}
+
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+
+	if agg.files != nil && len(sources) == len(agg.sources) {
+		unchanged := true
+		for i := range sources {
+			unchanged = unchanged && sources[i] == agg.sources[i]
+		}
+		if unchanged {
+			return agg.modtime, agg.files
+		}
+	}
+
+	packages := aggregatePackages(feeds, sources)
+	content := bytes.NewBuffer(nil)
+	packages.StringTo(content)
+
+	files := map[string][]byte{FormatPackages: content.Bytes()}
+	for _, compressor := range agg.compressors {
+		compressed := bytes.NewBuffer(nil)
+		if err := compressor.Compress(compressed, bytes.NewReader(content.Bytes())); err != nil {
+			logErrorf("creating aggregated %q: %v", FormatPackages+compressor.Ext, err)
+			continue
+		}
+		files[FormatPackages+compressor.Ext] = compressed.Bytes()
+	}
+
+	agg.sources, agg.files = sources, files
+	agg.modtime = packages.NewestModTime()
+	if agg.modtime.IsZero() {
+		agg.modtime = time.Now()
+	}
+	return agg.modtime, agg.files
+}
+
+// merges the packages of 'feeds' (their indices given in 'indices') into
+// one index, named by their path relative to "/". a package (same name, version and architecture)
+// contained in several feeds is listed only once, from the first feed
+// it was found in.
+func aggregatePackages(feeds []*Feed, indices []*PackageIndex) *PackageIndex {
+	packages := &PackageIndex{Entries: make(map[string]*Ipkg)}
+	seen := make(map[string]string)
+	for i, feed := range feeds {
+		index := indices[i]
+		dir := strings.Trim(feed.Prefix, "/")
+		for _, name := range index.SortedNames() {
+			ipkg := *index.Entries[name]
+			ipkg.Name = path.Join(dir, name)
+
+			key := ipkg.Header["Package"] + " " + ipkg.Header["Version"] + " " + ipkg.Header["Architecture"]
+			if first, ok := seen[key]; ok {
+				logDebugf("aggregated index: %q is the same package as %q, skipped", ipkg.Name, first)
+				continue
+			}
+			seen[key] = ipkg.Name
+			packages.Add(ipkg.Name, &ipkg)
+		}
+	}
+	return packages
+}
+
+// returns the feeds containing packages, sorted by their prefix
+func (repo *Repository) Feeds() []*Feed {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	feeds := make([]*Feed, 0, len(repo.feeds))
+	for _, feed := range repo.feeds {
+		if packages := feed.Packages(); packages != nil && len(packages.Entries) > 0 {
+			feeds = append(feeds, feed)
+		}
+	}
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].Prefix < feeds[j].Prefix })
+	return feeds
+}
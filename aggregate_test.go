@@ -0,0 +1,65 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// the "Filename" fields of the stanzas in 'index'
+func indexFilenames(index []byte) []string {
+	filenames := []string{}
+	for _, line := range strings.Split(string(index), "\n") {
+		if strings.HasPrefix(line, "Filename: ") {
+			filenames = append(filenames, strings.TrimPrefix(line, "Filename: "))
+		}
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+func TestAggregateIndex(t *testing.T) {
+	root := mkdirs(t, "arm", "mips/sub", "docs")
+	writeIpk(t, filepath.Join(root, "arm"), "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	writeIpk(t, filepath.Join(root, "mips", "sub"), "foo_1.0_mips.ipk", testControl("foo", "1.0", "mips"))
+	// the same package in another feed is listed once
+	writeIpk(t, filepath.Join(root, "mips", "sub"), "foo-copy_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+
+	repo := testRepository(Mount{root, ""})
+	repo.Aggregate = true
+	repo.Compressors = []Compressor{{"gzip", ".gz", GzGolang}}
+	repo.Scan()
+
+	expected := []string{"arm/foo_1.0_arm.ipk", "mips/sub/foo_1.0_mips.ipk"}
+	filenames := indexFilenames(getBody(t, repo, "/Packages"))
+	if !reflect.DeepEqual(filenames, expected) {
+		t.Errorf("GET /Packages: got the Filenames %q, expected %q", filenames, expected)
+	}
+	for _, filename := range filenames {
+		if code := getStatus(repo, "/"+filename); code != http.StatusOK {
+			t.Errorf("GET /%s: got %d, expected 200", filename, code)
+		}
+	}
+	if got := indexFilenames(gunzip(t, getBody(t, repo, "/Packages.gz"))); !reflect.DeepEqual(got, expected) {
+		t.Errorf("GET /Packages.gz: got the Filenames %q, expected %q", got, expected)
+	}
+
+	// rebuilt after a rescan
+	writeIpk(t, filepath.Join(root, "docs"), "doc_1.0_all.ipk", testControl("doc", "1.0", "all"))
+	repo.Scan()
+	expected = []string{"arm/foo_1.0_arm.ipk", "docs/doc_1.0_all.ipk", "mips/sub/foo_1.0_mips.ipk"}
+	if got := indexFilenames(getBody(t, repo, "/Packages")); !reflect.DeepEqual(got, expected) {
+		t.Errorf("GET /Packages after the rescan: got the Filenames %q, expected %q", got, expected)
+	}
+}
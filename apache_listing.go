@@ -0,0 +1,216 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// the width of the name column of mod_autoindex ("NameWidth")
+const apacheNameWidth = 23
+
+// serves the files below 'root' like http.FileServer does, but lists
+// directories (without an index.html) the way apache's mod_autoindex does
+// with "IndexOptions FancyIndexing" and no icons:
+//
+//	<pre><a href="?C=N;O=D">Name</a>                    <a href="?C=M;O=A">Last modified</a> ...<hr>
+//	<a href="foo.txt">foo.txt</a>                 2020-01-01 00:00  1.2K
+//
+// the listing might be sorted via "?C=N|M|S;O=A|D" as well.
+func ApacheListing(root string) http.Handler {
+	return &apacheListing{root: http.Dir(root), files: http.FileServer(http.Dir(root))}
+}
+
+type apacheListing struct {
+	root  http.Dir
+	files http.Handler
+}
+
+func (al *apacheListing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != "GET" && r.Method != "HEAD") || !strings.HasSuffix(r.URL.Path, "/") {
+		al.files.ServeHTTP(w, r)
+		return
+	}
+
+	dir, err := al.root.Open(r.URL.Path)
+	if err != nil {
+		al.files.ServeHTTP(w, r)
+		return
+	}
+	defer dir.Close()
+	if fi, err := dir.Stat(); err != nil || !fi.IsDir() {
+		al.files.ServeHTTP(w, r)
+		return
+	}
+	if index, err := al.root.Open(path.Join(r.URL.Path, "index.html")); err == nil {
+		index.Close()
+		al.files.ServeHTTP(w, r)
+		return
+	}
+
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		http.Error(w, "error reading directory", http.StatusInternalServerError)
+		return
+	}
+
+	// the title shows the path as requested, not the one below 'root'
+	// (see http.StripPrefix)
+	title := r.URL.Path
+	if orig, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		title = orig.Path
+	}
+	if title != "/" {
+		title = strings.TrimSuffix(title, "/")
+	}
+
+	column, desc := apacheSortOrder(r.URL.RawQuery)
+	sortApacheEntries(entries, column, desc)
+
+	listing := bytes.NewBuffer(nil)
+	fmt.Fprintf(listing, "<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 3.2 Final//EN\">\n<html>\n <head>\n  <title>Index of %s</title>\n </head>\n <body>\n<h1>Index of %s</h1>\n",
+		html.EscapeString(title), html.EscapeString(title))
+
+	listing.WriteString("<pre>")
+	for _, col := range []struct{ c, name, pad string }{
+		{"N", "Name", strings.Repeat(" ", apacheNameWidth-3)},
+		{"M", "Last modified", strings.Repeat(" ", 6)},
+		{"S", "Size", "  "},
+		{"D", "Description", ""},
+	} {
+		order := "A"
+		if col.c == column && !desc {
+			order = "D"
+		}
+		fmt.Fprintf(listing, "<a href=\"?C=%s;O=%s\">%s</a>%s", col.c, order, col.name, col.pad)
+	}
+	listing.WriteString("<hr>")
+	if title != "/" {
+		parent := path.Dir(title)
+		if parent != "/" {
+			parent += "/"
+		}
+		fmt.Fprintf(listing, "<a href=\"%s\">Parent Directory</a>%s %16s  %s  \n",
+			html.EscapeString((&url.URL{Path: parent}).String()), apachePad("Parent Directory"), "", "  - ")
+	}
+	for _, fi := range entries {
+		name, size := fi.Name(), apacheSize(fi.Size())
+		if fi.IsDir() {
+			name, size = name+"/", "  - "
+		}
+		href := (&url.URL{Path: name}).String()
+		if strings.Contains(name, ":") {
+			href = "./" + href // not to be taken for a scheme
+		}
+		shown := name
+		if utf8.RuneCountInString(shown) > apacheNameWidth {
+			shown = string([]rune(shown)[:apacheNameWidth-3]) + "..>"
+		}
+		fmt.Fprintf(listing, "<a href=\"%s\">%s</a>%s %s  %s  \n",
+			html.EscapeString(href), html.EscapeString(shown), apachePad(shown),
+			fi.ModTime().Format("2006-01-02 15:04"), size)
+	}
+	listing.WriteString("<hr></pre>\n</body></html>\n")
+
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+	w.Header().Set("Content-Length", fmt.Sprint(listing.Len()))
+	if r.Method == "HEAD" {
+		return
+	}
+	listing.WriteTo(w)
+}
+
+// the spaces filling the name column after 'name'
+func apachePad(name string) string {
+	if n := apacheNameWidth - utf8.RuneCountInString(name); n > 0 {
+		return strings.Repeat(" ", n)
+	}
+	return ""
+}
+
+// parses mod_autoindex's "C=M;O=D" (or "C=M&O=D"), the default is by
+// name, ascending
+func apacheSortOrder(rawQuery string) (column string, desc bool) {
+	column = "N"
+	for _, arg := range strings.FieldsFunc(rawQuery, func(r rune) bool { return r == ';' || r == '&' }) {
+		switch arg {
+		case "C=N", "C=M", "C=S", "C=D":
+			column = arg[2:]
+		case "O=D":
+			desc = true
+		case "O=A":
+			desc = false
+		}
+	}
+	return column, desc
+}
+
+// sorts like mod_autoindex: by 'column' ("N", "M" or "S"), ties by name. a
+// description is never given, "D" sorts by name.
+func sortApacheEntries(entries []os.FileInfo, column string, desc bool) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if desc {
+			a, b = b, a
+		}
+		switch {
+		case column == "M" && !a.ModTime().Equal(b.ModTime()):
+			return a.ModTime().Before(b.ModTime())
+		case column == "S" && apacheSortSize(a) != apacheSortSize(b):
+			return apacheSortSize(a) < apacheSortSize(b)
+		}
+		return a.Name() < b.Name()
+	})
+}
+
+// directories have no size, they come first
+func apacheSortSize(fi os.FileInfo) int64 {
+	if fi.IsDir() {
+		return -1
+	}
+	return fi.Size()
+}
+
+// formats 'size' in the 4 columns mod_autoindex uses (apr_strfsize()):
+// " 12 ", "973 ", "1.0K", " 12K", "1.2M", ...
+func apacheSize(size int64) string {
+	if size < 0 {
+		return "  - "
+	}
+	if size < 973 {
+		return fmt.Sprintf("%3d ", size)
+	}
+	for _, unit := range "KMGTPE" {
+		remain := size & 1023
+		size >>= 10
+		if size >= 973 {
+			continue
+		}
+		if size < 9 || (size == 9 && remain < 973) {
+			if remain = ((remain * 5) + 256) / 512; remain >= 10 {
+				size, remain = size+1, 0
+			}
+			return fmt.Sprintf("%d.%d%c", size, remain, unit)
+		}
+		if remain >= 512 {
+			size++
+		}
+		return fmt.Sprintf("%3d%c", size, unit)
+	}
+	return "  - "
+}
@@ -0,0 +1,56 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// the url-path the static assets of the html listings are served below.
+// a dot-directory, it does not get into the way of the feeds.
+const AssetsPrefix = "/.kellner/"
+
+//go:embed assets
+var builtinAssets embed.FS
+
+// serves "/favicon.ico" and the files below AssetsPrefix (eg, the
+// "kellner.css" of the listings). a file in 'dir' (-assets-dir) replaces
+// the built-in one of the same name; other files of 'dir' are served as
+// well.
+func assetsHandler(dir string) http.Handler {
+	builtin, _ := fs.Sub(builtinAssets, "assets")
+	assets := []http.FileSystem{http.FS(builtin)}
+	if dir != "" {
+		assets = append([]http.FileSystem{http.Dir(dir)}, assets...)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, AssetsPrefix))
+		for _, fsys := range assets {
+			file, err := fsys.Open(name)
+			if err != nil {
+				continue
+			}
+			fi, err := file.Stat()
+			if err != nil || fi.IsDir() {
+				file.Close()
+				continue
+			}
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			http.ServeContent(w, r, fi.Name(), fi.ModTime(), file)
+			file.Close()
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the -basic-auth flag: "user:passhash", repeated or comma separated.
+// 'passhash' is a bcrypt hash ("$2y$..."), eg. created by 'htpasswd -nB'.
+type basicAuthFlag map[string]string
+
+func (users basicAuthFlag) String() string {
+	names := make([]string, 0, len(users))
+	for name, passhash := range users {
+		names = append(names, name+":"+passhash)
+	}
+	return strings.Join(names, ",")
+}
+
+func (users basicAuthFlag) Set(value string) error {
+	for _, value := range splitList(value) {
+		i := strings.IndexByte(value, ':')
+		if i < 1 {
+			return fmt.Errorf("expected user:passhash, got %q", value)
+		}
+		name, passhash := value[:i], value[i+1:]
+		if _, err := bcrypt.Cost([]byte(passhash)); err != nil {
+			return fmt.Errorf("hash of %q: %v", name, err)
+		}
+		users[name] = passhash
+	}
+	return nil
+}
+
+// lets only requests with http basic credentials matching 'users' through
+// to 'handler'. with 'allowCert' a request carrying a client-cert passes
+// as well (see requireClientCert()), so devices can use either.
+//
+// checking a hash is expensive on purpose: the credentials which matched
+// once are remembered (by their sha256) and not checked again.
+func requireBasicAuth(handler http.Handler, users map[string]string, allowCert bool) http.Handler {
+	var (
+		mu       sync.Mutex
+		verified = make(map[[sha256.Size]byte]bool)
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowCert && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		name, password, ok := r.BasicAuth()
+		if ok {
+			key := sha256.Sum256([]byte(name + ":" + password))
+			mu.Lock()
+			ok = verified[key]
+			mu.Unlock()
+			if !ok {
+				passhash, known := users[name]
+				ok = known && bcrypt.CompareHashAndPassword([]byte(passhash), []byte(password)) == nil
+				if ok {
+					mu.Lock()
+					verified[key] = true
+					mu.Unlock()
+				}
+			}
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kellner"`)
+			writeError(http.StatusUnauthorized, w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
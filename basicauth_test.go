@@ -0,0 +1,102 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// "allmine", from the tests of golang.org/x/crypto/bcrypt. htpasswd -B
+// writes "$2y$", which is the same algorithm.
+const (
+	testBcrypt  = "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga"
+	testBcrypt2 = "$2y$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga"
+)
+
+func TestBasicAuthFlag(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected map[string]string // nil: an error
+	}{
+		{"box:" + testBcrypt, map[string]string{"box": testBcrypt}},
+		{"box:" + testBcrypt + ",ci:" + testBcrypt2, map[string]string{"box": testBcrypt, "ci": testBcrypt2}},
+		{"box", nil},
+		{":" + testBcrypt, nil},
+		{"box:secret", nil},
+		{"box:$2y$10$abcdefghijklmnopqrstuv", nil},
+		{"box:$2a$32$sssssssssssssssssssssshhhhhhhhhhhhhhhhhhhhhhhhhhhhhhh", nil},
+		{"box:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", nil},
+	} {
+		users := make(basicAuthFlag)
+		err := users.Set(test.value)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("Set(%q): expected an error, got %v", test.value, users)
+			}
+			continue
+		}
+		if err != nil || len(users) != len(test.expected) {
+			t.Errorf("Set(%q): got %v %v, expected %v", test.value, users, err, test.expected)
+			continue
+		}
+		for name, passhash := range test.expected {
+			if users[name] != passhash {
+				t.Errorf("Set(%q): got %v, expected %v", test.value, users, test.expected)
+			}
+		}
+	}
+}
+
+func TestRequireBasicAuth(t *testing.T) {
+	users := map[string]string{"box": testBcrypt, "ci": testBcrypt2}
+	cert := testCertificate(t, pkix.Name{CommonName: "box-1"})
+	// the verified credentials are remembered across requests
+	handlers := map[bool]http.Handler{
+		false: requireBasicAuth(bodyHandler("feed"), users, false),
+		true:  requireBasicAuth(bodyHandler("feed"), users, true),
+	}
+	for _, test := range []struct {
+		allowCert      bool
+		cert           *x509.Certificate
+		user, password string // "": no credentials
+		code           int
+	}{
+		{false, nil, "", "", http.StatusUnauthorized},
+		{false, nil, "box", "allmine", http.StatusOK},
+		// remembered, still matched against the password
+		{false, nil, "box", "allmine", http.StatusOK},
+		{false, nil, "box", "Allmine", http.StatusUnauthorized},
+		{false, nil, "box", "", http.StatusUnauthorized},
+		{false, nil, "ci", "allmine", http.StatusOK},
+		{false, nil, "other", "allmine", http.StatusUnauthorized},
+		{false, cert, "", "", http.StatusUnauthorized},
+		{true, cert, "", "", http.StatusOK},
+		{true, nil, "", "", http.StatusUnauthorized},
+		{true, nil, "box", "allmine", http.StatusOK},
+	} {
+		handler := handlers[test.allowCert]
+		r := clientRequest("/arm/Packages", test.cert)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("allowCert: %v, cert: %v, user %q: got %d, expected %d", test.allowCert, test.cert != nil, test.user, w.Code, test.code)
+		}
+		challenge := w.Header().Get("WWW-Authenticate")
+		if (w.Code == http.StatusUnauthorized) != (challenge == `Basic realm="kellner"`) {
+			t.Errorf("allowCert: %v, cert: %v, user %q: got %d with WWW-Authenticate %q", test.allowCert, test.cert != nil, test.user, w.Code, challenge)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// caches the results of NewIpkgFromFile() in 'FileName' (eg.
+// .kellner-cache.json), keyed by the full path of the package. an entry
+// is only valid as long as size and mtime of the package stay the same;
+// on a hit the package is not read at all.
+//
+// the file is written by Save(): at the end of each Scan(), every minute
+// (for the feeds rebuilt in between, eg. by -watch) and on shutdown.
+type IpkgCache struct {
+	FileName string
+
+	saving sync.Mutex // serializes Save()
+
+	mu      sync.Mutex
+	entries map[string]ipkgCacheEntry
+	changes uint64 // counts the changes of 'entries'
+	saved   uint64 // 'changes' as of the last successful Save()
+}
+
+type ipkgCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // unix nano-seconds
+	Control string `json:"control"`
+	Md5     string `json:"md5,omitempty"`
+	Sha1    string `json:"sha1,omitempty"`
+	Sha256  string `json:"sha256,omitempty"`
+
+	// unix seconds, 0: unknown. nil in entries written before kellner
+	// knew about build dates, those are read again.
+	BuildDate *int64 `json:"build_date,omitempty"`
+}
+
+func LoadIpkgCache(fileName string) (*IpkgCache, error) {
+	cache := &IpkgCache{FileName: fileName, entries: make(map[string]ipkgCacheEntry)}
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &cache.entries); err != nil {
+		return nil, fmt.Errorf("parsing -cache %q: %v", fileName, err)
+	}
+	return cache, nil
+}
+
+// returns the cached Ipkg for 'name' in 'dir', if the cache holds an
+// entry matching the current size and mtime of the file and containing
+// all the checksums asked for by 'opts'.
+func (cache *IpkgCache) Lookup(name, dir string, opts *ScanOptions) (*Ipkg, bool) {
+	fullName := filepath.Join(dir, name)
+	fi, err := os.Stat(fullName)
+	if err != nil {
+		return nil, false
+	}
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[fullName]
+	cache.mu.Unlock()
+
+	if !ok || entry.Size != fi.Size() || entry.ModTime != fi.ModTime().UnixNano() ||
+		(opts.Md5 && entry.Md5 == "") || (opts.Sha1 && entry.Sha1 == "") || (opts.Sha256 && entry.Sha256 == "") || entry.BuildDate == nil {
+		return nil, false
+	}
+
+	ipkg := &Ipkg{Name: name, Control: entry.Control, Header: make(map[string]string), FileInfo: fi}
+	if err := ipkg.ControlToHeader(entry.Control); err != nil {
+		return nil, false
+	}
+	if *entry.BuildDate != 0 {
+		ipkg.BuildDate = time.Unix(*entry.BuildDate, 0).UTC()
+	}
+	if opts.Md5 {
+		ipkg.Md5 = entry.Md5
+	}
+	if opts.Sha1 {
+		ipkg.Sha1 = entry.Sha1
+	}
+	if opts.Sha256 {
+		ipkg.Sha256 = entry.Sha256
+	}
+	return ipkg, true
+}
+
+// stores the freshly read 'ipkg' of 'dir'
+func (cache *IpkgCache) Store(dir string, ipkg *Ipkg) {
+	entry := ipkgCacheEntry{
+		Size:    ipkg.FileInfo.Size(),
+		ModTime: ipkg.FileInfo.ModTime().UnixNano(),
+		Control: ipkg.Control,
+		Md5:     ipkg.Md5,
+		Sha1:    ipkg.Sha1,
+		Sha256:  ipkg.Sha256,
+	}
+	var buildDate int64
+	if !ipkg.BuildDate.IsZero() {
+		buildDate = ipkg.BuildDate.Unix()
+	}
+	entry.BuildDate = &buildDate
+
+	cache.mu.Lock()
+	cache.entries[filepath.Join(dir, ipkg.Name)] = entry
+	cache.changes++
+	cache.mu.Unlock()
+}
+
+// drops the entries of packages in 'dir' which are not in 'names' anymore
+func (cache *IpkgCache) Retain(dir string, names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[filepath.Join(dir, name)] = true
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for fullName := range cache.entries {
+		if filepath.Dir(fullName) == filepath.Clean(dir) && !keep[fullName] {
+			delete(cache.entries, fullName)
+			cache.changes++
+		}
+	}
+}
+
+// writes the cache to 'FileName', if it changed since the last successful
+// Save(). the scans are held up only while the cache is encoded, not while
+// it is written.
+func (cache *IpkgCache) Save() error {
+	cache.saving.Lock()
+	defer cache.saving.Unlock()
+
+	cache.mu.Lock()
+	changes := cache.changes
+	if changes == cache.saved {
+		cache.mu.Unlock()
+		return nil
+	}
+	content, err := json.Marshal(cache.entries)
+	cache.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write + rename: a crash while writing does not wreck the old cache
+	tmpName := cache.FileName + ".tmp"
+	if err = ioutil.WriteFile(tmpName, content, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, cache.FileName); err != nil {
+		return err
+	}
+
+	// the changes made meanwhile are left for the next Save()
+	cache.mu.Lock()
+	cache.saved = changes
+	cache.mu.Unlock()
+	return nil
+}
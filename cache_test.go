@@ -0,0 +1,88 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIpkgCacheSave(t *testing.T) {
+	dir, state := t.TempDir(), filepath.Join(t.TempDir(), "state")
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	fileName := filepath.Join(state, "cache.json")
+
+	cache, err := LoadIpkgCache(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &ScanOptions{Workers: NewWorkerPool(2), Sha256: true, Cache: cache}
+	if _, err := ScanDirectoryForPackages(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the caller saves, eg. once per Scan(). a failed Save() is retried.
+	if err := cache.Save(); err == nil {
+		t.Fatalf("Save(): expected an error, %q does not exist", state)
+	}
+	if err := os.Mkdir(state, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadIpkgCache(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipkg, ok := loaded.Lookup("foo_1.0_arm.ipk", dir, opts)
+	if !ok {
+		t.Fatalf("Lookup(): missing the saved entry")
+	}
+	if ipkg.Header["Package"] != "foo" || ipkg.Sha256 == "" {
+		t.Errorf("Lookup(): got %v, sha256 %q", ipkg.Header, ipkg.Sha256)
+	}
+
+	// asking for another checksum is a miss
+	if _, ok := loaded.Lookup("foo_1.0_arm.ipk", dir, &ScanOptions{Md5: true}); ok {
+		t.Errorf("Lookup(): a hit without the md5")
+	}
+}
+
+// each directory adds to the cache, Scan() saves it once at the end
+func TestScanSavesCache(t *testing.T) {
+	root := mkdirs(t, "arm", "mips")
+	writeIpk(t, filepath.Join(root, "arm"), "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	fileName := filepath.Join(t.TempDir(), "cache.json")
+
+	cache, err := LoadIpkgCache(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := testRepository(Mount{root, ""})
+	repo.ScanOpts.Cache = cache
+
+	if _, err := ScanDirectoryForPackages(filepath.Join(root, "arm"), repo.ScanOpts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("ScanDirectoryForPackages() wrote the -cache: %v", err)
+	}
+
+	repo.Scan()
+	loaded, err := LoadIpkgCache(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Lookup("foo_1.0_arm.ipk", filepath.Join(root, "arm"), repo.ScanOpts); !ok {
+		t.Errorf("Scan() did not save the -cache")
+	}
+}
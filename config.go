@@ -0,0 +1,243 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	configFlagName      = "config" // the config-file itself, not allowed inside of it
+	printConfigFlagName = "print-config"
+)
+
+// reads the config-file 'Name' and applies its values to the flags of
+// 'Flags' which were not given on the command line. the file contains
+// one "flag = value" per line, named like the command line flags:
+//
+//	# comment
+//	root = /srv/packages
+//	compress = gzip,xz
+//	ssl-key = "/etc/kellner/key.pem"
+//
+// unknown flags are an error. Reload() reads it again later on.
+type ConfigReloader struct {
+	Name  string
+	Flags *flag.FlagSet
+
+	// the flags which can change while running: applies the new value
+	// (the default if its line is gone), see Reload()
+	Reloadable map[string]func(value string) error
+
+	cmdLine map[string]bool     // the flags given on the command line
+	values  map[string][]string // of the file, by flag, as in effect
+}
+
+// the initial read of the config-file, returns the names of the flags set
+// from the file
+func (cr *ConfigReloader) Load() (map[string]bool, error) {
+	values, err := readConfigFile(cr.Name, cr.Flags)
+	if err != nil {
+		return nil, err
+	}
+
+	cr.cmdLine = make(map[string]bool)
+	cr.Flags.Visit(func(f *flag.Flag) { cr.cmdLine[f.Name] = true })
+
+	fromFile := make(map[string]bool)
+	for _, value := range values {
+		if cr.cmdLine[value.name] {
+			continue
+		}
+		if err := cr.Flags.Set(value.name, value.value); err != nil {
+			return nil, fmt.Errorf("%q, line %d: %v", cr.Name, value.line, err)
+		}
+		fromFile[value.name] = true
+	}
+	cr.values = configValuesByFlag(values)
+	return fromFile, nil
+}
+
+// reads the config-file again (eg. on SIGHUP) and applies the flags which
+// changed since: the Reloadable ones take effect right away, any other one
+// needs a restart, which is logged. so is a value not applicable. flags
+// given on the command line still take precedence. returns an error (and
+// changes nothing) if the file is not readable or invalid. not safe for
+// concurrent use.
+func (cr *ConfigReloader) Reload() error {
+	values, err := readConfigFile(cr.Name, cr.Flags)
+	if err != nil {
+		return err
+	}
+
+	next := configValuesByFlag(values)
+	names := make([]string, 0, len(next))
+	for name := range next {
+		names = append(names, name)
+	}
+	for name := range cr.values {
+		if _, ok := next[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if cr.cmdLine[name] || equalStrings(cr.values[name], next[name]) {
+			continue
+		}
+		value := cr.Flags.Lookup(name).DefValue
+		if lines := next[name]; len(lines) > 0 {
+			value = lines[len(lines)-1] // the last one wins, like on the command line
+		}
+
+		apply, ok := cr.Reloadable[name]
+		if !ok {
+			err = fmt.Errorf("changing it needs a restart")
+		} else {
+			err = apply(value)
+		}
+		if err != nil {
+			prev, had := cr.values[name]
+			current := cr.Flags.Lookup(name).Value.String()
+			if apply != nil { // might have been reloaded since
+				current = cr.Flags.Lookup(name).DefValue
+				if had {
+					current = prev[len(prev)-1]
+				}
+			}
+			if had {
+				next[name] = prev
+			} else {
+				delete(next, name)
+			}
+			logErrorf("-%s %q: %s = %q: %v, keeping %q", configFlagName, cr.Name, name, value, err, current)
+			continue
+		}
+		logInfof("-%s %q: %s = %q", configFlagName, cr.Name, name, value)
+	}
+	cr.values = next
+	return nil
+}
+
+// reads and parses the config-file 'name', all flags must be in 'flags'
+func readConfigFile(name string, flags *flag.FlagSet) ([]configValue, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values, err := parseConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", name, err)
+	}
+	for _, value := range values {
+		if flags.Lookup(value.name) == nil || value.name == configFlagName || value.name == printConfigFlagName {
+			return nil, fmt.Errorf("%q, line %d: unknown flag %q", name, value.line, value.name)
+		}
+	}
+	return values, nil
+}
+
+func configValuesByFlag(values []configValue) map[string][]string {
+	byFlag := make(map[string][]string)
+	for _, value := range values {
+		byFlag[value.name] = append(byFlag[value.name], value.value)
+	}
+	return byFlag
+}
+
+// flags holding secrets, their values are not shown by PrintConfigTo()
+var secretFlags = map[string]bool{"admin-token": true, "basic-auth": true}
+
+// writes the effective value of every flag in 'flags' in the format of
+// the config-file (so the output can be used as -config), along with where the value came from: the default,
+// the -config file (named in 'fromFile') or the command line.
+func PrintConfigTo(w io.Writer, flags *flag.FlagSet, fromFile map[string]bool) {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlagName || f.Name == printConfigFlagName {
+			return
+		}
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		if value == "" || strings.TrimSpace(value) != value || strings.ContainsAny(value, "\"#") {
+			value = strconv.Quote(value)
+		}
+		source := "default"
+		if fromFile[f.Name] {
+			source = "-" + configFlagName
+		} else if given[f.Name] {
+			source = "command line"
+		}
+		fmt.Fprintf(w, "%-20s = %-40s # %s\n", f.Name, value, source)
+	})
+}
+
+type configValue struct {
+	name  string
+	value string
+	line  int
+}
+
+// parses the "flag = value" lines of a config-file. a value might be
+// enclosed in double quotes (go syntax), eg. to keep surrounding spaces
+// or a '#'. otherwise a " #" starts a comment.
+func parseConfig(r io.Reader) ([]configValue, error) {
+	var (
+		values  = make([]configValue, 0)
+		scanner = bufio.NewScanner(r)
+		n       int
+	)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("line %d: expected \"flag = value\", got %q", n, line)
+		}
+		name := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err == nil && !isConfigComment(value[len(quoted):]) {
+				err = fmt.Errorf("trailing garbage")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value %s", n, value)
+			}
+			value, _ = strconv.Unquote(quoted)
+		} else if i := strings.Index(value, " #"); i != -1 {
+			value = strings.TrimSpace(value[:i])
+		}
+		values = append(values, configValue{name, value, n})
+	}
+	return values, scanner.Err()
+}
+
+// reports if 'rest' is empty or a comment
+func isConfigComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || rest[0] == '#'
+}
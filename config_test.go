@@ -0,0 +1,251 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, test := range []struct {
+		content  string
+		expected []configValue // nil: an error
+	}{
+		{"", []configValue{}},
+		{"# comment\n\n  # indented comment\n", []configValue{}},
+		{"root = /srv/packages\n", []configValue{{"root", "/srv/packages", 1}}},
+		{"\n  workers=4  \nroot = /a\nroot = /b\n", []configValue{{"workers", "4", 2}, {"root", "/a", 3}, {"root", "/b", 4}}},
+		{"compress = gzip,xz # no bzip2\n", []configValue{{"compress", "gzip,xz", 1}}},
+		{"client-map = a#b\n", []configValue{{"client-map", "a#b", 1}}},
+		{"ssl-key = \" /k.pem # \" # spaces kept\n", []configValue{{"ssl-key", " /k.pem # ", 1}}},
+		{"empty =\n", []configValue{{"empty", "", 1}}},
+		{"empty = \"\"\n", []configValue{{"empty", "", 1}}},
+		{"root /srv/packages\n", nil},
+		{"ssl-key = \"/k.pem\n", nil},
+		{"ssl-key = \"/k.pem\" garbage\n", nil},
+	} {
+		values, err := parseConfig(strings.NewReader(test.content))
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("parseConfig(%q): expected an error, got %v", test.content, values)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("parseConfig(%q): got %v %v, expected %v", test.content, values, err, test.expected)
+		}
+	}
+}
+
+// some of kellner's flags, the values of -root are appended to 'roots'
+func testConfigFlags(roots *[]string) *flag.FlagSet {
+	flags := flag.NewFlagSet("kellner", flag.ContinueOnError)
+	flags.String(configFlagName, "", "")
+	flags.Bool(printConfigFlagName, false, "")
+	flags.Func("root", "", func(value string) error { *roots = append(*roots, value); return nil })
+	flags.Int("workers", 4, "")
+	flags.String("compress", "gzip", "")
+	flags.String("ssl-key", "", "")
+	flags.String("admin-token", "", "")
+	flags.String("basic-auth", "", "")
+	return flags
+}
+
+func TestConfigLoad(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kellner.conf")
+	for _, test := range []struct {
+		content  string
+		cmdLine  []string
+		expected map[string]string // the flags' values, nil: an error
+		fromFile map[string]bool
+		roots    []string
+	}{
+		{"# sample\nroot = /srv/a\nroot = /srv/b\nworkers = 8\nssl-key = \"/etc/kellner/key.pem\"\n", nil,
+			map[string]string{"workers": "8", "compress": "gzip", "ssl-key": "/etc/kellner/key.pem"},
+			map[string]bool{"root": true, "workers": true, "ssl-key": true}, []string{"/srv/a", "/srv/b"}},
+		// the command line takes precedence
+		{"workers = 8\ncompress = xz\n", []string{"-workers", "2"},
+			map[string]string{"workers": "2", "compress": "xz"}, map[string]bool{"compress": true}, nil},
+		{"bogus = 1\n", nil, nil, nil, nil},
+		{"config = other.conf\n", nil, nil, nil, nil},
+		{"print-config = true\n", nil, nil, nil, nil},
+		{"workers = many\n", nil, nil, nil, nil},
+		{"workers\n", nil, nil, nil, nil},
+	} {
+		writeTestFile(t, name, test.content)
+		var roots []string
+		flags := testConfigFlags(&roots)
+		if err := flags.Parse(test.cmdLine); err != nil {
+			t.Fatal(err)
+		}
+
+		fromFile, err := (&ConfigReloader{Name: name, Flags: flags}).Load()
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("Load(%q): expected an error", test.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Load(%q): %v", test.content, err)
+			continue
+		}
+		for flagName, value := range test.expected {
+			if got := flags.Lookup(flagName).Value.String(); got != value {
+				t.Errorf("Load(%q): got -%s %q, expected %q", test.content, flagName, got, value)
+			}
+		}
+		if !reflect.DeepEqual(fromFile, test.fromFile) {
+			t.Errorf("Load(%q): got %v from the file, expected %v", test.content, fromFile, test.fromFile)
+		}
+		if !reflect.DeepEqual(roots, test.roots) {
+			t.Errorf("Load(%q): got the roots %q, expected %q", test.content, roots, test.roots)
+		}
+	}
+
+	if _, err := (&ConfigReloader{Name: name + ".missing", Flags: testConfigFlags(new([]string))}).Load(); err == nil {
+		t.Errorf("Load(): expected an error for a missing file")
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kellner.conf")
+	writeTestFile(t, name, "log-level = warn\nworkers = 2\nbind = :80\n")
+
+	flags := flag.NewFlagSet("kellner", flag.ContinueOnError)
+	flags.String("log-level", "info", "")
+	flags.String("compress-timeout", "30s", "")
+	workers := flags.Int("workers", 4, "")
+	bind := flags.String("bind", ":8080", "")
+	flags.Parse([]string{"-bind", ":443"})
+
+	applied := make(map[string]string)
+	reloader := &ConfigReloader{Name: name, Flags: flags}
+	reloader.Reloadable = map[string]func(string) error{
+		"log-level": func(value string) error {
+			if _, err := ParseLogLevel(value); err != nil {
+				return err
+			}
+			applied["log-level"] = value
+			return nil
+		},
+		"compress-timeout": func(value string) error {
+			applied["compress-timeout"] = value
+			return nil
+		},
+	}
+
+	fromFile, err := reloader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromFile, map[string]bool{"log-level": true, "workers": true}) {
+		t.Errorf("Load(): got %v from the file", fromFile)
+	}
+	if *workers != 2 || *bind != ":443" {
+		t.Errorf("Load(): got -workers %d -bind %q, expected 2 and the command line's :443", *workers, *bind)
+	}
+
+	for _, test := range []struct {
+		content string
+		applied map[string]string
+	}{
+		// unchanged
+		{"log-level = warn\nworkers = 2\nbind = :80\n", map[string]string{}},
+		// the command line takes precedence, -workers needs a restart
+		{"log-level = debug\nworkers = 3\nbind = :81\n", map[string]string{"log-level": "debug"}},
+		// an invalid value is not applied, tried again on the next reload
+		{"log-level = loud\nworkers = 3\ncompress-timeout = 1m\n", map[string]string{"compress-timeout": "1m"}},
+		{"log-level = loud\nworkers = 3\ncompress-timeout = 1m\n", map[string]string{}},
+		// gone from the file: the default
+		{"workers = 3\n", map[string]string{"log-level": "info", "compress-timeout": "30s"}},
+	} {
+		writeTestFile(t, name, test.content)
+		for key := range applied {
+			delete(applied, key)
+		}
+		if err := reloader.Reload(); err != nil {
+			t.Errorf("Reload(%q): %v", test.content, err)
+		}
+		if !reflect.DeepEqual(applied, test.applied) {
+			t.Errorf("Reload(%q): applied %v, expected %v", test.content, applied, test.applied)
+		}
+		if *workers != 2 || *bind != ":443" {
+			t.Errorf("Reload(%q): changed -workers %d -bind %q", test.content, *workers, *bind)
+		}
+	}
+
+	// an invalid file changes nothing
+	writeTestFile(t, name, "log-level = warn\nbogus = 1\n")
+	for key := range applied {
+		delete(applied, key)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("Reload(): expected an error for the unknown flag")
+	}
+	if len(applied) != 0 {
+		t.Errorf("Reload(): applied %v of an invalid file", applied)
+	}
+}
+
+func TestPrintConfigTo(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kellner.conf")
+	writeTestFile(t, name, "workers = 8\ncompress = xz\nadmin-token = s3cret\n")
+	flags := testConfigFlags(new([]string))
+	flags.Parse([]string{"-config", name, "-compress", "gzip,zstd", "-ssl-key", " /k.pem#1"})
+	fromFile, err := (&ConfigReloader{Name: name, Flags: flags}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.NewBuffer(nil)
+	PrintConfigTo(out, flags, fromFile)
+	if strings.Contains(out.String(), "s3cret") {
+		t.Errorf("PrintConfigTo(): the -admin-token is shown:\n%s", out)
+	}
+
+	type printed struct{ value, source string }
+	expected := map[string]printed{
+		"root":        {"", "default"},
+		"workers":     {"8", "-config"},
+		"compress":    {"gzip,zstd", "command line"},
+		"ssl-key":     {" /k.pem#1", "command line"},
+		"admin-token": {"<redacted>", "-config"},
+		"basic-auth":  {"", "default"},
+	}
+	// the output is a valid -config, the source is a comment
+	values, err := parseConfig(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("PrintConfigTo(): %v:\n%s", err, out)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(values) {
+		t.Fatalf("PrintConfigTo(): got %d lines, %d values:\n%s", len(lines), len(values), out)
+	}
+	got := make(map[string]printed)
+	for i, line := range lines {
+		got[values[i].name] = printed{values[i].value, strings.TrimSpace(line[strings.LastIndex(line, " # ")+3:])}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("PrintConfigTo(): got %v, expected %v:\n%s", got, expected, out)
+	}
+}
@@ -0,0 +1,141 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// the -crl file: the revocation lists (PEM "X509 CRL" blocks or a single
+// DER one) of the -ssl-client-cas. a client-certificate listed as revoked
+// fails the tls handshake. each list must be signed by one of the CAs,
+// lists of other issuers are an error.
+type CRL struct {
+	FileName string
+	CAs      []*x509.Certificate // the -ssl-client-cas
+
+	mu      sync.RWMutex
+	revoked map[string]bool // by issuer (raw) + serial number
+}
+
+func LoadCRL(fileName, casFileName string) (*CRL, error) {
+	content, err := ioutil.ReadFile(casFileName)
+	if err != nil {
+		return nil, err
+	}
+	crl := &CRL{FileName: fileName}
+	for {
+		var block *pem.Block
+		if block, content = pem.Decode(content); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			crl.CAs = append(crl.CAs, cert)
+		}
+	}
+	return crl, crl.Reload()
+}
+
+// reads 'FileName' again. on error the current lists stay in place.
+func (crl *CRL) Reload() error {
+	content, err := ioutil.ReadFile(crl.FileName)
+	if err != nil {
+		return err
+	}
+
+	ders := make([][]byte, 0)
+	for rest := content; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, content) // not PEM, maybe DER
+	}
+
+	revoked := make(map[string]bool)
+	for _, der := range ders {
+		list, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("%q: %v", crl.FileName, err)
+		}
+		if err = crl.checkSignature(list); err != nil {
+			return fmt.Errorf("%q: %v", crl.FileName, err)
+		}
+		if !list.NextUpdate.IsZero() && list.NextUpdate.Before(time.Now()) {
+			logWarnf("the crl of %q in %q is outdated since %s", list.Issuer, crl.FileName, list.NextUpdate)
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			revoked[crlKey(list.RawIssuer, entry.SerialNumber.Bytes())] = true
+		}
+	}
+
+	crl.mu.Lock()
+	crl.revoked = revoked
+	crl.mu.Unlock()
+	logInfof("loaded %d revoked certs from %q", len(revoked), crl.FileName)
+	return nil
+}
+
+func (crl *CRL) checkSignature(list *x509.RevocationList) error {
+	for _, ca := range crl.CAs {
+		if bytes.Equal(ca.RawSubject, list.RawIssuer) && list.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("the crl of %q is not signed by one of the -ssl-client-cas", list.Issuer)
+}
+
+func crlKey(rawIssuer, serial []byte) string {
+	return string(rawIssuer) + "\x00" + string(serial)
+}
+
+// reports if 'cert' is revoked
+func (crl *CRL) Revoked(cert *x509.Certificate) bool {
+	crl.mu.RLock()
+	defer crl.mu.RUnlock()
+	return crl.revoked[crlKey(cert.RawIssuer, cert.SerialNumber.Bytes())]
+}
+
+// for tls.Config: fails the handshake if the client-certificate (or one of
+// the intermediates it was verified by) is revoked
+func (crl *CRL) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil // no client-cert, see requireClientCert()
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	certs := []*x509.Certificate{leaf}
+	for _, chain := range verifiedChains {
+		certs = append(certs, chain...)
+	}
+	for _, cert := range certs {
+		if crl.Revoked(cert) {
+			logInfof("rejected client-cert of %q: %q (serial %s) is revoked", clientIdByName(&leaf.Subject), clientIdByName(&cert.Subject), cert.SerialNumber)
+			return fmt.Errorf("certificate %s is revoked", cert.SerialNumber)
+		}
+	}
+	return nil
+}
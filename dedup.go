@@ -0,0 +1,100 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"path"
+	"sort"
+	"sync"
+)
+
+// finds packages with the same content (by sha256) across all feeds,
+// eg. a package symlinked into several feeds. the Packages index of each
+// feed still lists all of them, only the html listing refers to the first
+// copy (by url-path) instead.
+//
+// like the aggregated index, the duplicates are only searched again if
+// the index of any feed changed.
+type Duplicates struct {
+	Feeds func() []*Feed
+
+	mu         sync.Mutex
+	sources    []*PackageIndex // the feed indices 'paths' was built from
+	generation int             // incremented whenever 'paths' changes
+	paths      map[string][]string
+}
+
+// returns the url-paths of the packages sharing their content with
+// another package, by sha256. the paths of each sha256 are sorted.
+// newly found duplicates are logged.
+func (dups *Duplicates) current() (int, map[string][]string) {
+	feeds := dups.Feeds()
+	sources := make([]*PackageIndex, len(feeds))
+	for i, feed := range feeds {
+		sources[i] = feed.Packages()
+	}
+
+	dups.mu.Lock()
+	defer dups.mu.Unlock()
+
+	if dups.paths != nil && len(sources) == len(dups.sources) {
+		unchanged := true
+		for i := range sources {
+			unchanged = unchanged && sources[i] == dups.sources[i]
+		}
+		if unchanged {
+			return dups.generation, dups.paths
+		}
+	}
+
+	bySum := make(map[string][]string)
+	for i, feed := range feeds {
+		for name, ipkg := range sources[i].Entries {
+			if ipkg.Sha256 != "" {
+				bySum[ipkg.Sha256] = append(bySum[ipkg.Sha256], path.Join(feed.Prefix, name))
+			}
+		}
+	}
+	paths := make(map[string][]string)
+	for sum, pkgPaths := range bySum {
+		if len(pkgPaths) < 2 {
+			continue
+		}
+		sort.Strings(pkgPaths)
+		paths[sum] = pkgPaths
+		if !equalStrings(dups.paths[sum], pkgPaths) {
+			logWarnf("%d packages with the same content (sha256 %s): %v", len(pkgPaths), sum, pkgPaths)
+		}
+	}
+
+	dups.sources, dups.paths = sources, paths
+	dups.generation++
+	return dups.generation, dups.paths
+}
+
+// returns the url-path of the first package with the same content as
+// 'pkgPath', "" if it is the first one (or has no duplicates)
+func sameContentAs(paths map[string][]string, sha256, pkgPath string) string {
+	if first := paths[sha256]; len(first) > 0 && first[0] != pkgPath {
+		return first[0]
+	}
+	return ""
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// counts the downloads of the packages of all feeds, keyed by the
+// url-path of the package (eg "/arm/foo_1.0_arm.ipk").
+//
+// the counts are not part of a feed's index: rebuilding a feed keeps the
+// counts of the packages which still exist afterwards and drops the counts
+// of the vanished ones (see Retain()). if 'FileName' is set, the counts are
+// loaded from there on startup and written back by Save(), so they survive
+// restarts as well; counts of the last moments before a crash are lost.
+type DownloadCounter struct {
+	FileName string
+
+	saving sync.Mutex // serializes Save()
+
+	mu      sync.Mutex
+	counts  map[string]uint64
+	changes uint64 // counts the changes of 'counts'
+	saved   uint64 // 'changes' as of the last successful Save()
+}
+
+func NewDownloadCounter(fileName string) (*DownloadCounter, error) {
+	dc := &DownloadCounter{FileName: fileName, counts: make(map[string]uint64)}
+	if fileName == "" {
+		return dc, nil
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return dc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &dc.counts); err != nil {
+		return nil, fmt.Errorf("parsing download counts %q: %v", fileName, err)
+	}
+	return dc, nil
+}
+
+func (dc *DownloadCounter) Inc(pkgPath string) {
+	dc.mu.Lock()
+	dc.counts[pkgPath]++
+	dc.changes++
+	dc.mu.Unlock()
+}
+
+// drops the counts of all packages of the feed at 'prefix' which
+// are not listed in 'names' anymore.
+func (dc *DownloadCounter) Retain(prefix string, names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[path.Join(prefix, name)] = true
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for pkgPath := range dc.counts {
+		if path.Dir(pkgPath) == path.Clean(prefix) && !keep[pkgPath] {
+			delete(dc.counts, pkgPath)
+			dc.changes++
+		}
+	}
+}
+
+// writes the counts to 'FileName', if they changed since the last
+// successful Save(). a failed one is retried by the next Save().
+func (dc *DownloadCounter) Save() error {
+	if dc.FileName == "" {
+		return nil
+	}
+	dc.saving.Lock()
+	defer dc.saving.Unlock()
+
+	dc.mu.Lock()
+	changes := dc.changes
+	if changes == dc.saved {
+		dc.mu.Unlock()
+		return nil
+	}
+	content, err := json.MarshalIndent(dc.counts, "", "  ")
+	dc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write + rename: a crash while writing does not wreck the old counts
+	tmpName := dc.FileName + ".tmp"
+	if err = ioutil.WriteFile(tmpName, content, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, dc.FileName); err != nil {
+		return err
+	}
+
+	// the changes made meanwhile are left for the next Save()
+	dc.mu.Lock()
+	dc.saved = changes
+	dc.mu.Unlock()
+	return nil
+}
+
+// lists the counts as "count path" lines, sorted by path
+func (dc *DownloadCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	paths := make([]string, 0, len(dc.counts))
+	for pkgPath := range dc.counts {
+		paths = append(paths, pkgPath)
+	}
+	sort.Strings(paths)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, pkgPath := range paths {
+		fmt.Fprintf(w, "%d %s\n", dc.counts[pkgPath], pkgPath)
+	}
+}
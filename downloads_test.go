@@ -0,0 +1,63 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// a failed Save() is retried by the next one, the counts survive a restart
+func TestDownloadCounterSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	fileName := filepath.Join(dir, "downloads.json")
+
+	dc, err := NewDownloadCounter(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.Inc("/arm/foo_1.0_arm.ipk")
+	dc.Inc("/arm/foo_1.0_arm.ipk")
+	if err := dc.Save(); err == nil {
+		t.Fatalf("Save(): expected an error, %q does not exist", dir)
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dc.Inc("/mips/bar_1.0_mips.ipk")
+	if err := dc.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing changed since: not written again
+	if err := os.Remove(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("Save(): wrote the unchanged counts: %v", err)
+	}
+	dc.Retain("/mips", nil)
+	if err := dc.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewDownloadCounter(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]uint64{"/arm/foo_1.0_arm.ipk": 2}; !reflect.DeepEqual(loaded.counts, expected) {
+		t.Errorf("got the counts %v, expected %v", loaded.counts, expected)
+	}
+}
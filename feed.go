@@ -0,0 +1,261 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a Feed is a directory full of packages, served at 'Prefix'. the
+// generated index files are kept in memory; Build() (re)creates them and
+// swaps them in at once, requests in flight keep using the old ones.
+type Feed struct {
+	Dir            string // directory containing the packages
+	Prefix         string // url-path the feed is served at
+	ScanOpts       *ScanOptions
+	Compressors    []Compressor
+	DefaultFormats IndexFormats // unless overridden by FeedFormatsFile
+	Signer         *GpgSigner
+	SplitArch      bool             // additional Packages.<arch> per architecture
+	Downloads      *DownloadCounter // optional
+	OutputDir      string           // optional, the generated files are written here as well
+	Metrics        *Metrics         // optional
+	Duplicates     *Duplicates      // optional
+	Mirror         *Mirror          // optional, fetches missing packages from upstream
+
+	AllowUpload    bool  // accept new packages via PUT / POST
+	AllowDelete    bool  // remove packages via DELETE
+	WriteNeedsCert bool  // uploads and deletes require a client-cert
+	UploadMaxSize  int64 // maximum size of an upload, 0: unlimited
+
+	UploadNeedsSignature bool // uploads carry a detached gpg-signature, see serveUpload()
+
+	building sync.Mutex   // serializes Build()
+	current  atomic.Value // *feedSnapshot, swapped by Build()
+
+	mu      sync.RWMutex
+	unwatch func() // stops Watch(), nil if not watching
+}
+
+// what Build() generated: the index and the handler serving the files
+// created from it. never modified once stored, a request works on one
+// snapshot throughout, no matter how often the feed is rebuilt meanwhile.
+type feedSnapshot struct {
+	packages *PackageIndex
+	handler  http.Handler
+}
+
+// scans the .ipk files in 'feed.Dir' and replaces the current
+// index files of the feed by the newly generated ones.
+func (feed *Feed) Build() error {
+
+	feed.building.Lock()
+	defer feed.building.Unlock()
+
+	now := time.Now()
+
+	logDebugf("start building index for %q", feed.Dir)
+
+	packages, err := ScanDirectoryForPackages(feed.Dir, feed.ScanOpts)
+	if err != nil {
+		return err
+	}
+
+	formats, err := FeedIndexFormats(feed.Dir, feed.DefaultFormats)
+	if err != nil {
+		return err
+	}
+
+	// a directory without packages is not a feed (anymore): there is no
+	// point in compressing and signing an empty index, it is listed like
+	// any other directory. a mirror serves its empty index, opkg fetches
+	// it before any package was mirrored.
+	var (
+		mux   = http.NewServeMux()
+		files []indexFile
+	)
+	if len(packages.Entries) == 0 && feed.Mirror == nil {
+		mux.Handle(feed.Prefix+"/", http.StripPrefix(feed.Prefix, withFileTypes(http.FileServer(http.Dir(feed.Dir)))))
+	} else {
+		files = AttachHttpHandler(mux, packages, feed.Prefix, feed.Dir, feed.Compressors, formats, feed.Signer, feed.SplitArch, feed.Duplicates)
+	}
+	if feed.OutputDir != "" {
+		if len(packages.Entries) == 0 {
+			files = nil // just clean up
+		}
+		if err := feed.writeOutput(files); err != nil {
+			logErrorf("writing the index files of %q to -output-dir: %v", feed.Dir, err)
+		}
+	}
+
+	prev := feed.Packages()
+	feed.current.Store(&feedSnapshot{packages: packages, handler: mux})
+
+	if feed.Downloads != nil {
+		feed.Downloads.Retain(feed.Prefix, packages.SortedNames())
+	}
+	if feed.Duplicates != nil {
+		feed.Duplicates.current() // logs new duplicates
+	}
+
+	took := time.Since(now)
+	if feed.Metrics != nil && len(packages.Entries) > 0 {
+		feed.Metrics.ObserveBuild(feed.Prefix, took)
+	}
+	logIndexDelta(feed.Dir, prev, packages, took)
+	return nil
+}
+
+// writes 'files' to the directory mirroring the feed below 'OutputDir'.
+// generated files of earlier runs which are not generated anymore (eg.
+// after changing -formats) are removed.
+func (feed *Feed) writeOutput(files []indexFile) error {
+	dir := filepath.Join(feed.OutputDir, filepath.FromSlash(feed.Prefix))
+	if len(files) == 0 {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return nil
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		name := filepath.Join(dir, file.name)
+		tmpName := filepath.Join(dir, "."+file.name+".tmp")
+		if err := ioutil.WriteFile(tmpName, file.content, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpName, name); err != nil {
+			return err
+		}
+		names[file.name] = true
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !names[entry.Name()] && isGeneratedName(entry.Name()) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// reports if 'name' is one of the files AttachHttpHandler() generates
+func isGeneratedName(name string) bool {
+	switch name {
+	case "index.json", "Release", "Release.gpg", "InRelease":
+		return true
+	}
+	return name == FormatPackages || strings.HasPrefix(name, FormatPackages+".")
+}
+
+// returns the index of the last Build(), nil before the first one
+func (feed *Feed) Packages() *PackageIndex {
+	if snapshot, ok := feed.current.Load().(*feedSnapshot); ok {
+		return snapshot.packages
+	}
+	return nil
+}
+
+func (feed *Feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" || r.Method == "POST" {
+		if !feed.AllowUpload {
+			writeError(http.StatusMethodNotAllowed, w, r)
+			return
+		}
+		feed.serveUpload(w, r)
+		return
+	}
+	if r.Method == "DELETE" {
+		if !feed.AllowDelete {
+			writeError(http.StatusMethodNotAllowed, w, r)
+			return
+		}
+		feed.serveDelete(w, r)
+		return
+	}
+
+	if feed.Mirror != nil && (r.Method == "GET" || r.Method == "HEAD") && path.Dir(r.URL.Path) == path.Clean(feed.Prefix) {
+		name := path.Base(r.URL.Path)
+		if _, ok := feed.Packages().Entries[name]; !ok && path.Ext(name) == ".ipk" && !strings.HasPrefix(name, ".") && !feed.ScanOpts.Excluded(name) {
+			if err := feed.Mirror.Fetch(feed, name); err != nil && err != errNotUpstream {
+				logErrorf("fetching %q from upstream: %v", r.URL.Path, err)
+				writeError(http.StatusBadGateway, w, r)
+				return
+			}
+		}
+	}
+
+	snapshot, ok := feed.current.Load().(*feedSnapshot)
+	if !ok {
+		writeError(http.StatusServiceUnavailable, w, r) // not built yet
+		return
+	}
+	handler, packages := snapshot.handler, snapshot.packages
+
+	if feed.Downloads != nil && r.Method == "GET" && !isResumedDownload(r) && path.Dir(r.URL.Path) == path.Clean(feed.Prefix) {
+		if _, ok := packages.Entries[path.Base(r.URL.Path)]; ok {
+			feed.Downloads.Inc(path.Clean(r.URL.Path))
+		}
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// reports if 'r' asks for the remainder of a download (eg, "Range:
+// bytes=4096-"), which was counted already when it started
+func isResumedDownload(r *http.Request) bool {
+	ranges := r.Header.Get("Range")
+	return ranges != "" && !strings.HasPrefix(ranges, "bytes=0-")
+}
+
+// watches 'feed.Dir' and rebuilds the feed once changes to the
+// packages have settled for 'delay'.
+func (feed *Feed) Watch(delay time.Duration) error {
+	unwatch, err := watchDirectory(feed.Dir, delay, func() {
+		if err := feed.Build(); err != nil {
+			logErrorf("rebuilding %q: %v", feed.Dir, err)
+		}
+	})
+	if err == nil {
+		feed.mu.Lock()
+		feed.unwatch = unwatch
+		feed.mu.Unlock()
+	}
+	return err
+}
+
+func (feed *Feed) Watching() bool {
+	feed.mu.RLock()
+	defer feed.mu.RUnlock()
+	return feed.unwatch != nil
+}
+
+// stops Watch(), eg. once the directory of the feed is gone
+func (feed *Feed) StopWatching() {
+	feed.mu.Lock()
+	unwatch := feed.unwatch
+	feed.unwatch = nil
+	feed.mu.Unlock()
+	if unwatch != nil {
+		unwatch()
+	}
+}
@@ -0,0 +1,285 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// a feed exposing the uncompressed Packages only
+func testFeed(dir, prefix string) *Feed {
+	return &Feed{
+		Dir:            dir,
+		Prefix:         prefix,
+		ScanOpts:       &ScanOptions{Workers: NewWorkerPool(2)},
+		DefaultFormats: IndexFormats{FormatPackages: true},
+	}
+}
+
+func getStatus(handler http.Handler, path string) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code
+}
+
+// a directory without packages is listed, no (empty) index is generated
+func TestFeedBuildEmpty(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	feed := testFeed(dir, "/arm")
+	feed.OutputDir = out
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "arm", "Packages")); err != nil {
+		t.Fatalf("-output-dir: %v", err)
+	}
+
+	// the package is gone, so is the feed
+	if err := os.Remove(filepath.Join(dir, "foo_1.0_arm.ipk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	for path, code := range map[string]int{
+		"/arm/":           http.StatusOK,
+		"/arm/README":     http.StatusOK,
+		"/arm/Packages":   http.StatusNotFound,
+		"/arm/index.json": http.StatusNotFound,
+	} {
+		if got := getStatus(feed, path); got != code {
+			t.Errorf("GET %s: got %d, expected %d", path, got, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "arm", "Packages")); !os.IsNotExist(err) {
+		t.Errorf("-output-dir: expected the Packages to be removed, got %v", err)
+	}
+}
+
+func TestFeedBuild(t *testing.T) {
+	dir := t.TempDir()
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+
+	feed := testFeed(dir, "/arm")
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	for path, code := range map[string]int{
+		"/arm/":                http.StatusOK,
+		"/arm/Packages":        http.StatusOK,
+		"/arm/foo_1.0_arm.ipk": http.StatusOK,
+	} {
+		if got := getStatus(feed, path); got != code {
+			t.Errorf("GET %s: got %d, expected %d", path, got, code)
+		}
+	}
+}
+
+// the generated files are written to -output-dir, the packages are only
+// read from the feed
+func TestFeedOutputDir(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	feed := testFeed(dir, "/arm")
+	feed.OutputDir = out
+	feed.Compressors = []Compressor{{"gzip", ".gz", GzGolang}}
+	feed.DefaultFormats = IndexFormats{FormatPackages: true, FormatPackagesGz: true}
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the package in the feed, got %d entries", len(entries))
+	}
+	for _, name := range []string{"Packages", "Packages.gz", "index.json"} {
+		written, err := os.ReadFile(filepath.Join(out, "arm", name))
+		if err != nil {
+			t.Errorf("-output-dir: %v", err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		feed.ServeHTTP(w, httptest.NewRequest("GET", "/arm/"+name, nil))
+		if !bytes.Equal(written, w.Body.Bytes()) {
+			t.Errorf("-output-dir: %s differs from the one served", name)
+		}
+	}
+
+	// a format not exposed anymore is removed, other files are kept
+	writeTestFile(t, filepath.Join(out, "arm", "README"), "hello")
+	writeTestFile(t, filepath.Join(dir, FeedFormatsFile), "Packages\n")
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{"Packages": true, "Packages.gz": false, "index.json": true, "README": true} {
+		if _, err := os.Stat(filepath.Join(out, "arm", name)); (err == nil) != exists {
+			t.Errorf("-output-dir: expected %s to exist=%v, got %v", name, exists, err)
+		}
+	}
+}
+
+// a part of a package is served with 206, resuming a download does not
+// count it again
+func TestFeedRange(t *testing.T) {
+	dir := t.TempDir()
+	content := readTestFile(t, writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm")))
+	dc, err := NewDownloadCounter(filepath.Join(t.TempDir(), "downloads.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := testFeed(dir, "/arm")
+	feed.Downloads = dc
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ranges   string
+		code     int
+		expected []byte
+		counted  uint64 // the downloads after the request
+	}{
+		{"", http.StatusOK, content, 1},
+		{"bytes=0-99", http.StatusPartialContent, content[:100], 2},
+		{"bytes=100-", http.StatusPartialContent, content[100:], 2},
+		{"bytes=10-19", http.StatusPartialContent, content[10:20], 2},
+		{"bytes=-10", http.StatusPartialContent, content[len(content)-10:], 2},
+		{fmt.Sprintf("bytes=%d-", len(content)), http.StatusRequestedRangeNotSatisfiable, nil, 2},
+	} {
+		r := httptest.NewRequest("GET", "/arm/foo_1.0_arm.ipk", nil)
+		if test.ranges != "" {
+			r.Header.Set("Range", test.ranges)
+		}
+		w := httptest.NewRecorder()
+		feed.ServeHTTP(w, r)
+		if w.Code != test.code || (test.expected != nil && !bytes.Equal(w.Body.Bytes(), test.expected)) {
+			t.Errorf("Range %q: got %d and %d bytes, expected %d and %d bytes", test.ranges, w.Code, w.Body.Len(), test.code, len(test.expected))
+		}
+		if w.Code == http.StatusOK && w.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("Range %q: got Accept-Ranges %q", test.ranges, w.Header().Get("Accept-Ranges"))
+		}
+		if counted := dc.counts["/arm/foo_1.0_arm.ipk"]; counted != test.counted {
+			t.Errorf("Range %q: counted %d downloads, expected %d", test.ranges, counted, test.counted)
+		}
+	}
+}
+
+// requests served while the feed is rebuilt see either the old or the new
+// index, each file of it complete
+func TestFeedConcurrentBuild(t *testing.T) {
+	dir := t.TempDir()
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	bar := writeIpk(t, dir, "bar_1.0_arm.ipk", testControl("bar", "1.0", "arm"))
+	feed := testFeed(dir, "/arm")
+	feed.Compressors = []Compressor{{"gzip", ".gz", GzGolang}}
+	feed.DefaultFormats = IndexFormats{FormatPackages: true, FormatPackagesGz: true, FormatPackagesStamps: true}
+
+	// the files generated with and without "bar", renamed away keeping
+	// its mtime
+	toggle := func(i int) {
+		from, to := bar, bar+".off"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths := []string{"/arm/Packages", "/arm/Packages.gz", "/arm/Packages.stamps", "/arm/index.json"}
+	valid := make(map[string]map[string]bool)
+	for _, path := range paths {
+		valid[path] = make(map[string]bool)
+	}
+	for i := 0; i < 2; i++ {
+		if err := feed.Build(); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range paths {
+			body := getBody(t, feed, path)
+			if path == "/arm/Packages.gz" {
+				body = gunzip(t, body)
+			}
+			valid[path][string(body)] = true
+		}
+		toggle(i)
+	}
+	for _, path := range paths {
+		if len(valid[path]) != 2 {
+			t.Fatalf("%s: the two indexes do not differ", path)
+		}
+	}
+
+	var (
+		done    = make(chan struct{})
+		readers sync.WaitGroup
+	)
+	for _, path := range paths {
+		path := path
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				feed.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				body := w.Body.Bytes()
+				if length := w.Header().Get("Content-Length"); length != "" && length != strconv.Itoa(len(body)) {
+					t.Errorf("GET %s: got %d bytes, Content-Length: %s", path, len(body), length)
+					return
+				}
+				if path == "/arm/Packages.gz" {
+					gz, err := gzip.NewReader(bytes.NewReader(body))
+					if err == nil {
+						body, err = io.ReadAll(gz)
+					}
+					if err != nil {
+						t.Errorf("GET %s: %v", path, err)
+						return
+					}
+				}
+				if w.Code != http.StatusOK || !valid[path][string(body)] {
+					t.Errorf("GET %s: got %d, an index which was never built:\n%s", path, w.Code, body)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 2; i < 50; i++ {
+		if err := feed.Build(); err != nil {
+			t.Error(err)
+			break
+		}
+		toggle(i)
+	}
+	close(done)
+	readers.Wait()
+}
@@ -0,0 +1,136 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// the headers of a file served from disk, by its extension
+type FileType struct {
+	ContentType  string // "": as guessed by net/http
+	CacheControl string // "": none (or the default, eg. of .ipk)
+}
+
+// the FileTypes of the files served from disk (packages and other files of
+// a feed, non-package directories), see setFileTypeHeaders(). the defaults
+// cover the files usually put next to packages, -file-types adds to them.
+var FileTypes = map[string]FileType{
+	".sig":    {ContentType: "application/pgp-signature"},
+	".asc":    {ContentType: "application/pgp-signature"},
+	".sha256": {ContentType: "text/plain; charset=utf-8"},
+	".md5":    {ContentType: "text/plain; charset=utf-8"},
+	".conf":   {ContentType: "text/plain; charset=utf-8"},
+}
+
+// reads the -file-types file, one extension per line, "ext content-type
+// [cache-control]". a content-type of "-" keeps the guessed one, the
+// cache-control is the rest of the line:
+//
+//	# comment
+//	.sig     application/pgp-signature   public, max-age=300
+//	.ipk     -                           public, max-age=86400, no-transform
+//	.txt     text/plain;charset=utf-8
+//
+// the entries replace those of the same extension in FileTypes.
+func LoadFileTypes(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		types   = make(map[string]FileType)
+		scanner = bufio.NewScanner(file)
+		n       int
+	)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], ".") {
+			return fmt.Errorf("%q, line %d: expected \".ext content-type [cache-control]\", got %q", fileName, n, line)
+		}
+		fileType := FileType{ContentType: fields[1], CacheControl: strings.Join(fields[2:], " ")}
+		if fileType.ContentType == "-" {
+			fileType.ContentType = ""
+		}
+		types[strings.ToLower(fields[0])] = fileType
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	for ext, fileType := range types {
+		FileTypes[ext] = fileType
+	}
+	return nil
+}
+
+// sets the Content-Type of the FileType of 'name' on 'w' (http.ServeFile()
+// keeps one which is set already). its Cache-Control is only sent along with
+// a successful response, not with a 404, so the returned writer is to be
+// used instead of 'w'.
+func setFileTypeHeaders(w http.ResponseWriter, name string) http.ResponseWriter {
+	fileType, ok := FileTypes[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return w
+	}
+	if fileType.ContentType != "" {
+		w.Header().Set("Content-Type", fileType.ContentType)
+	}
+	if fileType.CacheControl == "" {
+		return w
+	}
+	return &cacheControlWriter{ResponseWriter: w, cacheControl: fileType.CacheControl}
+}
+
+// wraps 'handler' serving files, see setFileTypeHeaders()
+func withFileTypes(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(setFileTypeHeaders(w, r.URL.Path), r)
+	})
+}
+
+// sets "Cache-Control" on responses below 400
+type cacheControlWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	wroteHeader  bool
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code < 400 {
+			w.Header().Set("Cache-Control", w.cacheControl)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheControlWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
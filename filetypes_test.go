@@ -0,0 +1,122 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// restores the default FileTypes once the test is done
+func keepFileTypes(t *testing.T) {
+	saved := make(map[string]FileType, len(FileTypes))
+	for ext, fileType := range FileTypes {
+		saved[ext] = fileType
+	}
+	t.Cleanup(func() { FileTypes = saved })
+}
+
+func TestLoadFileTypes(t *testing.T) {
+	keepFileTypes(t)
+	name := filepath.Join(t.TempDir(), "file-types")
+	for _, test := range []struct {
+		content  string
+		expected map[string]FileType // the changed entries, nil: an error
+	}{
+		{"# comment\n\n", map[string]FileType{}},
+		{".sig application/pgp-signature public, max-age=300\n",
+			map[string]FileType{".sig": {"application/pgp-signature", "public, max-age=300"}}},
+		{"  .IPK  -   public,  max-age=86400, no-transform\n.txt text/plain;charset=utf-8\n", map[string]FileType{
+			".ipk": {"", "public, max-age=86400, no-transform"},
+			".txt": {"text/plain;charset=utf-8", ""},
+		}},
+		{".sig\n", nil},
+		{"sig application/pgp-signature\n", nil},
+		// an invalid file changes nothing
+		{".new text/plain\n.bad\n", nil},
+	} {
+		before := make(map[string]FileType)
+		for ext, fileType := range FileTypes {
+			before[ext] = fileType
+		}
+		writeTestFile(t, name, test.content)
+
+		err := LoadFileTypes(name)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("LoadFileTypes(%q): expected an error", test.content)
+			}
+			if !reflect.DeepEqual(FileTypes, before) {
+				t.Errorf("LoadFileTypes(%q): changed FileTypes to %v", test.content, FileTypes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LoadFileTypes(%q): %v", test.content, err)
+			continue
+		}
+		for ext, fileType := range test.expected {
+			before[ext] = fileType
+		}
+		if !reflect.DeepEqual(FileTypes, before) {
+			t.Errorf("LoadFileTypes(%q): got %v, expected %v", test.content, FileTypes, before)
+		}
+	}
+
+	if err := LoadFileTypes(name + ".missing"); err == nil {
+		t.Errorf("LoadFileTypes(): expected an error for a missing file")
+	}
+}
+
+// the headers by extension, of the files of a feed and of a directory
+// without packages
+func TestFileTypeHeaders(t *testing.T) {
+	keepFileTypes(t)
+	FileTypes[".sig"] = FileType{"application/pgp-signature", "public, max-age=300"}
+	FileTypes[".ipk"] = FileType{"", "public, max-age=86400, no-transform"}
+
+	root := mkdirs(t, "arm", "docs")
+	writeIpk(t, filepath.Join(root, "arm"), "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	for _, name := range []string{"arm/foo_1.0_arm.ipk.sig", "arm/foo_1.0_arm.ipk.sha256", "docs/opkg.conf", "docs/readme.sig", "docs/notes.MD5"} {
+		writeTestFile(t, filepath.Join(root, filepath.FromSlash(name)), "content\n")
+	}
+	repo := testRepository(Mount{root, ""})
+	repo.Scan()
+
+	for _, test := range []struct {
+		path                      string
+		code                      int
+		contentType, cacheControl string
+	}{
+		{"/arm/foo_1.0_arm.ipk", http.StatusOK, "application/x-ipk", "public, max-age=86400, no-transform"},
+		{"/arm/foo_1.0_arm.ipk.sig", http.StatusOK, "application/pgp-signature", "public, max-age=300"},
+		{"/arm/foo_1.0_arm.ipk.sha256", http.StatusOK, "text/plain; charset=utf-8", ""},
+		{"/docs/opkg.conf", http.StatusOK, "text/plain; charset=utf-8", ""},
+		{"/docs/readme.sig", http.StatusOK, "application/pgp-signature", "public, max-age=300"},
+		{"/docs/notes.MD5", http.StatusOK, "text/plain; charset=utf-8", ""},
+		// no Cache-Control for an error
+		{"/docs/missing.sig", http.StatusNotFound, "", ""},
+	} {
+		w := httptest.NewRecorder()
+		repo.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("GET %s: got %d, expected %d", test.path, w.Code, test.code)
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); test.contentType != "" && got != test.contentType {
+			t.Errorf("GET %s: got the Content-Type %q, expected %q", test.path, got, test.contentType)
+		}
+		if got := w.Header().Get("Cache-Control"); got != test.cacheControl {
+			t.Errorf("GET %s: got the Cache-Control %q, expected %q", test.path, got, test.cacheControl)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the generated index files a feed is able to expose
+const (
+	FormatPackages         = "Packages"
+	FormatPackagesGz       = "Packages.gz"
+	FormatPackagesXz       = "Packages.xz"
+	FormatPackagesZst      = "Packages.zst"
+	FormatPackagesBz2      = "Packages.bz2"
+	FormatPackagesStamps   = "Packages.stamps"
+	FormatPackagesStampsGz = "Packages.stamps.gz"
+)
+
+var allIndexFormats = []string{
+	FormatPackages, FormatPackagesGz, FormatPackagesXz, FormatPackagesZst,
+	FormatPackagesBz2, FormatPackagesStamps, FormatPackagesStampsGz,
+}
+
+// a feed-directory might contain this file to override the
+// -formats for that specific feed.
+const FeedFormatsFile = ".kellner-formats"
+
+// the set of index files a feed exposes
+type IndexFormats map[string]bool
+
+// parses a list of index formats, separated by ',' or whitespace,
+// eg "Packages.gz,Packages.stamps"
+func ParseIndexFormats(list string) (IndexFormats, error) {
+	formats := make(IndexFormats)
+	isSep := func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' }
+	for _, name := range strings.FieldsFunc(list, isSep) {
+		if !isIndexFormat(name) {
+			return nil, fmt.Errorf("unknown index format %q, valid formats: %s",
+				name, strings.Join(allIndexFormats, ","))
+		}
+		formats[name] = true
+	}
+	return formats, nil
+}
+
+// returns the index formats of the feed in 'dir': either the content
+// of FeedFormatsFile or, if that does not exist, 'defaults'
+func FeedIndexFormats(dir string, defaults IndexFormats) (IndexFormats, error) {
+	fileName := filepath.Join(dir, FeedFormatsFile)
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return defaults, nil
+	} else if err != nil {
+		return nil, err
+	}
+	formats, err := ParseIndexFormats(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", fileName, err)
+	}
+	return formats, nil
+}
+
+func (formats IndexFormats) String() string {
+	names := make([]string, 0, len(formats))
+	for _, name := range allIndexFormats {
+		if formats[name] {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func isIndexFormat(name string) bool {
+	for _, format := range allIndexFormats {
+		if name == format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIndexFormats(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected string // IndexFormats.String()
+		ok       bool
+	}{
+		{"", "", true},
+		{"Packages", "Packages", true},
+		{"Packages.stamps,Packages.gz", "Packages.gz,Packages.stamps", true},
+		{" Packages.gz\tPackages.xz\nPackages.gz, ", "Packages.gz,Packages.xz", true},
+		{"Packages,index.json", "", false},
+		{"packages", "", false},
+	} {
+		formats, err := ParseIndexFormats(test.list)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseIndexFormats(%q): got %v, expected ok=%v", test.list, err, test.ok)
+			continue
+		}
+		if err == nil && formats.String() != test.expected {
+			t.Errorf("ParseIndexFormats(%q): got %q, expected %q", test.list, formats, test.expected)
+		}
+	}
+}
+
+func TestFeedIndexFormats(t *testing.T) {
+	defaults := IndexFormats{FormatPackages: true, FormatPackagesGz: true}
+	for _, test := range []struct {
+		file     string // "": no FeedFormatsFile
+		expected string
+		ok       bool
+	}{
+		{"", "Packages,Packages.gz", true},
+		{"Packages.gz\n", "Packages.gz", true},
+		{"\n", "", true},
+		{"Packages.lzma\n", "", false},
+	} {
+		dir := t.TempDir()
+		if test.file != "" {
+			writeTestFile(t, filepath.Join(dir, FeedFormatsFile), test.file)
+		}
+		formats, err := FeedIndexFormats(dir, defaults)
+		if (err == nil) != test.ok {
+			t.Errorf("FeedIndexFormats(%q): got %v, expected ok=%v", test.file, err, test.ok)
+			continue
+		}
+		if err == nil && formats.String() != test.expected {
+			t.Errorf("FeedIndexFormats(%q): got %q, expected %q", test.file, formats, test.expected)
+		}
+	}
+}
@@ -9,19 +9,62 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os/exec"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Gzipper func(w io.Writer, r io.Reader) error
 
+// how long an external compressor (gzip, xz, zstd, bzip2) may take before
+// it is killed (-compress-timeout), 0: no limit. a time.Duration, changes
+// on SIGHUP (see ConfigReloader) while feeds are built.
+var compressTimeout atomic.Int64
+
+func SetCompressTimeout(timeout time.Duration) {
+	compressTimeout.Store(int64(timeout))
+}
+
+func CompressTimeout() time.Duration {
+	return time.Duration(compressTimeout.Load())
+}
+
+// runs 'name' with 'args', piping 'r' through it into 'w'. the process
+// (and its process group, see killOnCancel()) is killed once it takes
+// longer than CompressTimeout().
+func runPipe(w io.Writer, r io.Reader, name string, args ...string) error {
+	ctx, timeout := context.Background(), CompressTimeout()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	killOnCancel(cmd)
+	// do not wait forever for the pipes, eg. held open by a grandchild
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("'%s' did not finish within -compress-timeout %s, killed", name, timeout)
+	}
+	return err
+}
+
 // use the compress/gzip to compress the content of
-// 'r'.
+// 'r'. the header carries no mtime, so the same input always
+// results in the same output (and ETag).
 func GzGolang(w io.Writer, r io.Reader) error {
 	gz, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
-	gz.Header.ModTime = time.Now()
 	if _, err := io.Copy(gz, r); err != nil {
 		return err
 	}
@@ -33,8 +76,92 @@ func GzGolang(w io.Writer, r io.Reader) error {
 // accepts the output. right now it's unclear why opkg explodes
 // when it hits a golang-native-created .gz file.
 func GzGzipPipe(w io.Writer, r io.Reader) error {
-	cmd := exec.Command("gzip", "-9", "-c")
-	cmd.Stdin = r
-	cmd.Stdout = w
-	return cmd.Run()
+	return runPipe(w, r, "gzip", "-9", "-c")
+}
+
+// GzGzipPipe(), falling back to GzGolang() if 'gzip' fails (eg, it hangs
+// and is killed after CompressTimeout())
+func GzGzipPipeOrGolang(w io.Writer, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	compressed := bytes.NewBuffer(nil)
+	if err = GzGzipPipe(compressed, bytes.NewReader(content)); err != nil {
+		logWarnf("%v, using the native gzipper", err)
+		return GzGolang(w, bytes.NewReader(content))
+	}
+	_, err = compressed.WriteTo(w)
+	return err
+}
+
+// checks if GzGzipPipe() works, ie. 'gzip' is installed
+func GzGzipPipeWorks() error {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		return err
+	}
+	return GzGzipPipe(ioutil.Discard, strings.NewReader("kellner"))
+}
+
+// use a pipe to 'xz' to create Packages.xz. there is no xz-writer
+// in the golang stdlib.
+func XzPipe(w io.Writer, r io.Reader) error {
+	return runPipe(w, r, "xz", "-9", "-c")
+}
+
+// use a pipe to 'bzip2' to create Packages.bz2, still used by some older
+// feeds. compress/bzip2 only decompresses.
+func Bzip2Pipe(w io.Writer, r io.Reader) error {
+	return runPipe(w, r, "bzip2", "-9", "-c")
+}
+
+// checks if Bzip2Pipe() works, ie. 'bzip2' is installed
+func Bzip2PipeWorks() error {
+	if _, err := exec.LookPath("bzip2"); err != nil {
+		return err
+	}
+	return Bzip2Pipe(ioutil.Discard, strings.NewReader("kellner"))
+}
+
+// use a pipe to 'zstd' to create Packages.zst at the given compression
+// 'level' (1..19).
+func ZstdPipe(level int) Gzipper {
+	return func(w io.Writer, r io.Reader) error {
+		return runPipe(w, r, "zstd", fmt.Sprintf("-%d", level), "-q", "-c")
+	}
+}
+
+// a compressed variant of the 'Packages' index
+type Compressor struct {
+	Name     string // as given to -compress, eg "gzip"
+	Ext      string // appended to "Packages", eg ".gz"
+	Compress Gzipper
+}
+
+// parses a comma separated list of compression names (eg, "gzip,xz")
+// into the Compressors to use. 'gzipper' is used for "gzip", "zstd"
+// compresses at 'zstdLevel'.
+func ParseCompressors(list string, gzipper Gzipper, zstdLevel int) ([]Compressor, error) {
+	known := []Compressor{
+		{"gzip", ".gz", gzipper},
+		{"xz", ".xz", XzPipe},
+		{"zstd", ".zst", ZstdPipe(zstdLevel)},
+		{"bzip2", ".bz2", Bzip2Pipe},
+	}
+
+	compressors := make([]Compressor, 0, len(known))
+	for _, name := range splitList(list) {
+		found := false
+		for _, compressor := range known {
+			if compressor.Name == name {
+				compressors = append(compressors, compressor)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown compression %q", name)
+		}
+	}
+	return compressors, nil
 }
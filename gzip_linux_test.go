@@ -0,0 +1,53 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reports if the process 'pid' is gone (or a zombie no one reaps)
+func processGone(pid string) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// the compressor's process group is killed on a timeout: a wrapper script
+// does not leave the real compressor behind
+func TestCompressTimeoutKillsGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	t.Setenv("PATH", fakeTool(t, "gzip", "sleep 30 & echo $! > "+pidFile+"; wait")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setTestCompressTimeout(t, 200*time.Millisecond)
+
+	if err := GzGzipPipe(bytes.NewBuffer(nil), strings.NewReader("kellner")); err == nil {
+		t.Fatalf("GzGzipPipe(): expected a timeout")
+	}
+	pid, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); !processGone(strings.TrimSpace(string(pid))); {
+		if time.Now().After(deadline) {
+			t.Fatalf("the forked 'sleep' (pid %s) is still running", strings.TrimSpace(string(pid)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,209 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCompressors(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected []string // the extensions, nil: an error
+	}{
+		{"", []string{}},
+		{"gzip", []string{".gz"}},
+		{"zstd, gzip,,xz", []string{".zst", ".gz", ".xz"}},
+		{"gzip,xz,zstd,bzip2", []string{".gz", ".xz", ".zst", ".bz2"}},
+		{"gzip,lzma", nil},
+		{"GZIP", nil},
+	} {
+		compressors, err := ParseCompressors(test.list, GzGolang, 3)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("ParseCompressors(%q): expected an error", test.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCompressors(%q): %v", test.list, err)
+			continue
+		}
+		exts := make([]string, len(compressors))
+		for i, compressor := range compressors {
+			exts[i] = compressor.Ext
+		}
+		if !reflect.DeepEqual(exts, test.expected) {
+			t.Errorf("ParseCompressors(%q): got %q, expected %q", test.list, exts, test.expected)
+		}
+	}
+}
+
+// puts the shell 'script' as 'name' into a directory for PATH
+func fakeTool(t *testing.T, name, script string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGzGzipPipeWorks(t *testing.T) {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip(err)
+	}
+	if err := GzGzipPipeWorks(); err != nil {
+		t.Errorf("GzGzipPipeWorks(): %v", err)
+	}
+
+	for name, path := range map[string]string{
+		"missing": t.TempDir(),
+		"failing": fakeTool(t, "gzip", "exit 1"),
+	} {
+		t.Setenv("PATH", path)
+		if err := GzGzipPipeWorks(); err == nil {
+			t.Errorf("GzGzipPipeWorks() with a %s gzip: expected an error", name)
+		}
+		// no (silently) empty Packages.gz
+		if err := GzGzipPipe(bytes.NewBuffer(nil), strings.NewReader("kellner")); err == nil {
+			t.Errorf("GzGzipPipe() with a %s gzip: expected an error", name)
+		}
+	}
+}
+
+// a Packages index of 'n' packages
+func testPackagesIndex(n int) []byte {
+	index := bytes.NewBuffer(nil)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("pkg%04d", i)
+		fmt.Fprintf(index, "%sFilename: %s_1.0_arm.ipk\nSize: %d\n\n", testControl(name, "1.0", "arm"), name, 1000+i)
+	}
+	return index.Bytes()
+}
+
+// every compressor's output decompresses to its input again
+func TestCompressors(t *testing.T) {
+	compressors, err := ParseCompressors("gzip,xz,zstd,bzip2", GzGzipPipe, 19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressors = append(compressors, Compressor{"gzip", ".gz", GzGolang})
+	index := testPackagesIndex(100)
+	for _, compressor := range compressors {
+		if _, err := exec.LookPath(compressor.Name); err != nil {
+			t.Logf("%s: skipped, %v", compressor.Name, err)
+			continue
+		}
+		compressed := bytes.NewBuffer(nil)
+		if err := compressor.Compress(compressed, bytes.NewReader(index)); err != nil {
+			t.Errorf("%s: %v", compressor.Name, err)
+			continue
+		}
+		cmd := exec.Command(compressor.Name, "-d", "-c")
+		cmd.Stdin = compressed
+		decompressed, err := cmd.Output()
+		if err != nil {
+			t.Errorf("%s -d: %v", compressor.Name, err)
+		} else if !bytes.Equal(decompressed, index) {
+			t.Errorf("%s: the decompressed index differs", compressor.Name)
+		}
+	}
+}
+
+// the size/time tradeoff of zstd compared to gzip: "compressed-bytes" is
+// the size of the compressed index
+func BenchmarkCompressors(b *testing.B) {
+	index := testPackagesIndex(5000)
+	for _, bench := range []struct {
+		name     string
+		compress Gzipper
+		tool     string
+	}{
+		{"gzip-golang", GzGolang, ""},
+		{"gzip", GzGzipPipe, "gzip"},
+		{"zstd-3", ZstdPipe(3), "zstd"},
+		{"zstd-19", ZstdPipe(19), "zstd"},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			if bench.tool != "" {
+				if _, err := exec.LookPath(bench.tool); err != nil {
+					b.Skip(err)
+				}
+			}
+			compressed := bytes.NewBuffer(nil)
+			b.SetBytes(int64(len(index)))
+			for i := 0; i < b.N; i++ {
+				compressed.Reset()
+				if err := bench.compress(compressed, bytes.NewReader(index)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(compressed.Len()), "compressed-bytes")
+		})
+	}
+}
+
+// sets the -compress-timeout for the test
+func setTestCompressTimeout(t *testing.T, timeout time.Duration) {
+	prev := CompressTimeout()
+	SetCompressTimeout(timeout)
+	t.Cleanup(func() { SetCompressTimeout(prev) })
+}
+
+// a hanging compressor is killed after -compress-timeout, GzGzipPipeOrGolang
+// falls back to compress/gzip then
+func TestCompressTimeout(t *testing.T) {
+	gzip, err := exec.LookPath("gzip")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Setenv("PATH", fakeTool(t, "gzip", "sleep 10")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setTestCompressTimeout(t, 100*time.Millisecond)
+	logged := captureLog(t)
+
+	start := time.Now()
+	err = GzGzipPipe(bytes.NewBuffer(nil), strings.NewReader("kellner"))
+	if err == nil || !strings.Contains(err.Error(), "-compress-timeout") {
+		t.Errorf("GzGzipPipe(): got %v, expected a timeout", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("GzGzipPipe(): took %v to give up", took)
+	}
+
+	compressed := bytes.NewBuffer(nil)
+	if err := GzGzipPipeOrGolang(compressed, strings.NewReader("kellner")); err != nil {
+		t.Fatalf("GzGzipPipeOrGolang(): %v", err)
+	}
+	if got := gunzip(t, compressed.Bytes()); string(got) != "kellner" {
+		t.Errorf("GzGzipPipeOrGolang(): got %q, expected \"kellner\"", got)
+	}
+	if !strings.Contains(logged.String(), "using the native gzipper") {
+		t.Errorf("the fallback is not logged:\n%s", logged)
+	}
+
+	// no limit: a slow compressor is waited for
+	t.Setenv("PATH", fakeTool(t, "gzip", "sleep 0.3; exec "+gzip+" -c")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setTestCompressTimeout(t, 0)
+	compressed.Reset()
+	if err := GzGzipPipe(compressed, strings.NewReader("kellner")); err != nil {
+		t.Fatalf("GzGzipPipe() without a timeout: %v", err)
+	}
+	if got := gunzip(t, compressed.Bytes()); string(got) != "kellner" {
+		t.Errorf("GzGzipPipe() without a timeout: got %q, expected \"kellner\"", got)
+	}
+}
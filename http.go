@@ -9,24 +9,39 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type DirEntry struct {
-	Name     string
-	ModTime  time.Time
-	Size     int64
-	RawDescr string
-	Descr    string
+	Name          string
+	ModTime       time.Time
+	Built         time.Time // zero for the index files
+	Size          int64
+	InstalledSize int64 // "Installed-Size" of the control, 0 if unknown
+	RawDescr      string
+	Descr         string
+	SameAs        string // url-path of a package with the same content, see Duplicates
+	Arch          string // "" for the index files
 }
 
 type RenderCtx struct {
@@ -39,14 +54,8 @@ type RenderCtx struct {
 
 const TEMPLATE = `<!doctype html>
 <title>{{.Title}}</title>
-<style type="text/css">
-body { font-family: monospace }
-td, th { padding: auto 2em }
-.col-size { text-align: right }
-.col-modtime { white-space: nowrap }
-.col-descr { white-space: nowrap }
-footer { margin-top: 1em; padding-top: 1em; border-top: 1px dotted silver }
-</style>
+<link rel="icon" href="/favicon.ico">
+<link rel="stylesheet" href="/.kellner/kellner.css">
 
 <p>
 This repository contains {{.Entries|len}} packages with an accumulated size of {{.SumFileSize}} bytes.
@@ -54,9 +63,12 @@ This repository contains {{.Entries|len}} packages with an accumulated size of {
 <table>
 	<thead>
 		<tr>
-			<th>Name</th>
-			<th>Last Modified</th>
-			<th>Size</th>
+			<th><a href="?sort=name">Name</a></th>
+			<th><a href="?sort=modtime&amp;order=desc">Last Modified</a></th>
+			<th>Built</th>
+			<th><a href="?sort=size&amp;order=desc">Size</a></th>
+			<th>Installed Size</th>
+			<th>Architecture</th>
 			<th>Description</th>
 		</tr>
 	</thead>
@@ -65,8 +77,11 @@ This repository contains {{.Entries|len}} packages with an accumulated size of {
 	<tr>
 		<td class="col-link"><a href="{{.Name}}">{{.Name}}</a></td>
 		<td class="col-modtime">{{.ModTime.Format "2006-01-02T15:04:05Z07:00" }}</td>
+		<td class="col-built">{{if not .Built.IsZero}}{{.Built.Format "2006-01-02T15:04:05Z07:00" }}{{end}}</td>
 		<td class="col-size">{{.Size}}</td>
-		<td class="col-descr"><a href="{{.Name}}.control" title="{{.RawDescr | html }}">{{.Descr}}</td>
+		<td class="col-size col-installed-size">{{if .InstalledSize}}{{.InstalledSize}}{{end}}</td>
+		<td class="col-arch">{{if .Arch}}<a href="?arch={{.Arch}}">{{.Arch}}</a>{{end}}</td>
+		{{if .SameAs}}<td class="col-descr">same as <a href="{{.SameAs}}">{{.SameAs}}</a></td>{{else}}<td class="col-descr"><a href="{{.Name}}.control" title="{{.RawDescr | html }}">{{.Descr}}</td>{{end}}
 	</tr>
 {{end}}
 	</tbody>
@@ -75,6 +90,7 @@ This repository contains {{.Entries|len}} packages with an accumulated size of {
 <footer>{{.Version}} - generated at {{.Date}}</footer>
 `
 
+// the template of the html listing of a feed, see LoadIndexTemplate()
 var IndexTemplate *template.Template
 
 func init() {
@@ -83,56 +99,299 @@ func init() {
 		panic(err)
 	}
 	IndexTemplate = tmpl
+
+	// otherwise .ipk is served as "application/octet-stream" or, on some
+	// systems, "application/vnd.shana.informed.package"
+	mime.AddExtensionType(".ipk", "application/x-ipk")
 }
 
-func AttachHttpHandler(mux *http.ServeMux, packages *PackageIndex, prefix, root string, gzipper Gzipper) {
+// replaces the built-in IndexTemplate by the one in file 'name' (-template).
+// it gets the same RenderCtx and is tried once against a listing of an
+// example package, to report unknown fields right away.
+func LoadIndexTemplate(name string) error {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New("index").Parse(string(content))
+	if err != nil {
+		return err
+	}
+	example := &RenderCtx{
+		Title:   "/example - kellner",
+		Entries: []DirEntry{{Name: "example_1.0_all.ipk", ModTime: time.Now(), Built: time.Now(), Size: 1}},
+		Version: VERSION,
+		Date:    time.Now(),
+	}
+	if err = tmpl.Execute(ioutil.Discard, example); err != nil {
+		return err
+	}
+	IndexTemplate = tmpl
+	return nil
+}
 
-	now := time.Now()
+// attaches the index page, the generated index files and the packages of
+// the feed at 'prefix' to 'mux'. returns the generated files. with 'dups'
+// the listing refers to the first copy of packages found in several feeds.
+func AttachHttpHandler(mux *http.ServeMux, packages *PackageIndex, prefix, dir string, compressors []Compressor, formats IndexFormats, signer *GpgSigner, split_arch bool, dups *Duplicates) []indexFile {
+
+	// the generated files change only if the packages change, so they are
+	// as old as the newest package. this, and the ETags derived from the
+	// content, keep conditional requests working across restarts.
+	modtime := packages.NewestModTime()
+	if modtime.IsZero() {
+		modtime = time.Now()
+	}
 
 	packages_stamps := bytes.NewBuffer(nil)
 	packages_content := bytes.NewBuffer(nil)
-	packages_content_gz := bytes.NewBuffer(nil)
 	packages.StringTo(packages_content)
-	gzipper(packages_content_gz, bytes.NewReader(packages_content.Bytes()))
-	packages.StampsTo(packages_stamps)
+	if formats[FormatPackagesStamps] || formats[FormatPackagesStampsGz] {
+		packages.StampsTo(packages_stamps)
+	}
+
+	// the compressed variants of 'Packages', eg. Packages.gz
+	type compressed_file struct {
+		name    string
+		content *bytes.Buffer
+	}
+	packages_compressed := make([]compressed_file, 0, len(compressors))
+	var packages_content_gz *bytes.Buffer
+	for _, compressor := range compressors {
+		name := FormatPackages + compressor.Ext
+		if !formats[name] {
+			continue
+		}
+		content := bytes.NewBuffer(nil)
+		if err := compressor.Compress(content, bytes.NewReader(packages_content.Bytes())); err != nil {
+			logErrorf("creating %q for %q: %v", name, prefix, err)
+			continue
+		}
+		if name == FormatPackagesGz {
+			packages_content_gz = content
+		}
+		packages_compressed = append(packages_compressed, compressed_file{name, content})
+	}
+
+	// one 'Packages' per architecture, eg. Packages.armv7 and Packages.armv7.gz.
+	// these do not depend on 'formats' for the plain file, the compressed
+	// ones are created only if the combined one is exposed as well.
+	var packages_arch []compressed_file
+	if split_arch {
+		by_arch := packages.ByArchitecture()
+		archs := make([]string, 0, len(by_arch))
+		for arch := range by_arch {
+			archs = append(archs, arch)
+		}
+		sort.Strings(archs)
+		for _, arch := range archs {
+			name := FormatPackages + "." + arch
+			content := bytes.NewBuffer(nil)
+			by_arch[arch].StringTo(content)
+			packages_arch = append(packages_arch, compressed_file{name, content})
+			for _, compressor := range compressors {
+				if !formats[FormatPackages+compressor.Ext] {
+					continue
+				}
+				compressed := bytes.NewBuffer(nil)
+				if err := compressor.Compress(compressed, bytes.NewReader(content.Bytes())); err != nil {
+					logErrorf("creating %q for %q: %v", name+compressor.Ext, prefix, err)
+					continue
+				}
+				packages_arch = append(packages_arch, compressed_file{name + compressor.Ext, compressed})
+			}
+		}
+	}
+
+	if !formats[FormatPackages] {
+		packages_content = bytes.NewBuffer(nil)
+	}
+
+	// Packages.stamps.gz is created by the same gzipper as Packages.gz
+	var packages_stamps_gz *bytes.Buffer
+	for _, compressor := range compressors {
+		if compressor.Ext != ".gz" || !formats[FormatPackagesStampsGz] {
+			continue
+		}
+		packages_stamps_gz = bytes.NewBuffer(nil)
+		if err := compressor.Compress(packages_stamps_gz, bytes.NewReader(packages_stamps.Bytes())); err != nil {
+			logErrorf("creating %q for %q: %v", FormatPackagesStampsGz, prefix, err)
+			packages_stamps_gz = nil
+		}
+	}
+	if !formats[FormatPackagesStamps] {
+		packages_stamps = bytes.NewBuffer(nil)
+	}
+
+	serve_content := func(name string, content *bytes.Buffer) http.Handler {
+		etag := contentETag(content.Bytes())
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			http.ServeContent(w, r, name, modtime, bytes.NewReader(content.Bytes()))
+		})
+	}
 
+	packages_etag := contentETag(packages_content.Bytes())
+	var packages_gz_etag string
+	if packages_content_gz != nil {
+		packages_gz_etag = contentETag(packages_content_gz.Bytes())
+	}
+	// 'Packages' is served gzip'ed to clients accepting it, both variants
+	// are the same text: caches must tell them apart by Accept-Encoding.
 	packages_handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			http.ServeContent(w, r, "Packages", now, bytes.NewReader(packages_content.Bytes()))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if packages_content_gz != nil {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		if packages_content_gz == nil || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("ETag", packages_etag)
+			http.ServeContent(w, r, "Packages", modtime, bytes.NewReader(packages_content.Bytes()))
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("Content-Encoding", "gzip")
-		http.ServeContent(w, r, "Packages", now, bytes.NewReader(packages_content_gz.Bytes()))
+		w.Header().Set("ETag", packages_gz_etag)
+		http.ServeContent(w, r, "Packages", modtime, bytes.NewReader(packages_content_gz.Bytes()))
 	})
 
-	packages_gz_handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeContent(w, r, "Packages.gz", now, bytes.NewReader(packages_content_gz.Bytes()))
-	})
+	// the generated files, in the order they are listed on the index page
+	type meta_file struct {
+		name    string
+		content *bytes.Buffer
+		handler http.Handler
+	}
+	meta_files := make([]meta_file, 0, len(packages_compressed)+len(packages_arch)+5)
+	if formats[FormatPackages] {
+		meta_files = append(meta_files, meta_file{FormatPackages, packages_content, packages_handler})
+	}
+	for _, file := range packages_compressed {
+		meta_files = append(meta_files, meta_file{file.name, file.content, serve_content(file.name, file.content)})
+	}
+	for _, file := range packages_arch {
+		meta_files = append(meta_files, meta_file{file.name, file.content, serve_content(file.name, file.content)})
+	}
+	if formats[FormatPackagesStamps] {
+		meta_files = append(meta_files, meta_file{FormatPackagesStamps, packages_stamps, serve_content(FormatPackagesStamps, packages_stamps)})
+	}
+	if packages_stamps_gz != nil {
+		meta_files = append(meta_files, meta_file{FormatPackagesStampsGz, packages_stamps_gz, serve_content(FormatPackagesStampsGz, packages_stamps_gz)})
+	}
 
-	packages_stamps_handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeContent(w, r, "Packages.stamps", now, bytes.NewReader(packages_stamps.Bytes()))
+	index_json := bytes.NewBuffer(nil)
+	if err := packages.JSONTo(index_json); err != nil {
+		logErrorf("creating index.json for %q: %v", prefix, err)
+	}
+	index_json_gz := gzipBytes(index_json.Bytes())
+	index_json_etag, index_json_gz_etag := contentETag(index_json.Bytes()), contentETag(index_json_gz.Bytes())
+	index_json_handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("ETag", index_json_etag)
+			http.ServeContent(w, r, "index.json", modtime, bytes.NewReader(index_json.Bytes()))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", index_json_gz_etag)
+		http.ServeContent(w, r, "index.json", modtime, bytes.NewReader(index_json_gz.Bytes()))
 	})
+	meta_files = append(meta_files, meta_file{"index.json", index_json, index_json_handler})
+
+	if signer != nil {
+		release := bytes.NewBuffer(nil)
+		release_files := make([]indexFile, 0, len(meta_files))
+		if formats[FormatPackages] {
+			release_files = append(release_files, indexFile{FormatPackages, packages_content.Bytes()})
+		}
+		for _, file := range packages_compressed {
+			release_files = append(release_files, indexFile{file.name, file.content.Bytes()})
+		}
+		for _, file := range packages_arch {
+			release_files = append(release_files, indexFile{file.name, file.content.Bytes()})
+		}
+		ReleaseTo(release, modtime, release_files)
+
+		release_gpg := bytes.NewBuffer(nil)
+		in_release := bytes.NewBuffer(nil)
+		err := signer.DetachSign(release_gpg, bytes.NewReader(release.Bytes()))
+		if err == nil {
+			err = signer.ClearSign(in_release, bytes.NewReader(release.Bytes()))
+		}
+
+		if err != nil {
+			logErrorf("signing Release for %q: %v", prefix, err)
+		} else {
+			meta_files = append(meta_files,
+				meta_file{"Release", release, serve_content("Release", release)},
+				meta_file{"Release.gpg", release_gpg, serve_content("Release.gpg", release_gpg)},
+				meta_file{"InRelease", in_release, serve_content("InRelease", in_release)})
+		}
+	}
 
 	index_handler := func() http.Handler {
 
 		names := packages.SortedNames()
 		ctx := RenderCtx{Title: prefix + " - kellner", Version: VERSION, Date: time.Now()}
 
-		const n_meta_files = 3
-		ctx.Entries = make([]DirEntry, len(names)+n_meta_files)
-		ctx.Entries[0] = DirEntry{Name: "Packages", ModTime: now, Size: int64(packages_content.Len())}
-		ctx.Entries[1] = DirEntry{Name: "Packages.gz", ModTime: now, Size: int64(packages_content_gz.Len())}
-		ctx.Entries[2] = DirEntry{Name: "Packages.stamps", ModTime: now, Size: int64(packages_stamps.Len())}
+		ctx.Entries = make([]DirEntry, 0, len(names)+len(meta_files))
+		for _, meta := range meta_files {
+			ctx.Entries = append(ctx.Entries, DirEntry{Name: meta.name, ModTime: modtime, Size: int64(meta.content.Len())})
+		}
 
-		for i, name := range names {
+		for _, name := range names {
 			ipkg := packages.Entries[name]
-			ctx.Entries[i+n_meta_files] = ipkg.DirEntry()
+			ctx.Entries = append(ctx.Entries, ipkg.DirEntry())
 			ctx.SumFileSize += ipkg.FileInfo.Size()
 		}
 
 		index, index_gz := ctx.render(IndexTemplate)
 
+		// with 'dups' the listing is rendered again whenever the duplicates
+		// change, eg. after another feed was rebuilt. a listing of only the
+		// packages of one 'arch' (?arch=) or sorted otherwise than by name
+		// (?sort=, ?order=) is rendered on every request.
+		//
+		// the listing is last modified with the newest package, or when it
+		// changed due to 'dups'.
+		var (
+			rendered_mu  sync.Mutex
+			rendered_gen = -1
+			index_mtime  = modtime
+		)
+		current_index := func(arch, sort_by string, desc bool) (*bytes.Buffer, *bytes.Buffer, time.Time) {
+			rendered_mu.Lock()
+			defer rendered_mu.Unlock()
+			if dups != nil {
+				if gen, paths := dups.current(); gen != rendered_gen {
+					for i, name := range names {
+						entry := &ctx.Entries[len(meta_files)+i]
+						entry.SameAs = sameContentAs(paths, packages.Entries[name].Sha256, path.Join(prefix, name))
+					}
+					index, index_gz = ctx.render(IndexTemplate)
+					if rendered_gen != -1 {
+						index_mtime = time.Now()
+					}
+					rendered_gen = gen
+				}
+			}
+			if arch == "" && (sort_by == "" || sort_by == "name") && !desc {
+				return index, index_gz, index_mtime
+			}
+
+			filtered := ctx
+			filtered.Entries = make([]DirEntry, len(meta_files), len(ctx.Entries))
+			filtered.SumFileSize = 0
+			copy(filtered.Entries, ctx.Entries)
+			for _, entry := range ctx.Entries[len(meta_files):] {
+				if arch == "" || entry.Arch == arch {
+					filtered.Entries = append(filtered.Entries, entry)
+					filtered.SumFileSize += entry.Size
+				}
+			}
+			sortDirEntries(filtered.Entries[len(meta_files):], sort_by, desc)
+			filtered_index, filtered_index_gz := filtered.render(IndexTemplate)
+			return filtered_index, filtered_index_gz, index_mtime
+		}
+
 		// the actual index handler
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if strings.HasSuffix(r.URL.Path, ".control") {
@@ -144,37 +403,100 @@ func AttachHttpHandler(mux *http.ServeMux, packages *PackageIndex, prefix, root
 				}
 				io.WriteString(w, ipkg.Control)
 			} else if r.URL.Path == prefix || r.URL.Path == prefix+"/" {
+				query := r.URL.Query()
+				index, index_gz, index_mtime := current_index(query.Get("arch"), query.Get("sort"), query.Get("order") == "desc")
 				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Header().Add("Vary", "Accept-Encoding")
+				// conditional requests (If-Modified-Since) yield 304
 				if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-					w.Write(index.Bytes())
+					http.ServeContent(w, r, "", index_mtime, bytes.NewReader(index.Bytes()))
 					return
 				}
 				w.Header().Set("Content-Encoding", "gzip")
-				w.Write(index_gz.Bytes())
+				http.ServeContent(w, r, "", index_mtime, bytes.NewReader(index_gz.Bytes()))
+			} else if isIndexFormat(path.Base(r.URL.Path)) && path.Dir(r.URL.Path) == path.Clean(prefix) {
+				// a generated file which is not exposed by this feed. do not fall
+				// back to a (maybe stale) file with the same name on disk.
+				http.NotFound(w, r)
 			} else {
-				http.ServeFile(w, r, path.Join(root, r.URL.Path))
+				// a package: its md5 lets clients verify the download. not
+				// for a range, the header describes the body sent.
+				if ipkg, ok := packages.Entries[path.Base(r.URL.Path)]; ok && ipkg.Md5 != "" &&
+					path.Dir(r.URL.Path) == path.Clean(prefix) && r.Header.Get("Range") == "" {
+					if sum, err := hex.DecodeString(ipkg.Md5); err == nil {
+						w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+					}
+				}
+				// a package is compressed already (the gzip'ed tars in the ar),
+				// proxies must not compress it again
+				if path.Ext(r.URL.Path) == ".ipk" {
+					w.Header().Set("Cache-Control", "public, no-transform")
+				}
+				w = setFileTypeHeaders(w, r.URL.Path)
+				http.ServeFile(w, r, path.Join(dir, strings.TrimPrefix(r.URL.Path, prefix)))
 			}
 		})
 	}()
 
 	mux.Handle(prefix+"/", index_handler)
-	mux.Handle(prefix+"/Packages", packages_handler)
-	mux.Handle(prefix+"/Packages.gz", packages_gz_handler)
-	mux.Handle(prefix+"/Packages.stamps", packages_stamps_handler)
+	generated := make([]indexFile, 0, len(meta_files))
+	for _, meta := range meta_files {
+		mux.Handle(prefix+"/"+meta.name, meta.handler)
+		generated = append(generated, indexFile{meta.name, meta.content.Bytes()})
+	}
+	return generated
+}
+
+// sorts the listed packages 'entries' by "size", "modtime" or "name" (the
+// default, also for unknown values). ties are broken by name.
+func sortDirEntries(entries []DirEntry, by string, desc bool) {
+	less := func(a, b *DirEntry) bool { return a.Name < b.Name }
+	switch by {
+	case "size":
+		less = func(a, b *DirEntry) bool {
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+			return a.Name < b.Name
+		}
+	case "modtime":
+		less = func(a, b *DirEntry) bool {
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+			return a.Name < b.Name
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if desc {
+			return less(&entries[j], &entries[i])
+		}
+		return less(&entries[i], &entries[j])
+	})
 }
 
 func (ctx *RenderCtx) render(tmpl *template.Template) (index, index_gz *bytes.Buffer) {
 
 	index = bytes.NewBuffer(nil)
-	if err := IndexTemplate.Execute(index, ctx); err != nil {
-		panic(err)
+	if err := tmpl.Execute(index, ctx); err != nil {
+		logErrorf("rendering the listing %q: %v", ctx.Title, err)
 	}
-	index_gz = bytes.NewBuffer(nil)
-	gz := gzip.NewWriter(index_gz)
-	gz.Write(index.Bytes())
-	gz.Close()
+	return index, gzipBytes(index.Bytes())
+}
 
-	return index, index_gz
+// a strong ETag for 'content'
+func contentETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// returns the gzip-compressed 'content'
+func gzipBytes(content []byte) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	gz.Write(content)
+	gz.Close()
+	return buf
 }
 
 // based upon 'feeds' create a opkg-repository snippet:
@@ -182,27 +504,197 @@ func (ctx *RenderCtx) render(tmpl *template.Template) (index, index_gz *bytes.Bu
 //   src/gz name-ipks http://host:port/name
 //   src/gz name2-ipks http://host:port/name2
 //
+// the scheme is taken from the request, see requestScheme().
+//
 // TODO: add that entry to the parent directory-handler "somehow"
-func AttachOpkgRepoSnippet(mux *http.ServeMux, mount string, feeds []string) {
+func AttachOpkgRepoSnippet(mux *http.ServeMux, mount string, feeds func() []string, proxies TrustedProxies) {
 
 	mux.Handle(mount, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		scheme := r.URL.Scheme
-		if scheme == "" {
-			scheme = "http://"
+		writeOpkgConfTo(w, requestScheme(r, proxies)+"://"+r.Host, feeds())
+	}))
+}
+
+// returns the scheme the client used to reach kellner: "https" if the
+// request came in via tls, otherwise what a reverse-proxy reported via
+// "X-Forwarded-Proto" (its first value), "http" as the last resort. only
+// the trusted 'proxies' are believed, anyone else could make kellner hand
+// out "http" urls for a feed served via https only.
+func requestScheme(r *http.Request, proxies TrustedProxies) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if !proxies.trustsPeer(r) {
+		return "http"
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if i := strings.IndexByte(proto, ','); i >= 0 {
+		proto = proto[:i]
+	}
+	switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+	case "http", "https":
+		return proto
+	}
+	return "http"
+}
+
+// writes a "src/gz" line for each feed served at 'base' + 'mux_path'
+func writeOpkgConfTo(w io.Writer, base string, mux_paths []string) {
+	for _, mux_path := range mux_paths {
+		repo_name := strings.Replace(mux_path[1:], "/", "-", -1)
+		fmt.Fprintf(w, "src/gz %s-ipks %s%s\n", repo_name, base, mux_path)
+	}
+}
+
+// answers health checks of load-balancers: 503 while the initial scan
+// of 'repo' is still in progress, 200 once it's done.
+func healthzHandler(repo *Repository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if !repo.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"status":"indexing"}`+"\n")
+			return
 		}
+		fmt.Fprintf(w, `{"status":"ok","feeds":%d}`+"\n", len(repo.Indices()))
+	})
+}
 
-		for _, mux_path := range feeds {
-			repo_name := strings.Replace(mux_path[1:], "/", "-", -1)
-			fmt.Fprintf(w, "src/gz %s-ipks %s%s%s\n", repo_name, scheme, r.Host, mux_path)
+// serves 'mount' by 'exempt' and everything else by 'handler'. used to
+// keep 'exempt' outside of client-cert checks and the client-id mapping.
+// a 'mount' ending in "/" exempts everything below it.
+func exemptPath(mount string, exempt, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == mount || (strings.HasSuffix(mount, "/") && strings.HasPrefix(r.URL.Path, mount)) {
+			exempt.ServeHTTP(w, r)
+			return
 		}
-	}))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// rejects requests which do not come with a client certificate. see
+// initTLS(): -require-client-cert is checked here and not during the
+// tls-handshake to be able to exempt some paths (eg, /healthz).
+func requireClientCert(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			writeError(http.StatusUnauthorized, w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// keeps the number of requests currently handled by 'handler' in 'n'
+func countInFlight(handler http.Handler, n *int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(n, 1)
+		defer atomic.AddInt64(n, -1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// sets the Server header of all responses of 'handler' to 'server'. a
+// server of "-" strips the header, should any handler have set it.
+func setServerHeader(handler http.Handler, server string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server == "-" {
+			w = &stripServerHeader{ResponseWriter: w}
+		} else {
+			w.Header().Set("Server", server)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// removes the Server header right before the response header is sent
+type stripServerHeader struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *stripServerHeader) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Del("Server")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *stripServerHeader) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *stripServerHeader) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{w}, src)
+}
+
+func (w *stripServerHeader) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *stripServerHeader) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+func (w *stripServerHeader) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 const _EXTRA_LOG_KEY = "kellner-log-data"
 
-// wraps 'orig_handler' to log incoming http-request
-func logRequests(handler http.Handler) http.Handler {
+// the request headers logRequests() is able to log
+const (
+	LogHeadersFull    = "full"    // all request headers
+	LogHeadersCurated = "curated" // only 'curatedLogHeaders'
+	LogHeadersNone    = "none"    // no request headers
+)
+
+// the log-data attached by internal handlers is always part of the curated set
+var curatedLogHeaders = []string{"User-Agent", "Accept-Encoding", _EXTRA_LOG_KEY}
+
+// the formats of the request log
+const (
+	LogFormatText = "text" // space separated, for humans
+	LogFormatJSON = "json" // one json-object per line
+)
+
+// a request, as logged with LogFormatJSON
+type requestLogEntry struct {
+	Time       time.Time   `json:"time"`
+	RemoteAddr string      `json:"remote_addr"`
+	ClientId   string      `json:"client_id,omitempty"`
+	Method     string      `json:"method"`
+	Status     int         `json:"status"`
+	Host       string      `json:"host"`
+	URI        string      `json:"uri"`
+	Bytes      int64       `json:"bytes"`
+	Headers    http.Header `json:"headers,omitempty"`
+}
+
+// wraps 'orig_handler' to log incoming http-request. 'logHeaders' is one
+// of LogHeadersFull, LogHeadersCurated or LogHeadersNone, 'logFormat' one
+// of LogFormatText or LogFormatJSON. the client-id logged is the one of the
+// certificate at 'certDepth' of the client's chain, see clientIdOfChain().
+// the remote address logged is the one of the client behind 'proxies',
+// see TrustedProxies.RemoteAddr().
+func logRequests(handler http.Handler, logHeaders, logFormat string, certDepth int, proxies TrustedProxies) http.Handler {
+	// json lines go without the timestamp-prefix of the log
+	json_log := log.New(log.Writer(), "", 0)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// NOTE: maybe a dopey idea: let the http-handlers attach logging
@@ -221,26 +713,126 @@ func logRequests(handler http.Handler) http.Handler {
 			status_log.Code = 200
 		}
 
-		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
-			log.Println(r.RemoteAddr, r.Method, status_log.Code, r.Host, r.RequestURI, r.Header)
+		remote_addr := proxies.RemoteAddr(r)
+		client_id := ""
+		if r.TLS != nil {
+			client_id = clientIdOfChain(r.TLS, certDepth)
+		}
+
+		var headers http.Header
+		switch logHeaders {
+		case LogHeadersFull:
+			headers = r.Header
+		case LogHeadersCurated:
+			headers = selectHeaders(r.Header, curatedLogHeaders)
+		default:
+			headers = selectHeaders(r.Header, []string{_EXTRA_LOG_KEY})
+		}
+
+		if logFormat == LogFormatJSON {
+			entry, _ := json.Marshal(requestLogEntry{
+				Time:       time.Now(),
+				RemoteAddr: remote_addr,
+				ClientId:   client_id,
+				Method:     r.Method,
+				Status:     status_log.Code,
+				Host:       r.Host,
+				URI:        r.RequestURI,
+				Bytes:      status_log.Bytes,
+				Headers:    headers,
+			})
+			json_log.Println(string(entry))
 			return
 		}
 
-		// TODO: handle more than the first certificate
-		clientId := clientIdByName(&r.TLS.PeerCertificates[0].Subject)
-		log.Println(r.RemoteAddr, clientId, r.Method, status_log.Code, r.Host, r.RequestURI, r.Header)
+		fields := make([]interface{}, 0, 7)
+		fields = append(fields, remote_addr)
+		if client_id != "" {
+			fields = append(fields, client_id)
+		}
+		fields = append(fields, r.Method, status_log.Code, status_log.Bytes, r.Host, r.RequestURI)
+
+		switch {
+		case logHeaders == LogHeadersFull || logHeaders == LogHeadersCurated:
+			fields = append(fields, headers)
+		case len(headers) > 0:
+			fields = append(fields, headers[http.CanonicalHeaderKey(_EXTRA_LOG_KEY)])
+		}
+
+		log.Println(fields...)
 	})
 }
 
+// returns a copy of 'header' containing only the present 'keys'
+func selectHeaders(header http.Header, keys []string) http.Header {
+	selected := make(http.Header, len(keys))
+	for _, key := range keys {
+		key = http.CanonicalHeaderKey(key)
+		if values, ok := header[key]; ok {
+			selected[key] = values
+		}
+	}
+	return selected
+}
+
 //
 // small helper to intercept the http-statuscode written
 // to the original http.ResponseWriter
 type logStatusCode struct {
 	http.ResponseWriter
-	Code int
+	Code  int
+	Bytes int64 // of the body
 }
 
 func (w *logStatusCode) WriteHeader(code int) {
 	w.Code = code
 	w.ResponseWriter.WriteHeader(code)
 }
+
+func (w *logStatusCode) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.Bytes += int64(n)
+	return n, err
+}
+
+// io.Copy() (eg, in http.ServeContent) prefers ReadFrom(), which lets
+// the original writer use sendfile() for files
+func (w *logStatusCode) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(src)
+		w.Bytes += n
+		return n, err
+	}
+	return io.Copy(writerOnly{w}, src)
+}
+
+// hides the ReadFrom() of a writer from io.Copy()
+type writerOnly struct {
+	io.Writer
+}
+
+// keeps streamed responses (eg, /admin/verify) streaming
+func (w *logStatusCode) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *logStatusCode) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// lets http.ResponseController reach the wrapped writer
+func (w *logStatusCode) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// the wrappers of http.ResponseWriter pass Flush(), Hijack() and
+// ReadFrom() on to the writer they wrap. if that one does not support
+// them, Flush() does nothing, ReadFrom() copies and Hijack() fails.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
@@ -0,0 +1,674 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the handler of a feed at "/arm" with the package foo, exposing 'formats'
+func testFeedHandler(t *testing.T, formats IndexFormats) http.Handler {
+	t.Helper()
+	return testFeedHandlerIn(t, t.TempDir(), formats)
+}
+
+func testFeedHandlerIn(t *testing.T, dir string, formats IndexFormats) http.Handler {
+	t.Helper()
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	feed := testFeed(dir, "/arm")
+	feed.Compressors = []Compressor{{"gzip", ".gz", GzGolang}}
+	feed.DefaultFormats = formats
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+// a disabled format is neither served nor listed
+func TestAttachHttpHandlerFormats(t *testing.T) {
+	// a stale file on disk must not be served instead
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "Packages"), "Package: stale\n")
+	handler := testFeedHandlerIn(t, dir, IndexFormats{FormatPackagesGz: true, FormatPackagesStamps: true})
+	for path, code := range map[string]int{
+		"/arm/Packages.gz":        http.StatusOK,
+		"/arm/Packages.stamps":    http.StatusOK,
+		"/arm/Packages":           http.StatusNotFound,
+		"/arm/Packages.xz":        http.StatusNotFound,
+		"/arm/Packages.stamps.gz": http.StatusNotFound,
+		"/arm/index.json":         http.StatusOK,
+	} {
+		if got := getStatus(handler, path); got != code {
+			t.Errorf("GET %s: got %d, expected %d", path, got, code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/arm/", nil))
+	listing := w.Body.String()
+	for name, listed := range map[string]bool{
+		`"Packages.gz"`:     true,
+		`"Packages.stamps"`: true,
+		`"Packages"`:        false,
+	} {
+		if strings.Contains(listing, name) != listed {
+			t.Errorf("GET /arm/: expected %s to be listed=%v", name, listed)
+		}
+	}
+}
+
+func getBody(t *testing.T, handler http.Handler, path string) []byte {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d", path, w.Code)
+	}
+	return w.Body.Bytes()
+}
+
+func gunzip(t *testing.T, content []byte) []byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestPackagesStampsGz(t *testing.T) {
+	handler := testFeedHandler(t, IndexFormats{FormatPackagesStamps: true, FormatPackagesStampsGz: true})
+	stamps := getBody(t, handler, "/arm/Packages.stamps")
+	if len(stamps) == 0 {
+		t.Fatal("GET /arm/Packages.stamps: empty")
+	}
+	if got := gunzip(t, getBody(t, handler, "/arm/Packages.stamps.gz")); !bytes.Equal(got, stamps) {
+		t.Errorf("Packages.stamps.gz: got %q, expected %q", got, stamps)
+	}
+
+	// the gzipped file only, the plain one is still created for it
+	handler = testFeedHandler(t, IndexFormats{FormatPackagesStampsGz: true})
+	if got := gunzip(t, getBody(t, handler, "/arm/Packages.stamps.gz")); !bytes.HasPrefix(got, []byte("foo_1.0_arm.ipk\t")) {
+		t.Errorf("Packages.stamps.gz alone: got %q", got)
+	}
+	if code := getStatus(handler, "/arm/Packages.stamps"); code != http.StatusNotFound {
+		t.Errorf("GET /arm/Packages.stamps: got %d, expected 404", code)
+	}
+}
+
+// the "Package" fields of the stanzas in 'index'
+func packageNames(index []byte) []string {
+	names := []string{}
+	for _, line := range strings.Split(string(index), "\n") {
+		if strings.HasPrefix(line, "Package: ") {
+			names = append(names, strings.TrimPrefix(line, "Package: "))
+		}
+	}
+	return names
+}
+
+func TestSplitArch(t *testing.T) {
+	dir := t.TempDir()
+	writeIpk(t, dir, "foo_1.0_armv7.ipk", testControl("foo", "1.0", "armv7"))
+	writeIpk(t, dir, "bar_1.0_armv7.ipk", testControl("bar", "1.0", "armv7"))
+	writeIpk(t, dir, "foo_1.0_mips.ipk", testControl("foo", "1.0", "mips"))
+	writeIpk(t, dir, "doc_1.0_all.ipk", testControl("doc", "1.0", "all"))
+	feed := testFeed(dir, "/arm")
+	feed.Compressors = []Compressor{{"gzip", ".gz", GzGolang}}
+	feed.DefaultFormats = IndexFormats{FormatPackages: true, FormatPackagesGz: true}
+	feed.SplitArch = true
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		expected []string
+	}{
+		{"/arm/Packages", []string{"bar", "doc", "foo", "foo"}},
+		{"/arm/Packages.armv7", []string{"bar", "foo"}},
+		{"/arm/Packages.mips", []string{"foo"}},
+		{"/arm/Packages.all", []string{"doc"}},
+	} {
+		index := getBody(t, feed, test.path)
+		if got := packageNames(index); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("GET %s: got %v, expected %v", test.path, got, test.expected)
+		}
+		if got := packageNames(gunzip(t, getBody(t, feed, test.path+".gz"))); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("GET %s.gz: got %v, expected %v", test.path, got, test.expected)
+		}
+	}
+	if code := getStatus(feed, "/arm/Packages.x86"); code != http.StatusNotFound {
+		t.Errorf("GET /arm/Packages.x86: got %d, expected 404", code)
+	}
+}
+
+func TestOpkgRepoSnippet(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	AttachOpkgRepoSnippet(mux, "/opkg.conf", func() []string { return []string{"/arm", "/mips/sub"} }, proxies)
+
+	for _, test := range []struct {
+		remoteAddr string
+		tls        bool
+		proto      string
+		scheme     string
+	}{
+		{"192.0.2.1:1234", false, "", "http"},
+		{"192.0.2.1:1234", true, "", "https"},
+		{"10.1.2.3:1234", false, "https", "https"},
+		{"192.0.2.1:1234", false, "https", "http"},
+	} {
+		r := httptest.NewRequest("GET", "/opkg.conf", nil)
+		r.Host = "feeds.example.com"
+		r.RemoteAddr = test.remoteAddr
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if test.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		expected := "src/gz arm-ipks " + test.scheme + "://feeds.example.com/arm\n" +
+			"src/gz mips-sub-ipks " + test.scheme + "://feeds.example.com/mips/sub\n"
+		if got := w.Body.String(); got != expected {
+			t.Errorf("%s tls=%v X-Forwarded-Proto %q: got %q, expected %q", test.remoteAddr, test.tls, test.proto, got, expected)
+		}
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		proto      string
+		expected   string
+	}{
+		{"plain", "192.0.2.1:1234", false, "", "http"},
+		{"direct tls", "192.0.2.1:1234", true, "", "https"},
+		{"direct tls, header ignored", "192.0.2.1:1234", true, "http", "https"},
+		{"trusted proxy", "10.1.2.3:1234", false, "https", "https"},
+		{"trusted proxy, first value", "10.1.2.3:1234", false, "https, http", "https"},
+		{"trusted proxy, bogus value", "10.1.2.3:1234", false, "gopher", "http"},
+		{"untrusted proxy", "192.0.2.1:1234", false, "https", "http"},
+	} {
+		r := httptest.NewRequest("GET", "/opkg.conf", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if test.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		if got := requestScheme(r, proxies); got != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, got, test.expected)
+		}
+	}
+
+	// no -trusted-proxies: the header is never believed
+	r := httptest.NewRequest("GET", "/opkg.conf", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if got := requestScheme(r, nil); got != "http" {
+		t.Errorf("without -trusted-proxies: got %q, expected \"http\"", got)
+	}
+}
+
+func TestSetServerHeader(t *testing.T) {
+	for _, test := range []struct {
+		server      string // -server-header
+		handlerSets string // the Server set by the handler, if any
+		writeHeader bool   // the handler calls WriteHeader() itself
+		expected    string
+		present     bool
+	}{
+		{"kellner", "", false, "kellner", true},
+		{"kellner", "", true, "kellner", true},
+		{"-", "", false, "", false},
+		{"-", "upstream/1.0", false, "", false},
+		{"-", "upstream/1.0", true, "", false},
+	} {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.handlerSets != "" {
+				w.Header().Set("Server", test.handlerSets)
+			}
+			if test.writeHeader {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			io.WriteString(w, "hello")
+		})
+		w := httptest.NewRecorder()
+		setServerHeader(handler, test.server).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		values, present := w.Result().Header["Server"]
+		if present != test.present || (present && values[0] != test.expected) {
+			t.Errorf("-server-header %q, handler sets %q: got %q, expected %q (present=%v)",
+				test.server, test.handlerSets, values, test.expected, test.present)
+		}
+	}
+}
+
+// a ResponseWriter supporting Flush(), Hijack(), ReadFrom() and (for
+// http.ResponseController) SetWriteDeadline(), recording which of them
+// were called
+type fullWriter struct {
+	*httptest.ResponseRecorder
+	called map[string]bool
+}
+
+func (w *fullWriter) Flush() { w.called["Flush"] = true }
+
+func (w *fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.called["Hijack"] = true
+	return nil, nil, nil
+}
+
+func (w *fullWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.called["ReadFrom"] = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func (w *fullWriter) SetWriteDeadline(deadline time.Time) error {
+	w.called["SetWriteDeadline"] = true
+	return nil
+}
+
+func TestResponseWriterWrappers(t *testing.T) {
+	wrappers := map[string]func(http.ResponseWriter) http.ResponseWriter{
+		"logStatusCode":     func(w http.ResponseWriter) http.ResponseWriter { return &logStatusCode{ResponseWriter: w} },
+		"stripServerHeader": func(w http.ResponseWriter) http.ResponseWriter { return &stripServerHeader{ResponseWriter: w} },
+	}
+	for name, wrap := range wrappers {
+		inner := &fullWriter{httptest.NewRecorder(), make(map[string]bool)}
+		w := wrap(inner)
+		flusher, isFlusher := w.(http.Flusher)
+		hijacker, isHijacker := w.(http.Hijacker)
+		readerFrom, isReaderFrom := w.(io.ReaderFrom)
+		if !isFlusher || !isHijacker || !isReaderFrom {
+			t.Fatalf("%s: Flusher %v, Hijacker %v, ReaderFrom %v", name, isFlusher, isHijacker, isReaderFrom)
+		}
+		flusher.Flush()
+		hijacker.Hijack()
+		if n, err := readerFrom.ReadFrom(strings.NewReader("hello")); n != 5 || err != nil {
+			t.Errorf("%s: ReadFrom(): got %d %v", name, n, err)
+		}
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now()); err != nil {
+			t.Errorf("%s: http.ResponseController: %v", name, err)
+		}
+		if expected := map[string]bool{"Flush": true, "Hijack": true, "ReadFrom": true, "SetWriteDeadline": true}; !reflect.DeepEqual(inner.called, expected) {
+			t.Errorf("%s: passed on %v, expected %v", name, inner.called, expected)
+		}
+
+		// the recorder can not hijack, nor ReadFrom()
+		recorder := httptest.NewRecorder()
+		w = wrap(recorder)
+		if _, _, err := w.(http.Hijacker).Hijack(); err != http.ErrNotSupported {
+			t.Errorf("%s: Hijack() of a recorder: got %v, expected http.ErrNotSupported", name, err)
+		}
+		if n, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("hello")); n != 5 || err != nil || recorder.Body.String() != "hello" {
+			t.Errorf("%s: ReadFrom() of a recorder: got %d %v %q", name, n, err, recorder.Body.String())
+		}
+		w.(http.Flusher).Flush()
+		if !recorder.Flushed {
+			t.Errorf("%s: Flush() not passed on to the recorder", name)
+		}
+	}
+
+	// the bytes copied via ReadFrom() are logged as well
+	w := &logStatusCode{ResponseWriter: &fullWriter{httptest.NewRecorder(), make(map[string]bool)}}
+	io.Copy(w, strings.NewReader("hello"))
+	if w.Bytes != 5 {
+		t.Errorf("logStatusCode: got %d bytes via ReadFrom(), expected 5", w.Bytes)
+	}
+}
+
+// the log line of a single request 'r' to 'handler'
+func logRequest(t *testing.T, handler http.Handler, r *http.Request, logHeaders, logFormat string, proxies TrustedProxies) string {
+	t.Helper()
+	buf := captureLog(t)
+	log.SetFlags(0)
+	logRequests(handler, logHeaders, logFormat, 0, proxies).ServeHTTP(httptest.NewRecorder(), r)
+	return buf.String()
+}
+
+func TestLogRequestsHeaders(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set(_EXTRA_LOG_KEY, "extra")
+	})
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("GET", "/arm/Packages", nil)
+		r.Header.Set("User-Agent", "opkg")
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("Cookie", "secret")
+		r.Header.Set(_EXTRA_LOG_KEY, "forged")
+		return r
+	}
+
+	for _, test := range []struct {
+		logHeaders string
+		expected   []string // the headers logged
+	}{
+		{LogHeadersFull, []string{"Accept-Encoding", "Cookie", "Kellner-Log-Data", "User-Agent"}},
+		{LogHeadersCurated, []string{"Accept-Encoding", "Kellner-Log-Data", "User-Agent"}},
+		{LogHeadersNone, []string{"Kellner-Log-Data"}},
+	} {
+		line := logRequest(t, handler, newRequest(), test.logHeaders, LogFormatJSON, nil)
+		var entry requestLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("-log-headers %s: %q: %v", test.logHeaders, line, err)
+		}
+		got := make([]string, 0, len(entry.Headers))
+		for key := range entry.Headers {
+			got = append(got, key)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("-log-headers %s: got %v, expected %v", test.logHeaders, got, test.expected)
+		}
+		if extra := entry.Headers.Get(_EXTRA_LOG_KEY); extra != "extra" {
+			t.Errorf("-log-headers %s: got the log-data %q, expected the one of the handler", test.logHeaders, extra)
+		}
+
+		line = logRequest(t, handler, newRequest(), test.logHeaders, LogFormatText, nil)
+		for _, header := range []string{"User-Agent", "Cookie"} {
+			if logged := strings.Contains(line, header); logged != containsString(test.expected, header) {
+				t.Errorf("-log-headers %s: got %s logged=%v in %q", test.logHeaders, header, logged, line)
+			}
+		}
+		if !strings.Contains(line, "extra") || strings.Contains(line, "forged") {
+			t.Errorf("-log-headers %s: expected the log-data of the handler in %q", test.logHeaders, line)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// a package is served as already compressed, proxies must not gzip it again
+func TestPackageDownloadHeaders(t *testing.T) {
+	handler := testFeedHandler(t, IndexFormats{FormatPackages: true})
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/arm/foo_1.0_arm.ipk", http.StatusOK},
+		{"HEAD", "/arm/foo_1.0_arm.ipk", http.StatusOK},
+		{"GET", "/arm/missing_1.0_arm.ipk", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: got %d, expected %d", test.method, test.path, w.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/x-ipk" {
+			t.Errorf("%s %s: got the Content-Type %q, expected application/x-ipk", test.method, test.path, got)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "public, no-transform" {
+			t.Errorf("%s %s: got the Cache-Control %q, expected \"public, no-transform\"", test.method, test.path, got)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s %s: got the Content-Encoding %q, expected none", test.method, test.path, got)
+		}
+	}
+}
+
+// the logged address is the client behind a trusted proxy, an untrusted
+// peer is logged as it is
+func TestLogRequestsRemoteAddr(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{"10.1.2.3:1234", "198.51.100.7"},
+		{"192.0.2.1:1234", "192.0.2.1:1234"},
+	} {
+		for _, format := range []string{LogFormatText, LogFormatJSON} {
+			r := httptest.NewRequest("GET", "/arm/Packages", nil)
+			r.RemoteAddr = test.remoteAddr
+			r.Header.Set("X-Forwarded-For", "198.51.100.7")
+			logged := logRequest(t, handler, r, LogHeadersNone, format, proxies)
+			expected := test.expected + " "
+			if format == LogFormatJSON {
+				expected = `"remote_addr":"` + test.expected + `"`
+			}
+			if !strings.Contains(logged, expected) || (test.expected != "198.51.100.7" && strings.Contains(logged, "198.51.100.7")) {
+				t.Errorf("-log-format %s, peer %s: expected the address %s, got %q", format, test.remoteAddr, test.expected, logged)
+			}
+		}
+	}
+}
+
+// GET 'path' of 'handler' with the given "Accept-Encoding" and
+// "If-None-Match" ("": none)
+func getNegotiated(handler http.Handler, path, acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// both variants of Packages are the same text, caches tell them apart by
+// Accept-Encoding
+func TestPackagesContentNegotiation(t *testing.T) {
+	handler := testFeedHandler(t, IndexFormats{FormatPackages: true, FormatPackagesGz: true})
+	plain := getBody(t, handler, "/arm/Packages")
+	for _, acceptEncoding := range []string{"", "gzip", "deflate, gzip;q=0.5", "identity"} {
+		gzipped := strings.Contains(acceptEncoding, "gzip")
+		w := getNegotiated(handler, "/arm/Packages", acceptEncoding, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /arm/Packages, Accept-Encoding %q: got %d", acceptEncoding, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+			t.Errorf("Accept-Encoding %q: got the Content-Type %q", acceptEncoding, got)
+		}
+		if got := w.Header().Values("Vary"); !containsString(got, "Accept-Encoding") {
+			t.Errorf("Accept-Encoding %q: got Vary %q", acceptEncoding, got)
+		}
+		body := w.Body.Bytes()
+		if got := w.Header().Get("Content-Encoding"); (got == "gzip") != gzipped {
+			t.Errorf("Accept-Encoding %q: got the Content-Encoding %q", acceptEncoding, got)
+		} else if gzipped {
+			body = gunzip(t, body)
+		}
+		if !bytes.Equal(body, plain) {
+			t.Errorf("Accept-Encoding %q: got another index", acceptEncoding)
+		}
+
+		// a 304 varies as well
+		w = getNegotiated(handler, "/arm/Packages", acceptEncoding, w.Header().Get("ETag"))
+		if w.Code != http.StatusNotModified || !containsString(w.Header().Values("Vary"), "Accept-Encoding") {
+			t.Errorf("Accept-Encoding %q, If-None-Match: got %d, Vary %q", acceptEncoding, w.Code, w.Header().Values("Vary"))
+		}
+	}
+
+	// nothing to negotiate without Packages.gz
+	handler = testFeedHandler(t, IndexFormats{FormatPackages: true})
+	w := getNegotiated(handler, "/arm/Packages", "gzip", "")
+	if w.Header().Get("Content-Encoding") != "" || len(w.Header().Values("Vary")) != 0 {
+		t.Errorf("GET /arm/Packages without Packages.gz: got the Content-Encoding %q, Vary %q", w.Header().Get("Content-Encoding"), w.Header().Values("Vary"))
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("GET /arm/Packages without Packages.gz: got the Content-Type %q", got)
+	}
+}
+
+// index.json and the html listing are served gzip'ed as well
+func TestVaryAcceptEncoding(t *testing.T) {
+	handler := testFeedHandler(t, IndexFormats{FormatPackages: true})
+	for _, test := range []struct {
+		path, contentType string
+	}{
+		{"/arm/index.json", "application/json"},
+		{"/arm/", "text/html; charset=utf-8"},
+	} {
+		var variants [2][]byte
+		for i, acceptEncoding := range []string{"", "gzip"} {
+			w := getNegotiated(handler, test.path, acceptEncoding, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s, Accept-Encoding %q: got %d", test.path, acceptEncoding, w.Code)
+			}
+			if got := w.Header().Values("Vary"); !containsString(got, "Accept-Encoding") {
+				t.Errorf("GET %s, Accept-Encoding %q: got Vary %q", test.path, acceptEncoding, got)
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("GET %s, Accept-Encoding %q: got the Content-Type %q, expected %q", test.path, acceptEncoding, got, test.contentType)
+			}
+			variants[i] = w.Body.Bytes()
+			if got := w.Header().Get("Content-Encoding"); (got == "gzip") != (acceptEncoding == "gzip") {
+				t.Errorf("GET %s, Accept-Encoding %q: got the Content-Encoding %q", test.path, acceptEncoding, got)
+			} else if got == "gzip" {
+				variants[i] = gunzip(t, variants[i])
+			}
+		}
+		if !bytes.Equal(variants[0], variants[1]) {
+			t.Errorf("GET %s: the gzip'ed variant differs", test.path)
+		}
+	}
+
+	w := getNegotiated(handler, "/arm/index.json", "gzip", "")
+	w = getNegotiated(handler, "/arm/index.json", "gzip", w.Header().Get("ETag"))
+	if w.Code != http.StatusNotModified || !containsString(w.Header().Values("Vary"), "Accept-Encoding") {
+		t.Errorf("GET /arm/index.json, If-None-Match: got %d, Vary %q", w.Code, w.Header().Values("Vary"))
+	}
+}
+
+// a handler answering with 'body'
+func bodyHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, body) })
+}
+
+func TestExemptPath(t *testing.T) {
+	handler := exemptPath("/healthz", bodyHandler("exempt"), exemptPath("/metrics/", bodyHandler("exempt"), bodyHandler("handler")))
+	for _, test := range []struct {
+		path, expected string
+	}{
+		{"/healthz", "exempt"},
+		{"/healthz/", "handler"},
+		{"/healthz/x", "handler"},
+		{"/healthzz", "handler"},
+		{"/metrics/", "exempt"},
+		{"/metrics/feeds", "exempt"},
+		{"/metrics", "handler"},
+		{"/", "handler"},
+		{"/arm/healthz", "handler"},
+	} {
+		if got := string(getBody(t, handler, test.path)); got != test.expected {
+			t.Errorf("GET %s: served by %q, expected %q", test.path, got, test.expected)
+		}
+	}
+}
+
+// -require-client-cert, /healthz is exempt
+func TestRequireClientCert(t *testing.T) {
+	handler := exemptPath("/healthz", bodyHandler("healthz"), requireClientCert(bodyHandler("feed")))
+	cert := testCertificate(t, pkix.Name{CommonName: "box-1"})
+	for _, test := range []struct {
+		path string
+		tls  bool
+		cert *x509.Certificate
+		code int
+		body string
+	}{
+		{"/arm/Packages", false, nil, http.StatusUnauthorized, ""},
+		{"/arm/Packages", true, nil, http.StatusUnauthorized, ""},
+		{"/arm/Packages", true, cert, http.StatusOK, "feed"},
+		{"/healthz", false, nil, http.StatusOK, "healthz"},
+		{"/healthz", true, nil, http.StatusOK, "healthz"},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.tls {
+			r = clientRequest(test.path, test.cert)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("GET %s (tls: %v, cert: %v): got %d %q, expected %d %q", test.path, test.tls, test.cert != nil, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	root := mkdirs(t, "arm", "mips")
+	writeIpk(t, filepath.Join(root, "arm"), "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	writeIpk(t, filepath.Join(root, "mips"), "foo_1.0_mips.ipk", testControl("foo", "1.0", "mips"))
+	repo := testRepository(Mount{root, ""})
+	handler := healthzHandler(repo)
+
+	for _, expected := range []struct {
+		code int
+		body string
+	}{
+		{http.StatusServiceUnavailable, `{"status":"indexing"}`},
+		{http.StatusOK, `{"status":"ok","feeds":2}`},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != expected.code || strings.TrimSpace(w.Body.String()) != expected.body {
+			t.Errorf("GET /healthz: got %d %q, expected %d %q", w.Code, w.Body.String(), expected.code, expected.body)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+			t.Errorf("GET /healthz: got the Cache-Control %q, expected no-cache", got)
+		}
+		repo.Scan()
+	}
+}
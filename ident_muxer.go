@@ -12,7 +12,6 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -35,8 +34,10 @@ import (
 //                                            maps request "/special" to /root/ipk-folder2 )
 //
 type ClientIdMuxer struct {
-	IdRoot    string         // folder to use for lookup client-id-requests
-	RootMuxer *http.ServeMux // hold the real worker
+	IdRoot    string          // folder to use for lookup client-id-requests
+	RootMuxer *http.ServeMux  // hold the real worker
+	ACL       *ClientACL      // optional, checked for the mapped path
+	Feeds     func() []string // optional, the feeds listed in a client's /opkg.conf
 }
 
 // looks up the first certificate to get the client-id. based upon the client-id
@@ -68,6 +69,11 @@ func (muxer *ClientIdMuxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	clientDir := filepath.Join(muxer.IdRoot, clientId)
 
+	if r.URL.Path == "/opkg.conf" {
+		muxer.serveOpkgConf(w, r, clientId, clientDir)
+		return
+	}
+
 	requestedPath := path.Clean(r.URL.Path)
 	mapFile := filepath.Join(clientDir, requestedPath)
 	// try different map-files
@@ -84,7 +90,7 @@ func (muxer *ClientIdMuxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// TODO: decide how to treat a directory
 	if fi.IsDir() {
-		log.Println("fi is a directory, is 404 ok?")
+		logDebugf("fi is a directory, is 404 ok?")
 		http.NotFound(w, r)
 		return
 	}
@@ -95,13 +101,19 @@ func (muxer *ClientIdMuxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if fi.Size() > 0 {
 		content, err := ioutil.ReadFile(mapFile)
 		if err != nil {
-			log.Printf("warning: reading %q yields %v", mapFile, err)
+			logWarnf("reading %q yields %v", mapFile, err)
 			writeError(http.StatusInternalServerError, w, r)
 			return
 		}
 		mappedPath = string(bytes.TrimSpace(content))
 	}
 
+	if muxer.ACL != nil && !muxer.ACL.Allowed(clientId, mappedPath) {
+		logInfof("client-acl: %q may not access %q, denied %s", clientId, mappedPath, r.URL.Path)
+		writeError(http.StatusForbidden, w, r)
+		return
+	}
+
 	mappedRequest := *r
 	mappedRequest.URL, _ = url.Parse(r.URL.String())
 	mappedRequest.URL.Path = cleanPath(path.Join(mappedPath, path.Base(r.URL.Path)))
@@ -116,6 +128,52 @@ func (muxer *ClientIdMuxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler.ServeHTTP(w, &mappedRequest)
 }
 
+// lists the feeds of 'clientDir' in the opkg.conf format, by the paths
+// the client requests them with. feeds denied by the ACL and mappings to
+// directories which are not a feed are left out.
+func (muxer *ClientIdMuxer) serveOpkgConf(w http.ResponseWriter, r *http.Request, clientId, clientDir string) {
+
+	if fi, err := os.Stat(clientDir); err != nil || !fi.IsDir() {
+		writeError(http.StatusForbidden, w, r)
+		return
+	}
+
+	feeds := make(map[string]bool)
+	if muxer.Feeds != nil {
+		for _, feed := range muxer.Feeds() {
+			feeds[feed] = true
+		}
+	}
+
+	requestPaths := make([]string, 0)
+	filepath.Walk(clientDir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(clientDir, name)
+		requestPath := "/" + filepath.ToSlash(rel)
+		mappedPath := requestPath
+		if fi.Size() > 0 {
+			content, err := ioutil.ReadFile(name)
+			if err != nil {
+				logWarnf("reading %q yields %v", name, err)
+				return nil
+			}
+			mappedPath = path.Clean("/" + string(bytes.TrimSpace(content)))
+		}
+		if muxer.ACL != nil && !muxer.ACL.Allowed(clientId, mappedPath) {
+			return nil
+		}
+		if muxer.Feeds != nil && !feeds[mappedPath] {
+			return nil
+		}
+		requestPaths = append(requestPaths, requestPath)
+		return nil
+	})
+
+	writeOpkgConfTo(w, "https://"+r.Host, requestPaths)
+}
+
 func writeError(code int, w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(code)
 	fmt.Fprintf(w, "%d %q for %s\n\n", code, http.StatusText(code), r.URL.Path)
@@ -0,0 +1,71 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a request for 'path' by a client presenting 'cert'
+func clientRequest(path string, cert *x509.Certificate) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		r.TLS.PeerCertificates = []*x509.Certificate{cert}
+	}
+	return r
+}
+
+// the directory of a client is selected by its client-id, which includes
+// the email address of the subject
+func TestClientIdMuxerEmail(t *testing.T) {
+	idRoot := t.TempDir()
+	clientDir := filepath.Join(idRoot, "CN=box-1,E=ops_example_com")
+	if err := os.MkdirAll(clientDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(clientDir, "arm"), "")
+	writeTestFile(t, filepath.Join(clientDir, "special"), "mips\n")
+
+	mux := http.NewServeMux()
+	for _, feed := range []string{"/arm/", "/mips/"} {
+		feed := feed
+		mux.HandleFunc(feed, func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, feed) })
+	}
+	muxer := &ClientIdMuxer{IdRoot: idRoot, RootMuxer: mux}
+
+	email := func(address string) *x509.Certificate {
+		return testCertificate(t, pkix.Name{CommonName: "box-1", ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidE, Value: address}}})
+	}
+	for _, test := range []struct {
+		path string
+		cert *x509.Certificate
+		code int
+		body string
+	}{
+		{"/arm/Packages", email("ops@example.com"), http.StatusOK, "/arm/"},
+		{"/special/Packages", email("ops@example.com"), http.StatusOK, "/mips/"},
+		{"/arm/Packages", email("dev@example.com"), http.StatusForbidden, ""},
+		{"/arm/Packages", nil, http.StatusUnauthorized, ""},
+	} {
+		w := httptest.NewRecorder()
+		muxer.ServeHTTP(w, clientRequest(test.path, test.cert))
+		if w.Code != test.code || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("GET %s: got %d %q, expected %d %q", test.path, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+}
@@ -15,7 +15,9 @@ import (
 	"compress/gzip"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"hash"
 	"io"
@@ -27,6 +29,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/blakesmith/ar"
 )
@@ -38,6 +41,49 @@ type Ipkg struct {
 	FileInfo os.FileInfo
 	Md5      string
 	Sha1     string
+	Sha256   string
+
+	BuildDate time.Time // zero if unknown, see Built()
+	Relations Relations // parsed from the Header
+}
+
+// the layouts accepted in a "Build-Date" control-field
+var buildDateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 -0700", // debian "Date"
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// returns the build date given by the control-fields in 'header', either
+// "SourceDateEpoch" (unix seconds, written by the openwrt build system) or
+// "Build-Date". without those: 'archived' (the mtime of the 'control' file
+// in the package). returns the zero time if nothing sensible is known.
+func buildDateOf(header map[string]string, archived time.Time) time.Time {
+	if epoch, err := strconv.ParseInt(header["SourceDateEpoch"], 10, 64); err == nil && epoch > 0 {
+		return time.Unix(epoch, 0).UTC()
+	}
+	if value := header["Build-Date"]; value != "" {
+		for _, layout := range buildDateLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	if archived.Unix() > 0 {
+		return archived.UTC()
+	}
+	return time.Time{}
+}
+
+// returns when the package was built or, if that is unknown, the mtime
+// of the file
+func (ipkg *Ipkg) Built() time.Time {
+	if !ipkg.BuildDate.IsZero() {
+		return ipkg.BuildDate
+	}
+	return ipkg.FileInfo.ModTime()
 }
 
 // parses 'control' and stores the result in ipkg.Header
@@ -56,9 +102,48 @@ func (ipkg *Ipkg) ControlToHeader(control string) error {
 
 		ipkg.Header[line[:i]] = strings.TrimSpace(line[i+1:])
 	}
+	ipkg.Relations = relationsOf(ipkg.Header)
 	return nil
 }
 
+// removes 'fields' (and their continuation lines) from the 'control'
+// and from the parsed header. all other fields, even those unknown to
+// kellner (eg "Conffiles", "Source" or "Alternatives"), are kept as they are.
+func (ipkg *Ipkg) StripFields(fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	var (
+		stripped = bytes.NewBuffer(nil)
+		skip     bool
+	)
+	for _, line := range strings.SplitAfter(ipkg.Control, "\n") {
+		if line == "" {
+			continue
+		}
+		// continuation lines belong to the field before
+		if line[0] != ' ' && line[0] != '\t' {
+			skip = false
+			if i := strings.IndexByte(line, ':'); i != -1 {
+				name := line[:i]
+				for _, field := range fields {
+					if strings.EqualFold(name, field) {
+						skip = true
+						delete(ipkg.Header, name)
+						break
+					}
+				}
+			}
+		}
+		if !skip {
+			stripped.WriteString(line)
+		}
+	}
+	ipkg.Control = stripped.String()
+	ipkg.Relations = relationsOf(ipkg.Header)
+}
+
 func (ipkg *Ipkg) EnhanceHeader() {
 	ipkg.Header["Size"] = strconv.FormatInt(ipkg.FileInfo.Size(), 10)
 	if ipkg.Md5 != "" {
@@ -67,42 +152,78 @@ func (ipkg *Ipkg) EnhanceHeader() {
 	if ipkg.Sha1 != "" {
 		ipkg.Header["SHA1"] = ipkg.Sha1
 	}
+	if ipkg.Sha256 != "" {
+		ipkg.Header["SHA256sum"] = ipkg.Sha256
+	}
 }
 
 func (ipkg *Ipkg) DirEntry() DirEntry {
 
-	descr := ipkg.Header["Description"]
+	synopsis, extended := descriptionOf(ipkg.Control)
+	descr, raw_descr := synopsis, synopsis
 	if len(descr) > 64 {
 		descr = descr[:64] + "..."
 	}
+	if extended != "" {
+		raw_descr += "\n" + extended
+	}
 
 	return DirEntry{
-		Name:     ipkg.Name,
-		ModTime:  ipkg.FileInfo.ModTime(),
-		Size:     ipkg.FileInfo.Size(),
-		Descr:    descr,
-		RawDescr: ipkg.Header["Description"],
+		Name:          ipkg.Name,
+		ModTime:       ipkg.FileInfo.ModTime(),
+		Size:          ipkg.FileInfo.Size(),
+		InstalledSize: ipkg.InstalledSize(),
+		Built:         ipkg.Built(),
+		Arch:          ipkg.Header["Architecture"],
+		Descr:         descr,
+		RawDescr:      raw_descr,
 	}
 }
 
-// according to https://www.debian.org/doc/debian-policy/ch-controlfields.html
-// the order of the fields does not matter
-// according to https://wiki.debian.org/RepositoryFormat#A.22Packages.22_Indices
-// 'Packages' should be the first field.
-func (ipkg *Ipkg) HeaderTo(w io.Writer) {
-
-	p, ok := ipkg.Header["Package"]
-	if ok {
-		fmt.Fprintf(w, "Package: %s\n", p)
+// returns the "Installed-Size" of the control (as given, in bytes for
+// opkg, dpkg uses KiB), 0 if it is missing or no number
+func (ipkg *Ipkg) InstalledSize() int64 {
+	size, err := strconv.ParseInt(ipkg.Header["Installed-Size"], 10, 64)
+	if err != nil || size < 0 {
+		return 0
 	}
+	return size
+}
 
-	for key := range ipkg.Header {
-		if key != "Package" {
-			fmt.Fprintf(w, "%s: %s\n", key, ipkg.Header[key])
+// returns the synopsis (the first line) and the extended description of
+// the "Description" field of 'control', following the debian control
+// semantics: the continuation lines start with a space (which is removed,
+// lines starting with more spaces are verbatim), a line of " ." stands
+// for an empty line. the header ControlToHeader() parses has all lines
+// joined by a space instead.
+func descriptionOf(control string) (string, string) {
+	lines := strings.Split(control, "\n")
+	for i, line := range lines {
+		colon := strings.IndexByte(line, ':')
+		if colon == -1 || !strings.EqualFold(line[:colon], "Description") {
+			continue
 		}
+		extended := make([]string, 0)
+		for _, cont := range lines[i+1:] {
+			if cont == "" || (cont[0] != ' ' && cont[0] != '\t') {
+				break
+			}
+			cont = strings.TrimRight(cont[1:], " \t\r")
+			if cont == "." {
+				cont = ""
+			}
+			extended = append(extended, cont)
+		}
+		return strings.TrimSpace(line[colon+1:]), strings.Join(extended, "\n")
 	}
+	return "", ""
 }
 
+// writes the stanza of 'ipkg' for the Packages index: the 'control' as it
+// is (so every field survives, even those kellner does not care about, like
+// "Alternatives" for update-alternatives) followed by the fields kellner
+// computes. "Filename" is always the actual name of the file, a "Filename"
+// in the control is stripped while scanning.
 func (ipkg *Ipkg) ControlAndChecksumTo(w io.Writer) {
 	io.WriteString(w, ipkg.Control)
 	fmt.Fprintf(w, "Filename: %s\n", ipkg.Name)
@@ -113,6 +234,43 @@ func (ipkg *Ipkg) ControlAndChecksumTo(w io.Writer) {
 	if ipkg.Sha1 != "" {
 		fmt.Fprintf(w, "SHA1: %s\n", ipkg.Sha1)
 	}
+	if ipkg.Sha256 != "" {
+		fmt.Fprintf(w, "SHA256sum: %s\n", ipkg.Sha256)
+	}
+}
+
+// machine readable summary of an Ipkg, eg. for /index.json. the json
+// field names are relied upon by external tools, keep them stable.
+type IpkgInfo struct {
+	Name          string    `json:"name"` // filename of the .ipk
+	Package       string    `json:"package"`
+	Version       string    `json:"version"`
+	Architecture  string    `json:"architecture"`
+	Size          int64     `json:"size"`                     // of the .ipk
+	InstalledSize int64     `json:"installed_size,omitempty"` // "Installed-Size" of the control
+	ModTime       time.Time `json:"modtime"`
+	BuildDate     time.Time `json:"build_date"` // the mtime if unknown
+	Md5           string    `json:"md5,omitempty"`
+	Sha1          string    `json:"sha1,omitempty"`
+	Sha256        string    `json:"sha256,omitempty"`
+	Relations               // "depends", "provides", "conflicts", "replaces"
+}
+
+func (ipkg *Ipkg) Info() IpkgInfo {
+	return IpkgInfo{
+		Name:          ipkg.Name,
+		Package:       ipkg.Header["Package"],
+		Version:       ipkg.Header["Version"],
+		Architecture:  ipkg.Header["Architecture"],
+		Size:          ipkg.FileInfo.Size(),
+		InstalledSize: ipkg.InstalledSize(),
+		ModTime:       ipkg.FileInfo.ModTime(),
+		BuildDate:     ipkg.Built(),
+		Md5:           ipkg.Md5,
+		Sha1:          ipkg.Sha1,
+		Sha256:        ipkg.Sha256,
+		Relations:     ipkg.Relations,
+	}
 }
 
 type IpkgChan chan *Ipkg
@@ -120,8 +278,23 @@ type IpkgChan chan *Ipkg
 type PackageIndex struct {
 	sync.Mutex
 	Entries map[string]*Ipkg
+
+	sortedNames []string // cached result of SortedNames()
 }
 
+// adds 'ipkg' as 'name' to the index. use this instead of modifying
+// 'Entries' directly, it keeps the SortedNames() cache valid.
+func (pi *PackageIndex) Add(name string, ipkg *Ipkg) {
+	pi.Lock()
+	pi.Entries[name] = ipkg
+	pi.sortedNames = nil
+	pi.Unlock()
+}
+
+// writes the Packages index: the stanzas sorted by filename, each one
+// as ControlAndChecksumTo() writes it. the output only depends on the
+// packages, never on the order of the 'Entries' map, so the same feed
+// always gives the same bytes (and the same ETag).
 func (pi *PackageIndex) StringTo(w io.Writer) {
 	for _, name := range pi.SortedNames() {
 		entry := pi.Entries[name]
@@ -130,11 +303,58 @@ func (pi *PackageIndex) StringTo(w io.Writer) {
 	}
 }
 
+// writes the Packages.stamps of the index, one line per package, sorted
+// by name:
+//
+//	name<TAB>mtime<TAB>sha256
+//
+// 'mtime' is the modification time of the .ipk in seconds since the unix
+// epoch, 'sha256' is empty without -sha256. a client comparing it to the
+// previous copy cheaply learns which packages changed. see ParseStamps().
 func (pi *PackageIndex) StampsTo(w io.Writer) {
 	for _, name := range pi.SortedNames() {
 		entry := pi.Entries[name]
-		fmt.Fprintf(w, "%d %s\n", entry.FileInfo.ModTime().Unix(), name)
+		fmt.Fprintf(w, "%s\t%d\t%s\n", name, entry.FileInfo.ModTime().Unix(), entry.Sha256)
+	}
+}
+
+// a line of Packages.stamps
+type Stamp struct {
+	Name    string
+	ModTime time.Time
+	Sha256  string // "" if unknown
+}
+
+// parses a Packages.stamps as written by StampsTo()
+func ParseStamps(r io.Reader) ([]Stamp, error) {
+	var (
+		stamps  = make([]Stamp, 0)
+		scanner = bufio.NewScanner(r)
+		n       int
+	)
+	for scanner.Scan() {
+		n++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expected \"name<TAB>mtime<TAB>sha256\", got %q", n, scanner.Text())
+		}
+		mtime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid mtime %q", n, fields[1])
+		}
+		stamps = append(stamps, Stamp{fields[0], time.Unix(mtime, 0), fields[2]})
 	}
+	return stamps, scanner.Err()
+}
+
+// writes the IpkgInfo of all entries as a json-array, sorted by name
+func (pi *PackageIndex) JSONTo(w io.Writer) error {
+	names := pi.SortedNames()
+	infos := make([]IpkgInfo, len(names))
+	for i, name := range names {
+		infos[i] = pi.Entries[name].Info()
+	}
+	return json.NewEncoder(w).Encode(infos)
 }
 
 func (pi *PackageIndex) String() string {
@@ -143,75 +363,281 @@ func (pi *PackageIndex) String() string {
 	return buf.String()
 }
 
+// removes 'name' from the index
+func (pi *PackageIndex) Remove(name string) {
+	pi.Lock()
+	delete(pi.Entries, name)
+	pi.sortedNames = nil
+	pi.Unlock()
+}
+
+// an entry removed by RemoveCollisions() in favour of another one
+type Collision struct {
+	Kept    string
+	Removed string
+}
+
+// removes entries declaring the same Package, Version and Architecture
+// as another one, opkg fails on duplicate stanzas. of each such group the
+// entry with the newest mtime (on a tie: the first by name) is kept.
+func (pi *PackageIndex) RemoveCollisions() []Collision {
+	kept := make(map[string]*Ipkg)
+	collisions := make([]Collision, 0)
+	for _, name := range pi.SortedNames() {
+		ipkg := pi.Entries[name]
+		key := ipkg.Header["Package"] + " " + ipkg.Header["Version"] + " " + ipkg.Header["Architecture"]
+		other, ok := kept[key]
+		if !ok {
+			kept[key] = ipkg
+			continue
+		}
+		if ipkg.FileInfo.ModTime().After(other.FileInfo.ModTime()) {
+			kept[key] = ipkg
+			other, ipkg = ipkg, other
+		}
+		collisions = append(collisions, Collision{Kept: other.Name, Removed: ipkg.Name})
+	}
+
+	for _, collision := range collisions {
+		pi.Remove(collision.Removed)
+	}
+	return collisions
+}
+
+// keeps only the 'n' newest versions (according to CompareVersions()) of
+// each package and removes the older ones from the index. packages are
+// grouped by their name and architecture. returns the names of the
+// removed entries.
+func (pi *PackageIndex) KeepNewest(n int) []string {
+	groups := make(map[string][]*Ipkg)
+	for _, name := range pi.SortedNames() {
+		ipkg := pi.Entries[name]
+		key := ipkg.Header["Package"] + " " + ipkg.Header["Architecture"]
+		groups[key] = append(groups[key], ipkg)
+	}
+
+	removed := make([]string, 0)
+	for _, group := range groups {
+		if len(group) <= n {
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			return CompareVersions(group[i].Header["Version"], group[j].Header["Version"]) > 0
+		})
+		for _, ipkg := range group[n:] {
+			removed = append(removed, ipkg.Name)
+		}
+	}
+
+	for _, name := range removed {
+		pi.Remove(name)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// returns the newest modification time of all entries, the zero time
+// for an empty index.
+func (pi *PackageIndex) NewestModTime() time.Time {
+	var newest time.Time
+	for _, name := range pi.SortedNames() {
+		if mtime := pi.Entries[name].FileInfo.ModTime(); mtime.After(newest) {
+			newest = mtime
+		}
+	}
+	return newest
+}
+
+// partitions the entries by their "Architecture" field. entries without
+// one are left out.
+func (pi *PackageIndex) ByArchitecture() map[string]*PackageIndex {
+	archs := make(map[string]*PackageIndex)
+	for _, name := range pi.SortedNames() {
+		ipkg := pi.Entries[name]
+		arch := ipkg.Header["Architecture"]
+		if arch == "" {
+			continue
+		}
+		if archs[arch] == nil {
+			archs[arch] = &PackageIndex{Entries: make(map[string]*Ipkg)}
+		}
+		archs[arch].Add(name, ipkg)
+	}
+	return archs
+}
+
+// returns the number of entries in 'pi' which are not present in 'prev'
+// (added) and the number of entries in 'prev' which are gone in 'pi'
+// (removed). a nil 'prev' is treated as an empty index.
+func (pi *PackageIndex) Delta(prev *PackageIndex) (added, removed int) {
+	if prev == nil {
+		return len(pi.Entries), 0
+	}
+	for name := range pi.Entries {
+		if _, ok := prev.Entries[name]; !ok {
+			added++
+		}
+	}
+	for name := range prev.Entries {
+		if _, ok := pi.Entries[name]; !ok {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// returns the names of all entries, sorted. the result is cached until the
+// next Add(), so callers must not modify the returned slice.
 func (pi *PackageIndex) SortedNames() []string {
-	var (
-		names = make([]string, len(pi.Entries))
-		i     int
-	)
+	pi.Lock()
+	defer pi.Unlock()
+	if pi.sortedNames != nil {
+		return pi.sortedNames
+	}
+
+	names := make([]string, 0, len(pi.Entries))
 	for name := range pi.Entries {
-		names[i] = name
-		i++
+		names = append(names, name)
 	}
 	sort.Strings(names)
+	pi.sortedNames = names
 	return names
 }
 
 // extract 'control' file from 'reader'. the contents of a 'control' file
 // is a set of key-value pairs as described in
 // https://www.debian.org/doc/debian-policy/ch-controlfields.html
-func ExtractControlFromIpk(reader io.Reader) (string, error) {
+//
+// the whole archive is read and checked: it must be an ar-archive
+// starting with 'debian-binary', containing 'control.tar.gz' and a
+// 'data.tar.*', none of the members may be truncated. also returns the
+// mtime of the 'control' file inside of 'control.tar.gz'.
+func ExtractControlFromIpk(reader io.Reader) (string, time.Time, error) {
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != "!<arch>\n" {
+		return "", time.Time{}, fmt.Errorf("not an ar-archive")
+	}
 
 	var (
-		ar_reader  *ar.Reader
-		tar_reader *tar.Reader
-		gz_reader  *gzip.Reader
+		ar_reader = ar.NewReader(io.MultiReader(bytes.NewReader(magic), reader))
+		control   string
+		modtime   time.Time
+		members   = make([]string, 0, 3)
+		has_data  bool
 	)
-
-	ar_reader = ar.NewReader(reader)
 	for {
 		header, err := ar_reader.Next()
-		if err != nil && err != io.EOF {
-			return "", fmt.Errorf("extracting contents: %v", err)
-		} else if header == nil {
+		if err == io.EOF {
 			break
+		} else if err == io.ErrUnexpectedEOF {
+			return "", time.Time{}, fmt.Errorf("truncated ar-header after %q", members)
+		} else if err != nil {
+			return "", time.Time{}, fmt.Errorf("extracting contents: %v", err)
 		}
 
 		// NOTE: strangeley the name of the files end with a "/" ... content error?
-		if header.Name == "control.tar.gz/" || header.Name == "control.tar.gz" {
-			gz_reader, err = gzip.NewReader(ar_reader)
-			break
+		name := strings.TrimSuffix(header.Name, "/")
+		members = append(members, name)
+
+		// the members are streamed, only the small bits needed are kept:
+		// memory use does not depend on the size of the package.
+		var (
+			member  = &countingReader{r: ar_reader}
+			err_mem error
+		)
+		switch {
+		case len(members) == 1:
+			if name != "debian-binary" {
+				return "", time.Time{}, fmt.Errorf("first member is %q, expected 'debian-binary'", name)
+			}
+			content, _ := ioutil.ReadAll(io.LimitReader(member, 16))
+			if !bytes.HasPrefix(content, []byte("2.")) {
+				err_mem = fmt.Errorf("unsupported 'debian-binary' %q", content)
+			}
+		case name == "control.tar.gz":
+			control, modtime, err_mem = extractControlFromTarGz(member)
+		default:
+			has_data = has_data || strings.HasPrefix(name, "data.tar.")
+		}
+		io.Copy(ioutil.Discard, member)
+
+		// a truncated member explains any other error
+		if member.n != header.Size {
+			return "", time.Time{}, fmt.Errorf("truncated %q (%d of %d bytes)", name, member.n, header.Size)
+		} else if err_mem != nil {
+			return "", time.Time{}, err_mem
 		}
 	}
 
-	if gz_reader == nil {
-		return "", fmt.Errorf("missing control.tar.gz file")
+	if len(members) == 0 {
+		return "", time.Time{}, fmt.Errorf("empty ar-archive")
+	} else if control == "" {
+		return "", time.Time{}, fmt.Errorf("missing control.tar.gz file")
+	} else if !has_data {
+		return "", time.Time{}, fmt.Errorf("missing data.tar.* file")
+	}
+	return control, modtime, nil
+}
+
+// counts the bytes read from 'r'
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// the size limit of the 'control' file
+const maxControlSize = 1 << 20
+
+// returns the content and the mtime of the 'control' file in the
+// 'control.tar.gz' read from 'reader'
+func extractControlFromTarGz(reader io.Reader) (string, time.Time, error) {
+
+	gz_reader, err := gzip.NewReader(reader)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("extracting control.tar.gz: %v", err)
 	}
 	defer gz_reader.Close()
 
-	buffer := bytes.NewBuffer(nil)
-	tar_reader = tar.NewReader(gz_reader)
+	var (
+		buffer  = bytes.NewBuffer(nil)
+		modtime time.Time
+	)
+	tar_reader := tar.NewReader(gz_reader)
 	for {
 		header, err := tar_reader.Next()
-		if err != nil && err != io.EOF {
-			return "", fmt.Errorf("extracting control.tar.gz: %v", err)
-		} else if header == nil {
+		if err == io.EOF {
 			break
+		} else if err != nil {
+			return "", time.Time{}, fmt.Errorf("extracting control.tar.gz: %v", err)
 		}
-		if header.Name != "./control" {
+		if header.Name != "./control" && header.Name != "control" {
 			continue
 		}
 
-		io.Copy(buffer, tar_reader)
+		modtime = header.ModTime
+		if header.Size > maxControlSize {
+			return "", time.Time{}, fmt.Errorf("'control' inside 'control.tar.gz' exceeds %d bytes", maxControlSize)
+		}
+		if _, err = io.Copy(buffer, tar_reader); err != nil {
+			return "", time.Time{}, fmt.Errorf("extracting 'control' from control.tar.gz: %v", err)
+		}
 		break
 	}
 
 	if buffer.Len() == 0 {
-		return "", fmt.Errorf("missing or empty 'control' file inside 'control.tar.gz'")
+		return "", time.Time{}, fmt.Errorf("missing or empty 'control' file inside 'control.tar.gz'")
 	}
-	return buffer.String(), nil
+	return buffer.String(), modtime, nil
 }
 
-func NewIpkgFromFile(name, root string, do_md5, do_sha1 bool) (*Ipkg, error) {
+func NewIpkgFromFile(name, root string, do_md5, do_sha1, do_sha256 bool) (*Ipkg, error) {
 
 	var (
 		full_name = path.Join(root, name)
@@ -220,6 +646,7 @@ func NewIpkgFromFile(name, root string, do_md5, do_sha1 bool) (*Ipkg, error) {
 		err       error
 		md5er     hash.Hash
 		sha1er    hash.Hash
+		sha256er  hash.Hash
 	)
 
 	file, err = os.Open(full_name)
@@ -228,7 +655,6 @@ func NewIpkgFromFile(name, root string, do_md5, do_sha1 bool) (*Ipkg, error) {
 	}
 	defer file.Close()
 
-	writer = append(writer, ioutil.Discard)
 	if do_md5 {
 		md5er = md5.New()
 		writer = append(writer, md5er)
@@ -237,10 +663,14 @@ func NewIpkgFromFile(name, root string, do_md5, do_sha1 bool) (*Ipkg, error) {
 		sha1er = sha1.New()
 		writer = append(writer, sha1er)
 	}
+	if do_sha256 {
+		sha256er = sha256.New()
+		writer = append(writer, sha256er)
+	}
 
 	tee := io.TeeReader(file, io.MultiWriter(writer...))
 
-	control, err := ExtractControlFromIpk(tee)
+	control, archived, err := ExtractControlFromIpk(tee)
 	if err != nil {
 		return nil, fmt.Errorf("error: extract pkg-info from %q: %v", full_name, err)
 	}
@@ -250,18 +680,76 @@ func NewIpkgFromFile(name, root string, do_md5, do_sha1 bool) (*Ipkg, error) {
 	if err := ipkg.ControlToHeader(control); err != nil {
 		return nil, fmt.Errorf("error: header parse error in %q: %v", full_name, err)
 	}
+	for _, field := range []string{"Package", "Version", "Architecture"} {
+		if ipkg.Header[field] == "" {
+			return nil, fmt.Errorf("error: missing %q field in the control of %q", field, full_name)
+		}
+	}
+	ipkg.BuildDate = buildDateOf(ipkg.Header, archived)
 
-	// consume the rest of the file to calculate md5/sha1
-	io.Copy(ioutil.Discard, tee)
+	// consume the rest of the file to calculate md5/sha1/sha256. the
+	// hashers are fed in chunks, the file is never held in memory.
+	if _, err = io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, fmt.Errorf("error: reading %q: %v", full_name, err)
+	}
 	file.Close() // close to free handles, 'collector' might block freeing otherwise
 
-	ipkg.FileInfo, _ = os.Lstat(full_name)
+	// a symlinked package is described by its target
+	if ipkg.FileInfo, err = os.Stat(full_name); err != nil {
+		return nil, fmt.Errorf("error: %v", err)
+	}
 	if md5er != nil {
 		ipkg.Md5 = hex.EncodeToString(md5er.Sum(nil))
 	}
 	if sha1er != nil {
 		ipkg.Sha1 = hex.EncodeToString(sha1er.Sum(nil))
 	}
+	if sha256er != nil {
+		ipkg.Sha256 = hex.EncodeToString(sha256er.Sum(nil))
+	}
 
 	return ipkg, nil
 }
+
+// re-reads the package from 'dir' and compares its checksums (those
+// calculated when it was scanned) and its size against the file on disk.
+func (ipkg *Ipkg) Verify(dir string) error {
+	if ipkg.Md5 == "" && ipkg.Sha1 == "" && ipkg.Sha256 == "" {
+		return fmt.Errorf("no checksum to verify against")
+	}
+
+	file, err := os.Open(path.Join(dir, ipkg.Name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		md5er    = md5.New()
+		sha1er   = sha1.New()
+		sha256er = sha256.New()
+	)
+	n, err := io.Copy(io.MultiWriter(md5er, sha1er, sha256er), file)
+	if err != nil {
+		return err
+	}
+	if ipkg.FileInfo != nil && n != ipkg.FileInfo.Size() {
+		return fmt.Errorf("size changed from %d to %d bytes", ipkg.FileInfo.Size(), n)
+	}
+	for _, sum := range []struct {
+		name, expected string
+		hasher         hash.Hash
+	}{
+		{"md5", ipkg.Md5, md5er},
+		{"sha1", ipkg.Sha1, sha1er},
+		{"sha256", ipkg.Sha256, sha256er},
+	} {
+		if sum.expected == "" {
+			continue
+		}
+		if actual := hex.EncodeToString(sum.hasher.Sum(nil)); actual != sum.expected {
+			return fmt.Errorf("%s mismatch: indexed %s, on disk %s", sum.name, sum.expected, actual)
+		}
+	}
+	return nil
+}
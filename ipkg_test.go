@@ -0,0 +1,731 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blakesmith/ar"
+)
+
+// the time the members of a test package were archived
+var testIpkTime = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// a member of the ar-archive of a test package
+type ipkMember struct {
+	name string
+	data []byte
+}
+
+// a .tar.gz containing the file 'name' (empty: no file at all)
+func tarGz(t testing.TB, name, content string) []byte {
+	t.Helper()
+	var (
+		buf = bytes.NewBuffer(nil)
+		gz  = gzip.NewWriter(buf)
+		tw  = tar.NewWriter(gz)
+	)
+	if name != "" {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: testIpkTime}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// an ar-archive of 'members', in order
+func ipkArchive(t testing.TB, members ...ipkMember) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	aw := ar.NewWriter(buf)
+	if err := aw.WriteGlobalHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range members {
+		header := &ar.Header{Name: member.name, ModTime: testIpkTime, Mode: 0644, Size: int64(len(member.data))}
+		if err := aw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := aw.Write(member.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// the members of a well-formed package with the 'control' file given
+func ipkMembers(t testing.TB, control string) []ipkMember {
+	return []ipkMember{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", tarGz(t, "./control", control)},
+		{"data.tar.gz", tarGz(t, "./usr/share/hello", "hello\n")},
+	}
+}
+
+// writes a well-formed package 'name' into 'dir'
+func writeIpk(t testing.TB, dir, name, control string) string {
+	t.Helper()
+	fileName := filepath.Join(dir, name)
+	if err := os.WriteFile(fileName, ipkArchive(t, ipkMembers(t, control)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// a minimal 'control' file
+func testControl(name, version, arch string) string {
+	return "Package: " + name + "\nVersion: " + version + "\nArchitecture: " + arch + "\nDescription: the " + name + " package\n"
+}
+
+func TestBuildDateOf(t *testing.T) {
+	archived := testIpkTime
+	for _, test := range []struct {
+		header   map[string]string
+		archived time.Time
+		expected time.Time
+	}{
+		{map[string]string{}, archived, archived},
+		{map[string]string{}, time.Unix(0, 0), time.Time{}},
+		{map[string]string{"SourceDateEpoch": "1600000000"}, archived, time.Unix(1600000000, 0)},
+		{map[string]string{"SourceDateEpoch": "1600000000", "Build-Date": "2020-01-01"}, archived, time.Unix(1600000000, 0)},
+		{map[string]string{"SourceDateEpoch": "soon"}, archived, archived},
+		{map[string]string{"Build-Date": "2020-01-02T03:04:05+02:00"}, archived, time.Date(2020, 1, 2, 1, 4, 5, 0, time.UTC)},
+		{map[string]string{"Build-Date": "Thu, 2 Jan 2020 03:04:05 +0000"}, archived, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{map[string]string{"Build-Date": "2020-01-02 03:04:05"}, archived, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{map[string]string{"Build-Date": "2020-01-02"}, archived, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{map[string]string{"Build-Date": "last tuesday"}, archived, archived},
+	} {
+		if got := buildDateOf(test.header, test.archived); !got.Equal(test.expected) {
+			t.Errorf("buildDateOf(%v, %v): got %v, expected %v", test.header, test.archived, got, test.expected)
+		}
+	}
+}
+
+// the build date surfaces in index.json and, with -build-date, in the
+// Packages index
+func TestBuildDate(t *testing.T) {
+	dir := t.TempDir()
+	writeIpk(t, dir, "dated_1.0_arm.ipk", testControl("dated", "1.0", "arm")+"Build-Date: 2020-01-02\n")
+	writeIpk(t, dir, "plain_1.0_arm.ipk", testControl("plain", "1.0", "arm"))
+	packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1), BuildDate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := bytes.NewBuffer(nil)
+	packages.StringTo(index)
+	for _, field := range []string{"Build-Date: 2020-01-02\n", "Build-Date: 2015-06-01T12:00:00Z\n"} {
+		if n := strings.Count(index.String(), field); n != 1 {
+			t.Errorf("Packages: got %q %d times, expected once:\n%s", field, n, index)
+		}
+	}
+
+	infos := bytes.NewBuffer(nil)
+	if err := packages.JSONTo(infos); err != nil {
+		t.Fatal(err)
+	}
+	var entries []struct {
+		Package   string    `json:"package"`
+		BuildDate time.Time `json:"build_date"`
+	}
+	if err := json.Unmarshal(infos.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]time.Time{"dated": time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "plain": testIpkTime}
+	for _, entry := range entries {
+		if !entry.BuildDate.Equal(expected[entry.Package]) {
+			t.Errorf("index.json: got the build date %v of %q, expected %v", entry.BuildDate, entry.Package, expected[entry.Package])
+		}
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("index.json: got %d entries, expected %d", len(entries), len(expected))
+	}
+
+	feed := testFeed(dir, "/arm")
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if listing := string(getBody(t, feed, "/arm/")); !strings.Contains(listing, "2020-01-02T00:00:00Z") {
+		t.Errorf("GET /arm/: the build date is not listed")
+	}
+}
+
+// an endless stream of zeros
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// the memory used to scan a package does not depend on its size
+func TestNewIpkgFromFileBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a large package")
+	}
+	const dataSize = 64 << 20
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "big_1.0_arm.ipk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw := ar.NewWriter(file)
+	aw.WriteGlobalHeader()
+	for _, member := range ipkMembers(t, testControl("big", "1.0", "arm"))[:2] {
+		aw.WriteHeader(&ar.Header{Name: member.name, ModTime: testIpkTime, Mode: 0644, Size: int64(len(member.data))})
+		aw.Write(member.data)
+	}
+	// the content of data.tar.gz is not looked at
+	aw.WriteHeader(&ar.Header{Name: "data.tar.gz", ModTime: testIpkTime, Mode: 0644, Size: dataSize})
+	if _, err := io.CopyN(aw, zeros{}, dataSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	ipkg, err := NewIpkgFromFile("big_1.0_arm.ipk", dir, true, true, true)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipkg.Sha256 == "" || ipkg.Header["Package"] != "big" {
+		t.Errorf("got %q with the sha256 %q", ipkg.Header["Package"], ipkg.Sha256)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4<<20 {
+		t.Errorf("scanning a package of %d MiB allocated %d KiB", dataSize>>20, allocated>>10)
+	}
+}
+
+func TestDescriptionOf(t *testing.T) {
+	for _, test := range []struct {
+		control            string
+		synopsis, extended string
+	}{
+		{"Package: foo\n", "", ""},
+		{"Package: foo\nDescription: a tool\n", "a tool", ""},
+		{"Package: foo\ndescription:   a tool  \nVersion: 1.0\n", "a tool", ""},
+		{"Description: a tool\n does things.\n More things.\nVersion: 1.0\n", "a tool", "does things.\nMore things."},
+		// paragraphs, verbatim lines, tabs
+		{"Description: a tool\n first paragraph.\n .\n second paragraph:\n   indented verbatim\n\tby tab\nMaintainer: x\n",
+			"a tool", "first paragraph.\n\nsecond paragraph:\n  indented verbatim\nby tab"},
+		// trailing spaces and \r are dropped, a later field is not part of it
+		{"Description: a tool\r\n line \r\nX-Description: other\n", "a tool", "line"},
+		// the control ends within the description
+		{"Description: a tool\n last", "a tool", "last"},
+	} {
+		synopsis, extended := descriptionOf(test.control)
+		if synopsis != test.synopsis || extended != test.extended {
+			t.Errorf("descriptionOf(%q): got %q %q, expected %q %q", test.control, synopsis, extended, test.synopsis, test.extended)
+		}
+	}
+}
+
+func TestDirEntryDescription(t *testing.T) {
+	synopsis := strings.Repeat("long ", 20)
+	control := "Package: foo\nVersion: 1.0\nArchitecture: arm\nDescription: " + synopsis + "\n first.\n .\n second.\n"
+	dir := t.TempDir()
+	writeIpk(t, dir, "foo_1.0_arm.ipk", control)
+	ipkg, err := NewIpkgFromFile("foo_1.0_arm.ipk", dir, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := ipkg.DirEntry()
+	if expected := strings.TrimSpace(synopsis)[:64] + "..."; entry.Descr != expected {
+		t.Errorf("Descr: got %q, expected %q", entry.Descr, expected)
+	}
+	if expected := strings.TrimSpace(synopsis) + "\nfirst.\n\nsecond."; entry.RawDescr != expected {
+		t.Errorf("RawDescr: got %q, expected %q", entry.RawDescr, expected)
+	}
+}
+
+func TestParseStamps(t *testing.T) {
+	for _, test := range []struct {
+		content  string
+		expected []Stamp // nil: an error
+	}{
+		{"", []Stamp{}},
+		{"foo_1.0_arm.ipk\t1600000000\tabc\n", []Stamp{{"foo_1.0_arm.ipk", time.Unix(1600000000, 0), "abc"}}},
+		{"a.ipk\t1\t\nb.ipk\t-1\t\n", []Stamp{{"a.ipk", time.Unix(1, 0), ""}, {"b.ipk", time.Unix(-1, 0), ""}}},
+		// the last line may lack its newline
+		{"a.ipk\t1\tabc", []Stamp{{"a.ipk", time.Unix(1, 0), "abc"}}},
+		{"a.ipk\t1\n", nil},
+		{"a.ipk 1 abc\n", nil},
+		{"a.ipk\t1\tabc\textra\n", nil},
+		{"\t1\tabc\n", nil},
+		{"a.ipk\tyesterday\tabc\n", nil},
+		{"a.ipk\t1\tabc\n\n", nil},
+	} {
+		stamps, err := ParseStamps(strings.NewReader(test.content))
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("ParseStamps(%q): expected an error, got %v", test.content, stamps)
+			}
+			continue
+		}
+		if err != nil || len(stamps) != len(test.expected) {
+			t.Errorf("ParseStamps(%q): got %v %v, expected %v", test.content, stamps, err, test.expected)
+			continue
+		}
+		for i := range stamps {
+			if stamps[i].Name != test.expected[i].Name || !stamps[i].ModTime.Equal(test.expected[i].ModTime) || stamps[i].Sha256 != test.expected[i].Sha256 {
+				t.Errorf("ParseStamps(%q): got %v, expected %v", test.content, stamps, test.expected)
+				break
+			}
+		}
+	}
+}
+
+// ParseStamps() reads back what StampsTo() writes, the feed writes it
+// anew on every Build()
+func TestStampsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	mtimes := map[string]time.Time{
+		"foo_1.0_arm.ipk": time.Unix(1600000000, 0),
+		"bar_2.0_arm.ipk": time.Unix(1500000000, 0),
+	}
+	for name, mtime := range mtimes {
+		writeIpk(t, dir, name, testControl(strings.Split(name, "_")[0], "1.0", "arm"))
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1), Sha256: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	packages.StampsTo(buf)
+	stamps, err := ParseStamps(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stamps) != 2 || stamps[0].Name != "bar_2.0_arm.ipk" || stamps[1].Name != "foo_1.0_arm.ipk" {
+		t.Fatalf("got %v, expected bar and foo in order", stamps)
+	}
+	for _, stamp := range stamps {
+		if !stamp.ModTime.Equal(mtimes[stamp.Name]) {
+			t.Errorf("%s: got the mtime %v, expected %v", stamp.Name, stamp.ModTime, mtimes[stamp.Name])
+		}
+		if expected := packages.Entries[stamp.Name].Sha256; stamp.Sha256 != expected || len(expected) != 64 {
+			t.Errorf("%s: got the sha256 %q, expected %q", stamp.Name, stamp.Sha256, expected)
+		}
+	}
+
+	feed := testFeed(dir, "/arm")
+	feed.DefaultFormats = IndexFormats{FormatPackagesStamps: true}
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	writeIpk(t, dir, "baz_1.0_arm.ipk", testControl("baz", "1.0", "arm"))
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	stamps, err = ParseStamps(bytes.NewReader(getBody(t, feed, "/arm/Packages.stamps")))
+	if err != nil || len(stamps) != 3 || stamps[1].Name != "baz_1.0_arm.ipk" {
+		t.Errorf("GET /arm/Packages.stamps after a rebuild: got %v %v", stamps, err)
+	}
+}
+
+// a symlinked package is described by its target, not by the link
+func TestNewIpkgFromFileSymlink(t *testing.T) {
+	dir, pool := t.TempDir(), t.TempDir()
+	target := writeIpk(t, pool, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	if err := os.Symlink(target, filepath.Join(dir, "foo_1.0_arm.ipk")); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := packages.Entries["foo_1.0_arm.ipk"]
+	if entry == nil {
+		t.Fatalf("the symlinked package is not indexed: %v", packages.Entries)
+	}
+	if entry.FileInfo.Size() != fi.Size() || !entry.FileInfo.ModTime().Equal(fi.ModTime()) {
+		t.Errorf("got the size %d and mtime %v, expected %d and %v", entry.FileInfo.Size(), entry.FileInfo.ModTime(), fi.Size(), fi.ModTime())
+	}
+	if field := "Size: " + strconv.FormatInt(fi.Size(), 10) + "\n"; !strings.Contains(packages.String(), field) {
+		t.Errorf("Packages: %q is missing:\n%s", field, packages)
+	}
+}
+
+// of several packages with the same name, version and arch the newest is
+// indexed
+func TestRemoveCollisions(t *testing.T) {
+	dir := t.TempDir()
+	old, newer := time.Unix(1500000000, 0), time.Unix(1600000000, 0)
+	for _, file := range []struct {
+		name, version string
+		mtime         time.Time
+	}{
+		{"a.ipk", "1.0", old},
+		{"b.ipk", "1.0", newer},
+		{"c.ipk", "1.0", old},
+		{"d.ipk", "2.0", old},
+		// a tie: the first by name
+		{"e.ipk", "3.0", old},
+		{"f.ipk", "3.0", old},
+	} {
+		writeIpk(t, dir, file.name, testControl("foo", file.version, "arm"))
+		if err := os.Chtimes(filepath.Join(dir, file.name), file.mtime, file.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logged := captureLog(t)
+
+	packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, expected := packages.SortedNames(), []string{"b.ipk", "d.ipk", "e.ipk"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %q, expected %q", names, expected)
+	}
+	if n := strings.Count(packages.String(), "Package: foo\nVersion: 1.0\n"); n != 1 {
+		t.Errorf("Packages: got foo 1.0 %d times, expected once", n)
+	}
+	for _, warning := range []string{`"b.ipk" and "a.ipk"`, `"b.ipk" and "c.ipk"`, `"e.ipk" and "f.ipk"`} {
+		if !strings.Contains(logged.String(), warning) {
+			t.Errorf("no warning naming %s:\n%s", warning, logged)
+		}
+	}
+}
+
+func TestInstalledSize(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected int64
+	}{
+		{"", 0},
+		{"12345", 12345},
+		{"12 KiB", 0},
+		{"-1", 0},
+	} {
+		ipkg := &Ipkg{Header: map[string]string{}}
+		if test.value != "" {
+			ipkg.Header["Installed-Size"] = test.value
+		}
+		if got := ipkg.InstalledSize(); got != test.expected {
+			t.Errorf("InstalledSize(%q): got %d, expected %d", test.value, got, test.expected)
+		}
+	}
+}
+
+// the Size of the index is that of the .ipk, a Size of the control is
+// replaced, the Installed-Size is kept
+func TestSizeAndInstalledSize(t *testing.T) {
+	dir := t.TempDir()
+	fileName := writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm")+"Installed-Size: 12345\nSize: 1\n")
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := testFeed(dir, "/arm")
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	index := string(getBody(t, feed, "/arm/Packages"))
+	if n := strings.Count(index, "\nSize: "); n != 1 || !strings.Contains(index, "\nSize: "+strconv.FormatInt(fi.Size(), 10)+"\n") {
+		t.Errorf("Packages: expected a single Size of %d:\n%s", fi.Size(), index)
+	}
+	if !strings.Contains(index, "\nInstalled-Size: 12345\n") {
+		t.Errorf("Packages: the Installed-Size is missing:\n%s", index)
+	}
+
+	var infos []IpkgInfo
+	if err := json.Unmarshal(getBody(t, feed, "/arm/index.json"), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Size != fi.Size() || infos[0].InstalledSize != 12345 {
+		t.Errorf("index.json: got %+v, expected the size %d and installed size 12345", infos, fi.Size())
+	}
+
+	listing := string(getBody(t, feed, "/arm/"))
+	for _, cell := range []string{
+		`<td class="col-size">` + strconv.FormatInt(fi.Size(), 10) + `</td>`,
+		`<td class="col-size col-installed-size">12345</td>`,
+	} {
+		if !strings.Contains(listing, cell) {
+			t.Errorf("GET /arm/: %s is missing", cell)
+		}
+	}
+}
+
+func TestPackagesReproducible(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"zlib_1.2_arm.ipk", "busybox_1.36_arm.ipk", "base-files_1.0_arm.ipk", "opkg_0.4_arm.ipk", "dropbear_2022_arm.ipk"}
+	for _, name := range names {
+		writeIpk(t, dir, name, testControl(strings.Split(name, "_")[0], "1.0", "arm")+"Depends: libc\nSection: base\n")
+	}
+
+	var first []byte
+	for i := 0; i < 5; i++ {
+		packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(4), Md5: true, Sha256: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := bytes.NewBuffer(nil)
+		packages.StringTo(index)
+		if first == nil {
+			first = index.Bytes()
+			continue
+		}
+		if !bytes.Equal(index.Bytes(), first) {
+			t.Fatalf("scan %d: got\n%s\nexpected\n%s", i+1, index, first)
+		}
+	}
+
+	var filenames []string
+	for _, line := range strings.Split(string(first), "\n") {
+		if strings.HasPrefix(line, "Filename: ") {
+			filenames = append(filenames, strings.TrimPrefix(line, "Filename: "))
+		}
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(filenames, names) {
+		t.Errorf("got the stanzas %q, expected %q", filenames, names)
+	}
+
+	// and so the same ETag, after every rebuild
+	feed := testFeed(dir, "/arm")
+	etags := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		if err := feed.Build(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		feed.ServeHTTP(w, httptest.NewRequest("GET", "/arm/Packages", nil))
+		etags[w.Header().Get("ETag")] = true
+	}
+	if len(etags) != 1 || etags[""] {
+		t.Errorf("GET /arm/Packages: got the ETags %v, expected a single one", etags)
+	}
+}
+
+// -keep: only the newest versions of each package and arch are indexed
+func TestKeepNewest(t *testing.T) {
+	dir := t.TempDir()
+	for _, pkg := range []struct{ name, version, arch string }{
+		{"foo", "1.0", "arm"},
+		{"foo", "1.9", "arm"},
+		{"foo", "1.10", "arm"},
+		{"foo", "2.0~rc1", "arm"},
+		{"foo", "1.0", "mips"},
+		{"bar", "1", "arm"},
+	} {
+		writeIpk(t, dir, pkg.name+"_"+pkg.version+"_"+pkg.arch+".ipk", testControl(pkg.name, pkg.version, pkg.arch))
+	}
+
+	packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1), Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"bar_1_arm.ipk", "foo_1.0_mips.ipk", "foo_1.10_arm.ipk", "foo_2.0~rc1_arm.ipk"}
+	if names := packages.SortedNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("-keep 2: got %q, expected %q", names, expected)
+	}
+}
+
+func TestExtractControlFromIpk(t *testing.T) {
+	control := testControl("foo", "1.0", "arm")
+	valid := ipkMembers(t, control)
+	for _, test := range []struct {
+		name     string
+		archive  []byte
+		expected string // a part of the error, "": none
+	}{
+		{"valid", ipkArchive(t, valid...), ""},
+		{"data.tar.xz", ipkArchive(t, valid[0], valid[1], ipkMember{"data.tar.xz", []byte("xz")}), ""},
+		{"extra member", ipkArchive(t, append(valid, ipkMember{"extra", []byte("1")})...), ""},
+		{"empty file", nil, "not an ar-archive"},
+		{"tar.gz", tarGz(t, "./control", control), "not an ar-archive"},
+		{"no members", ipkArchive(t), "empty ar-archive"},
+		{"control first", ipkArchive(t, valid[1], valid[0], valid[2]), "first member is \"control.tar.gz\""},
+		{"debian-binary 3", ipkArchive(t, ipkMember{"debian-binary", []byte("3.0\n")}, valid[1], valid[2]), "unsupported 'debian-binary'"},
+		{"no control.tar.gz", ipkArchive(t, valid[0], valid[2]), "missing control.tar.gz"},
+		{"no data.tar", ipkArchive(t, valid[0], valid[1]), "missing data.tar"},
+		{"no control", ipkArchive(t, valid[0], ipkMember{"control.tar.gz", tarGz(t, "./postinst", "#!/bin/sh\n")}, valid[2]), "missing or empty 'control'"},
+		{"empty control", ipkArchive(t, valid[0], ipkMember{"control.tar.gz", tarGz(t, "./control", "")}, valid[2]), "missing or empty 'control'"},
+		{"control.tar.gz not gzip'ed", ipkArchive(t, valid[0], ipkMember{"control.tar.gz", []byte("plain")}, valid[2]), "extracting control.tar.gz"},
+		{"garbage after the magic", append([]byte("!<arch>\n"), bytes.Repeat([]byte{'x'}, 100)...), "expected 'debian-binary'"},
+	} {
+		got, modtime, err := ExtractControlFromIpk(bytes.NewReader(test.archive))
+		if test.expected != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("%s: got %v, expected an error %q", test.name, err, test.expected)
+			}
+			continue
+		}
+		if err != nil || got != control || !modtime.Equal(testIpkTime) {
+			t.Errorf("%s: got %q %v %v, expected %q %v", test.name, got, modtime, err, control, testIpkTime)
+		}
+	}
+}
+
+// a package cut off anywhere is rejected, with the member it was cut in
+func TestExtractControlFromIpkTruncated(t *testing.T) {
+	archive := ipkArchive(t, ipkMembers(t, testControl("foo", "1.0", "arm"))...)
+	cuts := map[string]bool{}
+	for n := 0; n < len(archive); n++ {
+		_, _, err := ExtractControlFromIpk(bytes.NewReader(archive[:n]))
+		// the last byte may be the padding of an odd-sized member
+		if err == nil && !(n == len(archive)-1 && archive[n] == '\n') {
+			t.Errorf("cut after %d of %d bytes: expected an error", n, len(archive))
+		}
+		if err != nil {
+			cuts[strings.SplitN(err.Error(), " (", 2)[0]] = true
+		}
+	}
+	for _, expected := range []string{
+		"not an ar-archive",
+		"truncated \"debian-binary\"",
+		"truncated \"control.tar.gz\"",
+		"truncated \"data.tar.gz\"",
+	} {
+		if !cuts[expected] {
+			t.Errorf("no cut gave %q, got %v", expected, cuts)
+		}
+	}
+}
+
+// a malformed package is not indexed, the others are
+func TestScanMalformedPackage(t *testing.T) {
+	dir := t.TempDir()
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	archive := ipkArchive(t, ipkMembers(t, testControl("bar", "1.0", "arm"))...)
+	writeTestFile(t, filepath.Join(dir, "bar_1.0_arm.ipk"), string(archive[:len(archive)/2]))
+	writeIpk(t, dir, "baz_1.0_arm.ipk", "Package: baz\nVersion: 1.0\n")
+	logged := captureLog(t)
+
+	packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := packages.SortedNames(); !reflect.DeepEqual(names, []string{"foo_1.0_arm.ipk"}) {
+		t.Errorf("got %q, expected only foo", names)
+	}
+	for _, name := range []string{"bar_1.0_arm.ipk", "baz_1.0_arm.ipk"} {
+		if !strings.Contains(logged.String(), name) {
+			t.Errorf("%q is not named in the log:\n%s", name, logged)
+		}
+	}
+}
+
+func TestScanStripFields(t *testing.T) {
+	dir := t.TempDir()
+	control := testControl("foo", "1.0", "arm") + "Source: foo-src\nConffiles:\n /etc/foo.conf\n /etc/foo.d/bar.conf\n"
+	writeIpk(t, dir, "foo_1.0_arm.ipk", control)
+
+	for _, test := range []struct {
+		fields  []string
+		present []string
+		absent  []string
+	}{
+		{nil, []string{"Source: foo-src\n", "Conffiles:\n /etc/foo.conf\n /etc/foo.d/bar.conf\n"}, nil},
+		{[]string{"Conffiles"}, []string{"Source: foo-src\n"}, []string{"Conffiles:", "/etc/foo.conf", "/etc/foo.d/bar.conf"}},
+		{[]string{"source", "Conffiles"}, nil, []string{"Source:", "Conffiles:", "/etc/foo.conf"}},
+	} {
+		packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1), StripFields: test.fields})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var index bytes.Buffer
+		packages.StringTo(&index)
+		for _, s := range append([]string{"Package: foo\n", "Filename: foo_1.0_arm.ipk\n"}, test.present...) {
+			if !strings.Contains(index.String(), s) {
+				t.Errorf("StripFields %q: %q is missing in\n%s", test.fields, s, index.String())
+			}
+		}
+		for _, s := range test.absent {
+			if strings.Contains(index.String(), s) {
+				t.Errorf("StripFields %q: %q is not stripped from\n%s", test.fields, s, index.String())
+			}
+		}
+	}
+}
+
+func TestScanKeepsAlternatives(t *testing.T) {
+	dir := t.TempDir()
+	line := "Alternatives: 100:/bin/sh:/bin/busybox\n"
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm")+line)
+
+	packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index bytes.Buffer
+	packages.StringTo(&index)
+	if !strings.Contains(index.String(), "\n"+line) {
+		t.Errorf("%q is not kept verbatim in\n%s", line, index.String())
+	}
+}
+
+func BenchmarkSortedNames(b *testing.B) {
+	const n = 50000
+	pi := &PackageIndex{Entries: make(map[string]*Ipkg, n)}
+	for i := 0; i < n; i++ {
+		name := "pkg" + strconv.Itoa(i) + "_1.0_arm.ipk"
+		pi.Entries[name] = &Ipkg{Name: name}
+	}
+	if names := pi.SortedNames(); !sort.StringsAreSorted(names) || len(names) != n {
+		b.Fatalf("SortedNames(): got %d names, sorted %v", len(names), sort.StringsAreSorted(names))
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pi.SortedNames()
+		}
+	})
+	b.Run("after-add", func(b *testing.B) {
+		ipkg := &Ipkg{Name: "extra"}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pi.Add("extra", ipkg)
+			pi.SortedNames()
+		}
+	})
+}
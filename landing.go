@@ -0,0 +1,130 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// a feed as listed on the landing page
+type FeedSummary struct {
+	Path        string // url-path, ending in "/"
+	Packages    int
+	SumFileSize int64
+	ModTime     time.Time // of the newest package
+}
+
+type LandingCtx struct {
+	Title   string
+	Feeds   []FeedSummary
+	Date    time.Time
+	Version string
+}
+
+const LANDING_TEMPLATE = `<!doctype html>
+<title>{{.Title}}</title>
+<link rel="icon" href="/favicon.ico">
+<link rel="stylesheet" href="/.kellner/kellner.css">
+
+<p>
+This repository serves {{.Feeds|len}} feeds, add them to opkg via <a href="/opkg.conf">/opkg.conf</a>.
+</p>
+<table>
+	<thead>
+		<tr>
+			<th>Feed</th>
+			<th>Packages</th>
+			<th>Size</th>
+			<th>Last Modified</th>
+		</tr>
+	</thead>
+	<tbody>
+{{range .Feeds}}
+	<tr>
+		<td class="col-link"><a href="{{.Path}}">{{.Path}}</a></td>
+		<td class="col-size">{{.Packages}}</td>
+		<td class="col-size">{{.SumFileSize}}</td>
+		<td class="col-modtime">{{.ModTime.Format "2006-01-02T15:04:05Z07:00" }}</td>
+	</tr>
+{{end}}
+	</tbody>
+</table>
+
+<footer>{{.Version}} - generated at {{.Date}}</footer>
+`
+
+var LandingTemplate = template.Must(template.New("landing").Parse(LANDING_TEMPLATE))
+
+// answers "/" with a page listing all feeds of 'repo', unless "/" is a
+// feed itself, a root served at "/" has an index.html or the directories
+// are listed like apache does (-apache-listing). everything else is
+// served by 'repo'.
+func landingPage(repo *Repository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || (r.Method != "GET" && r.Method != "HEAD") || !repo.Ready() || !repo.wantsLandingPage() {
+			repo.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := &LandingCtx{Title: "kellner", Date: time.Now(), Version: VERSION}
+		for _, feed := range repo.Feeds() {
+			packages := feed.Packages()
+			summary := FeedSummary{
+				Path:     feed.Prefix + "/",
+				Packages: len(packages.Entries),
+				ModTime:  packages.NewestModTime(),
+			}
+			for _, name := range packages.SortedNames() {
+				summary.SumFileSize += packages.Entries[name].FileInfo.Size()
+			}
+			ctx.Feeds = append(ctx.Feeds, summary)
+		}
+
+		page := bytes.NewBuffer(nil)
+		if err := LandingTemplate.Execute(page, ctx); err != nil {
+			logErrorf("rendering the landing page: %v", err)
+			writeError(http.StatusInternalServerError, w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", fmt.Sprint(page.Len()))
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Method == "HEAD" {
+			return
+		}
+		page.WriteTo(w)
+	})
+}
+
+// reports if "/" shows the landing page, see landingPage()
+func (repo *Repository) wantsLandingPage() bool {
+	if repo.ApacheListing {
+		return false
+	}
+	for _, index := range repo.Indices() {
+		if index == "/" {
+			return false
+		}
+	}
+	for _, mount := range repo.Roots {
+		if mount.Prefix != "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(mount.Dir, "index.html")); err == nil {
+			return false
+		}
+	}
+	return true
+}
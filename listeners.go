@@ -0,0 +1,186 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// the addresses kellner serves at (-bind, with tls for -ssl-key). Bind()
+// replaces them while serving (eg. after a SIGHUP changed -bind): the new
+// listeners serve before the previous ones are shut down, so no connection
+// is refused in between and the requests in flight may finish.
+type Listeners struct {
+	Handler http.Handler
+	Drain   time.Duration // how long the requests in flight at replaced listeners may take
+
+	mu        sync.Mutex
+	serving   bool
+	server    *http.Server
+	listeners []net.Listener // as served, with tls
+	binds     []string
+	tls       *tlsOptions
+	raw       map[string]net.Listener // the bound sockets (without tls), by address
+}
+
+// binds to 'binds', with tls unless 'tlsOpts' is nil. an address bound
+// already keeps its socket, so changing only the tls settings works on the
+// same port. once Serve() was called, the new listeners are served right
+// away and the previous ones are shut down. returns an error (and changes
+// nothing, the previous listeners keep serving) if any address can't be
+// bound.
+func (l *Listeners) Bind(binds []string, tlsOpts *tlsOptions) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.raw != nil && equalStrings(binds, l.binds) && sameTLSFiles(tlsOpts, l.tls) {
+		return nil
+	}
+
+	var (
+		raw       = make(map[string]net.Listener, len(binds))
+		listeners = make([]net.Listener, 0, len(binds))
+	)
+	for _, addr := range binds {
+		listen, err := l.listen(addr)
+		if err == nil {
+			raw[addr] = listen
+			if tlsOpts != nil {
+				listen, err = initTLS(listen, tlsOpts)
+			}
+		} else {
+			err = fmt.Errorf("binding to %q failed: %v", addr, err)
+		}
+		if err != nil {
+			for _, listen := range raw {
+				listen.Close()
+			}
+			return err
+		}
+		logInfof("listen on %s", listen.Addr())
+		listeners = append(listeners, listen)
+	}
+
+	// a unix socket taken over must stay when the previous listener closes
+	for addr, listen := range raw {
+		if unix, ok := listen.(*net.UnixListener); ok {
+			if prev, ok := l.raw[addr].(*net.UnixListener); ok {
+				prev.SetUnlinkOnClose(false)
+			}
+			unix.SetUnlinkOnClose(true)
+		}
+	}
+
+	prevServer, prevListeners, prevBinds := l.server, l.listeners, l.binds
+	l.listeners, l.binds, l.tls, l.raw = listeners, binds, tlsOpts, raw
+	if !l.serving {
+		for _, listen := range prevListeners {
+			listen.Close()
+		}
+		return nil
+	}
+
+	l.serve()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), l.Drain)
+		defer cancel()
+		if err := prevServer.Shutdown(ctx); err != nil {
+			logErrorf("requests still in flight at %v after %s: %v", prevBinds, l.Drain, err)
+			prevServer.Close()
+		}
+		logInfof("stopped serving at %v", prevBinds)
+	}()
+	return nil
+}
+
+// a socket listening at 'addr': the one bound there already (duplicated,
+// the previous listener closes its own) or a new one
+func (l *Listeners) listen(addr string) (net.Listener, error) {
+	bound, ok := l.raw[addr]
+	if !ok {
+		return listenOn(addr)
+	}
+	filer, ok := bound.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("in use, rebinding it needs a restart")
+	}
+	file, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// serves the listeners of Bind() with 'Handler', from now on also those of
+// later calls
+func (l *Listeners) Serve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.serving = true
+	l.serve()
+}
+
+func (l *Listeners) serve() {
+	proto := "http"
+	if l.tls != nil {
+		proto = "https"
+	}
+	l.server = &http.Server{Handler: l.Handler}
+	for _, listen := range l.listeners {
+		if listen.Addr().Network() == "unix" {
+			logInfof("serving at unix:%s (%s)", listen.Addr(), proto)
+		} else {
+			logInfof("serving at %s://%s", proto, listen.Addr())
+		}
+		// Shutdown() closes all of them
+		go func(server *http.Server, listen net.Listener) {
+			if err := server.Serve(listen); err != http.ErrServerClosed {
+				logErrorf("serving at %s: %v", listen.Addr(), err)
+				os.Exit(1)
+			}
+		}(l.server, listen)
+	}
+}
+
+// stops serving, the requests in flight may finish until 'ctx' is done
+func (l *Listeners) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	server := l.server
+	l.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// stops serving right away
+func (l *Listeners) Close() error {
+	l.mu.Lock()
+	server := l.server
+	l.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
+
+// reports if 'a' and 'b' use the same tls key and cert (or both none)
+func sameTLSFiles(a, b *tlsOptions) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.keyFileName == b.keyFileName && a.certFileName == b.certFileName
+}
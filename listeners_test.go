@@ -0,0 +1,140 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// GETs /healthz at 'addr' ("host:port" or "unix:/path"), returns the body
+func getFrom(addr string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	resp, err := client.Get("http://kellner/healthz")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestListenersRebindOnReload(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "kellner.conf")
+	first, second := "unix:"+filepath.Join(dir, "a.sock"), "unix:"+filepath.Join(dir, "b.sock")
+	writeTestFile(t, name, "bind = "+first+"\n")
+
+	var binds bindsFlag
+	flags := flag.NewFlagSet("kellner", flag.ContinueOnError)
+	flags.Var(&binds, "bind", "")
+	reloader := &ConfigReloader{Name: name, Flags: flags}
+	reloader.Reloadable = map[string]func(string) error{
+		"bind": func(value string) error {
+			var next bindsFlag
+			if err := next.Set(value); err != nil {
+				return err
+			}
+			binds = next
+			return nil
+		},
+	}
+	if _, err := reloader.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := &Listeners{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }),
+		Drain:   time.Second,
+	}
+	if err := listeners.Bind(binds, nil); err != nil {
+		t.Fatal(err)
+	}
+	listeners.Serve()
+	defer listeners.Close()
+	if body, err := getFrom(first); err != nil || body != "ok" {
+		t.Fatalf("GET at %s: got %q, %v", first, body, err)
+	}
+
+	reload := func(content string) {
+		t.Helper()
+		writeTestFile(t, name, content)
+		if err := reloader.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a new address: served right away, the previous one is gone once drained
+	reload("bind = " + second + "\n")
+	if err := listeners.Bind(binds, nil); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := getFrom(second); err != nil || body != "ok" {
+		t.Errorf("GET at %s: got %q, %v", second, body, err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(strings.TrimPrefix(first, "unix:")); os.IsNotExist(err) {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s still exists after the rebind", first)
+		}
+	}
+	if _, err := getFrom(first); err == nil {
+		t.Errorf("GET at %s: expected an error after the rebind", first)
+	}
+
+	// an address bound already keeps its socket
+	reload("bind = " + second + ",127.0.0.1:0\n")
+	if err := listeners.Bind(binds, nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.raw["127.0.0.1:0"].Addr().String()
+	time.Sleep(100 * time.Millisecond) // let the previous listeners close
+	for _, addr := range []string{second, tcp} {
+		if body, err := getFrom(addr); err != nil || body != "ok" {
+			t.Errorf("GET at %s: got %q, %v", addr, body, err)
+		}
+	}
+
+	// an address which can't be bound changes nothing
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	reload("bind = " + second + "," + busy.Addr().String() + "\n")
+	if err := listeners.Bind(binds, nil); err == nil {
+		t.Errorf("Bind(%q): expected an error", binds)
+	}
+	for _, addr := range []string{second, tcp} {
+		if body, err := getFrom(addr); err != nil || body != "ok" {
+			t.Errorf("GET at %s after a failed rebind: got %q, %v", addr, body, err)
+		}
+	}
+}
@@ -9,30 +9,87 @@
 package main
 
 import (
-	"io"
-	"log"
+	"compress/gzip"
 	"os"
+	"sync"
 )
 
-// assumption: user or logrotate has moved / renamed the file: we
-// still have the handle to the file but the name is gone. so,
-// we create a new file (and truncate! an existing one).
-func rotateLog(currentLogFile *os.File, currentOutput io.Writer) (newLogFile *os.File, newOutput io.Writer) {
+// the -log file. with 'Gzip' the file is a gzip-stream, Flush() makes
+// everything written so far readable (eg. by 'zcat'), Rotate() and Close()
+// end the stream properly.
+type LogFile struct {
+	Name string
+	Gzip bool
+
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+}
 
-	if currentLogFile == nil {
-		return currentLogFile, currentOutput
+// opens (appends to) the log file 'name'. appending to a gzipped log
+// adds another gzip-member, which 'zcat' handles fine.
+func OpenLogFile(name string, useGzip bool) (*LogFile, error) {
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
 	}
+	lf := &LogFile{Name: name, Gzip: useGzip}
+	lf.use(file)
+	return lf, nil
+}
 
-	// first create the new file
-	logFileName := currentLogFile.Name()
-	logFile, err := os.Create(logFileName)
+func (lf *LogFile) use(file *os.File) {
+	lf.file, lf.gz = file, nil
+	if lf.Gzip {
+		lf.gz = gzip.NewWriter(file)
+	}
+}
+
+func (lf *LogFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.gz != nil {
+		return lf.gz.Write(p)
+	}
+	return lf.file.Write(p)
+}
+
+// writes out what the gzip-stream has buffered
+func (lf *LogFile) Flush() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.gz == nil {
+		return nil
+	}
+	return lf.gz.Flush()
+}
+
+// assumption: user or logrotate has moved / renamed the file: we
+// still have the handle to the file but the name is gone. so,
+// we create a new file (and truncate! an existing one). the old
+// file is closed (and its gzip-stream finished) afterwards.
+func (lf *LogFile) Rotate() {
+	file, err := os.Create(lf.Name)
 	if err != nil {
-		log.Printf("error: can't create -log %q after USR1: %v", logFileName, err)
-		return currentLogFile, currentOutput
+		logErrorf("can't create -log %q after USR1: %v", lf.Name, err)
+		return
 	}
 
-	// close the old file
-	currentLogFile.Close()
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	lf.close()
+	lf.use(file)
+}
 
-	return logFile, io.MultiWriter(os.Stderr, logFile)
+func (lf *LogFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.close()
+}
+
+func (lf *LogFile) close() error {
+	if lf.gz != nil {
+		lf.gz.Close()
+	}
+	return lf.file.Close()
 }
@@ -0,0 +1,99 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestLogFileGzipRotate(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kellner.log.gz")
+	lf, err := OpenLogFile(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(lf, "line 1\n")
+	io.WriteString(lf, "line 2\n")
+
+	// what was written is readable after a Flush(), eg. by 'zcat'
+	if err := lf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(readTestFile(t, name)))
+	if err != nil {
+		t.Fatalf("Flush(): %v", err)
+	}
+	flushed, err := io.ReadAll(gz) // the stream is not finished yet
+	if string(flushed) != "line 1\nline 2\n" || err != io.ErrUnexpectedEOF {
+		t.Errorf("Flush(): got %q %v", flushed, err)
+	}
+
+	// logrotate moves the file, then sends USR1
+	rotated := name + ".1"
+	if err := os.Rename(name, rotated); err != nil {
+		t.Fatal(err)
+	}
+	lf.Rotate()
+	io.WriteString(lf, "line 3\n")
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(gunzip(t, readTestFile(t, rotated))); got != "line 1\nline 2\n" {
+		t.Errorf("the rotated log: got %q", got)
+	}
+	if got := string(gunzip(t, readTestFile(t, name))); got != "line 3\n" {
+		t.Errorf("the new log: got %q", got)
+	}
+
+	// appending adds another gzip-member
+	if lf, err = OpenLogFile(name, true); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(lf, "line 4\n")
+	lf.Close()
+	if got := string(gunzip(t, readTestFile(t, name))); got != "line 3\nline 4\n" {
+		t.Errorf("the appended log: got %q", got)
+	}
+}
+
+func TestLogFilePlainRotate(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kellner.log")
+	lf, err := OpenLogFile(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(lf, "line 1\n")
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	lf.Rotate()
+	io.WriteString(lf, "line 2\n")
+	lf.Close()
+
+	for fileName, expected := range map[string]string{name + ".1": "line 1\n", name: "line 2\n"} {
+		if got := string(readTestFile(t, fileName)); got != expected {
+			t.Errorf("%s: got %q, expected %q", filepath.Base(fileName), got, expected)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// the verbosity of the log (-log-level). the request log is not affected,
+// see logRequests().
+type LogLevel int
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			return LogLevel(level), nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// the messages above it are dropped. a LogLevel, changes on SIGHUP (see
+// ConfigReloader) while everything is logging.
+var logLevel atomic.Int32
+
+func init() {
+	SetLogLevel(LogLevelInfo)
+}
+
+func SetLogLevel(level LogLevel) {
+	logLevel.Store(int32(level))
+}
+
+// reports if messages at 'level' are logged
+func logs(level LogLevel) bool {
+	return LogLevel(logLevel.Load()) >= level
+}
+
+// errors are always logged, prefixed by "error: "
+func logErrorf(format string, args ...interface{}) {
+	log.Printf("error: "+format, args...)
+}
+
+// prefixed by "warning: "
+func logWarnf(format string, args ...interface{}) {
+	if logs(LogLevelWarn) {
+		log.Printf("warning: "+format, args...)
+	}
+}
+
+func logInfof(format string, args ...interface{}) {
+	if logs(LogLevelInfo) {
+		log.Printf(format, args...)
+	}
+}
+
+// eg. the per-feed lines of a scan
+func logDebugf(format string, args ...interface{}) {
+	if logs(LogLevelDebug) {
+		log.Printf(format, args...)
+	}
+}
+
+// the format of the events of logEvent(), -log-format (like the requests)
+var logEventFormat = LogFormatText
+
+// logs 'event' at 'level' along with 'fields', pairs of name and value:
+// as "event name=value ..." (strings quoted), with LogFormatJSON as one
+// object per line, carrying the time, the level and the event as well.
+func logEvent(level LogLevel, event string, fields ...interface{}) {
+	if !logs(level) {
+		return
+	}
+
+	line := bytes.NewBuffer(nil)
+	if logEventFormat == LogFormatJSON {
+		fmt.Fprintf(line, `{"time":%s,"level":%s,"event":%s`, eventJSON(time.Now()), eventJSON(level.String()), eventJSON(event))
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(line, ",%s:%s", eventJSON(fmt.Sprint(fields[i])), eventJSON(fields[i+1]))
+		}
+		line.WriteString("}")
+		// like the json lines of logRequests(), without the timestamp-prefix
+		log.New(log.Writer(), "", 0).Println(line.String())
+		return
+	}
+
+	line.WriteString(event)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if value, ok := fields[i+1].(string); ok {
+			fmt.Fprintf(line, " %v=%q", fields[i], value)
+		} else {
+			fmt.Fprintf(line, " %v=%v", fields[i], fields[i+1])
+		}
+	}
+	log.Println(line.String())
+}
+
+// a duration is encoded as "1.5s", like in the text format
+func eventJSON(value interface{}) []byte {
+	if d, ok := value.(time.Duration); ok {
+		value = d.String()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return encoded
+}
@@ -0,0 +1,88 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sends the log to the returned buffer until the test is done
+func captureLog(t *testing.T) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	prev, prevFlags := log.Writer(), log.Flags()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(prev); log.SetFlags(prevFlags) })
+	return buf
+}
+
+func TestLogEventText(t *testing.T) {
+	for _, test := range []struct {
+		level    LogLevel
+		event    string
+		fields   []interface{}
+		expected string
+	}{
+		{LogLevelInfo, "index-built", []interface{}{"feed", "/srv/arm", "prev", 2, "new", 3}, "index-built feed=\"/srv/arm\" prev=2 new=3\n"},
+		{LogLevelInfo, "index-built", []interface{}{"duration", 1500 * time.Millisecond}, "index-built duration=1.5s\n"},
+		{LogLevelInfo, "odd", []interface{}{"feed", "/srv/arm", "dangling"}, "odd feed=\"/srv/arm\"\n"},
+		{LogLevelWarn, "loud", nil, "loud\n"},
+		{LogLevelDebug, "dropped", []interface{}{"feed", "/srv/arm"}, ""},
+	} {
+		buf := captureLog(t)
+		log.SetFlags(0)
+		logEvent(test.level, test.event, test.fields...)
+		if got := buf.String(); got != test.expected {
+			t.Errorf("logEvent(%v, %q, %v): got %q, expected %q", test.level, test.event, test.fields, got, test.expected)
+		}
+	}
+}
+
+func TestLogEventJSON(t *testing.T) {
+	logEventFormat = LogFormatJSON
+	defer func() { logEventFormat = LogFormatText }()
+
+	for _, test := range []struct {
+		level    LogLevel
+		fields   []interface{}
+		expected map[string]interface{} // without the time
+	}{
+		{LogLevelInfo, []interface{}{"feed", "/srv/arm", "new", 3},
+			map[string]interface{}{"level": "info", "event": "e", "feed": "/srv/arm", "new": 3.0}},
+		{LogLevelWarn, []interface{}{"duration", 1500 * time.Millisecond, "quote", `a"b`},
+			map[string]interface{}{"level": "warn", "event": "e", "duration": "1.5s", "quote": `a"b`}},
+		{LogLevelDebug, nil, nil},
+	} {
+		buf := captureLog(t)
+		logEvent(test.level, "e", test.fields...)
+		if test.expected == nil {
+			if buf.Len() != 0 {
+				t.Errorf("logEvent(%v): expected nothing, got %q", test.level, buf.String())
+			}
+			continue
+		}
+
+		var got map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Errorf("logEvent(%v, %v): %q: %v", test.level, test.fields, buf.String(), err)
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, got["time"].(string)); err != nil {
+			t.Errorf("logEvent(%v, %v): time: %v", test.level, test.fields, err)
+		}
+		delete(got, "time")
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("logEvent(%v, %v): got %v, expected %v", test.level, test.fields, got, test.expected)
+		}
+	}
+}
@@ -18,17 +18,23 @@ package main
 // * opkg-make-index from the opkg-utils collection
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -38,29 +44,120 @@ const VERSION = "kellner-0.2"
 func main() {
 
 	var (
-		nworkers        = flag.Int("workers", 4, "number of workers")
-		bind            = flag.String("bind", ":8080", "address to bind to")
-		rootName        = flag.String("root", "", "directory containing the packages")
+		nworkers        = flag.Int("workers", 4, "number of workers (0: one per cpu)")
+		rescanWorkers   = flag.Int("rescan-workers", 0, "number of workers once the initial scan is done, eg. for -watch (0: same as -workers)")
 		dumpPackageList = flag.Bool("dump", false, "just dump the package list and exit")
+		verifyFile      = flag.String("verify", "", "check the given Packages file against the packages in -root, exit non-zero on differences")
+		dumpFormat      = flag.String("dump-format", "packages", "format of -dump: packages or json (like index.json)")
 		addMd5          = flag.Bool("md5", true, "calculate md5 of scanned packages")
 		addSha1         = flag.Bool("sha1", false, "calculate sha1 of scanned packages")
-		useGzip         = flag.Bool("gzip", true, "use 'gzip' to compress the package index. if false: use golang")
+		addSha256       = flag.Bool("sha256", true, "calculate sha256 of scanned packages")
+		useGzip         = flag.Bool("gzip", true, "use 'gzip' to compress the package index. if false: use golang (also used if 'gzip' is missing and -gzip is not given)")
+		strict          = flag.Bool("strict", false, "reject packages whose control lacks a matching Filename field")
+		stripFields     = flag.String("strip-fields", "", "comma separated list of control-fields to strip from the package index")
+		exclude         = flag.String("exclude", "", "comma separated list of globs (eg, *-debug.ipk): matching files are not indexed, but still served")
+		buildDate       = flag.Bool("build-date", false, "add a Build-Date field to the package index (if the control lacks one)")
+		outputDir       = flag.String("output-dir", "", "also write the generated index files to a tree mirroring the feeds in the given directory")
+		cacheFileName   = flag.String("cache", "", "cache the scanned package-data in the given file (eg, .kellner-cache.json)")
+		keepVersions    = flag.Int("keep", 0, "index only the N newest versions of each package (0: all)")
+		compressList    = flag.String("compress", "gzip", "comma separated list of compressed package indices to build (gzip,xz,zstd,bzip2)")
+		compressTimeout = flag.Duration("compress-timeout", 30*time.Second, "kill an external compressor (gzip, xz, ...) taking longer than this (0: no limit)")
+		zstdLevel       = flag.Int("zstd-level", 19, "compression level of Packages.zst (1..19)")
 		showVersion     = flag.Bool("version", false, "show version and exit")
 		logFileName     = flag.String("log", "", "log to given filename")
+		logGzip         = flag.Bool("log-gzip", false, "write the -log file gzip-compressed")
+		logHeaders      = flag.String("log-headers", LogHeadersCurated, "request headers to log: "+LogHeadersFull+", "+LogHeadersCurated+" (User-Agent, Accept-Encoding) or "+LogHeadersNone)
+		logCertDepth    = flag.Int("log-cert-depth", 0, "log the client-id of this certificate of the client's chain (0: the client-cert, 1: its issuer, ...)")
+		rateLimit       = flag.Float64("rate", 0, "requests per second a client (by client-id or address) may make on average, more yield 429 (0: unlimited)")
+		rateBurst       = flag.Int("burst", 10, "requests a client may make at once, see -rate")
+		trustedProxies  = flag.String("trusted-proxies", "", "comma separated list of CIDRs of reverse-proxies: the remote address logged for their requests is taken from X-Forwarded-For, the scheme of /opkg.conf from X-Forwarded-Proto")
+		logLevelName    = flag.String("log-level", LogLevelInfo.String(), "verbosity of the log: error, warn, info or debug (eg. the start of each feed built)")
+		logFormat       = flag.String("log-format", LogFormatText, "format of the request log and the index-built events: "+LogFormatText+" or "+LogFormatJSON+" (one object per line)")
+		quiet           = flag.Bool("quiet", false, "no progress reports during long scans")
+		watch           = flag.Bool("watch", false, "watch the feeds and rebuild the index when packages change")
+		pidFile         = flag.String("pidfile", "", "write the pid to this file once the listeners are bound, remove it on shutdown")
+		runAsUser       = flag.String("user", "", "switch to this user once the listeners are bound")
+		runAsGroup      = flag.String("group", "", "switch to this group once the listeners are bound (default: the primary group of -user)")
+		metricsBind     = flag.String("metrics-bind", "", "serve prometheus metrics at /metrics on the given address")
+		otelEndpoint    = flag.String("otel-endpoint", "", "export a span per request via OTLP/HTTP to the given url, eg. http://localhost:4318 (needs a build with -tags otel)")
+		serverHeader    = flag.String("server-header", "", "value of the Server header of all responses (\"-\": strip it)")
+		countDownloads  = flag.Bool("count-downloads", false, "count the downloads per package, list them at /downloads")
+		downloadsFile   = flag.String("downloads-file", "", "persist the download counts to the given file")
+		syncMarker      = flag.String("sync-marker", "", "rescan only if this (shared) marker file changed")
+		syncInterval    = flag.Duration("sync-interval", 10*time.Second, "how often to check the -sync-marker")
+		followSymlinks  = flag.Bool("follow-symlinks", false, "walk into symlinked directories (within the -root)")
+		assetsDir       = flag.String("assets-dir", "", "directory with a favicon.ico / kellner.css replacing the built-in ones of the html listings")
+		apacheListing   = flag.Bool("apache-listing", false, "list non-package directories in the format of apache's mod_autoindex")
+		maxDepth        = flag.Int("max-depth", -1, "look for feeds at most this many directories below -root (0: only the root itself, -1: unlimited)")
+		watchDelay      = flag.Duration("watch-delay", 2*time.Second, "rebuild the index once no changes were seen for this long")
+		shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "on SIGINT / SIGTERM (or a rebind on SIGHUP) wait this long for requests in flight to finish")
+		aggregate       = flag.Bool("aggregate", false, "serve /Packages listing the packages of all feeds")
+		dedup           = flag.Bool("dedup", false, "log packages with the same content in several feeds, list only the first copy in the html listings")
+		splitArch       = flag.Bool("split-arch", false, "additionally expose a Packages.<arch> index per architecture")
+		fileTypesFile   = flag.String("file-types", "", "file with the Content-Type and Cache-Control of the files served, by extension")
+		templateFile    = flag.String("template", "", "html/template for the listing of a feed (default: built-in)")
+		indexFormats    = flag.String("formats", strings.Join(allIndexFormats, ","), "index files exposed by each feed (overridable per feed via "+FeedFormatsFile+")")
 
 		sslKey               = flag.String("ssl-key", "", "PEM encoded ssl-key")
 		sslCert              = flag.String("ssl-cert", "", "PEM encoded ssl-cert")
 		sslClientCas         = flag.String("ssl-client-cas", "", "PEM encoded list of ssl-certs containing the CAs")
+		sslCRL               = flag.String("crl", "", "PEM (or DER) encoded revocation lists of the -ssl-client-cas, reloaded on SIGHUP")
 		sslRequireClientCert = flag.Bool("require-client-cert", false, "require a client-cert")
 		sslClientIdMuxRoot   = flag.String("client-map", "", "directory containing the client-mappings")
+		sslClientACL         = flag.String("client-acl", "", "file with the feeds each client may access (needs -client-map)")
 		printClientCert      = flag.String("client-id-for", "", "print client-id for given .cert and exit")
 
-		listen net.Listener
-		err    error
+		allowUpload    = flag.Bool("allow-upload", false, "accept new packages via PUT / POST to <feed>/name.ipk")
+		allowDelete    = flag.Bool("allow-delete", false, "remove packages via DELETE <feed>/name.ipk")
+		uploadMaxSize  = flag.Int64("upload-max-size", 256<<20, "maximum size of an uploaded package in bytes")
+		uploadNeedsSig = flag.Bool("upload-require-signature", false, "uploads need a detached gpg-signature (base64 encoded in \"X-Signature\") by a key in the keyring of the user running kellner")
+
+		upstream        = flag.String("upstream", "", "fetch packages missing in a feed from the feed at the same path below the given url")
+		upstreamMaxSize = flag.Int64("upstream-max-size", 0, "remove the oldest packages fetched from -upstream once those of a feed exceed the given bytes (0: unlimited)")
+
+		gpgKey = flag.String("gpg-key", "", "sign a per-feed Release file with the given gpg-key")
+
+		adminToken = flag.String("admin-token", "", "enable /admin/verify for requests with \"Authorization: Bearer <token>\"")
+
+		configFile  = flag.String(configFlagName, "", "read flags from the given file, flags given on the command line take precedence")
+		printConfig = flag.Bool(printConfigFlagName, false, "print the effective configuration and exit")
+
+		err error
 	)
 
+	var binds bindsFlag
+	flag.Var(&binds, "bind", "address to bind to, [::1]:8080 for ipv6, unix:/path for a unix socket (repeatable, default :8080)")
+	var roots rootsFlag
+	flag.Var(&roots, "root", "directory containing the packages, optionally served below a prefix: dir:/prefix (repeatable)")
+	basicAuth := basicAuthFlag{}
+	flag.Var(basicAuth, "basic-auth", "require http basic auth: user:passhash, the hash in bcrypt (repeatable)")
+
 	flag.Parse()
 
+	var (
+		fromConfig     map[string]bool
+		configReloader *ConfigReloader
+	)
+	if *configFile != "" {
+		configReloader = &ConfigReloader{Name: *configFile, Flags: flag.CommandLine}
+		if fromConfig, err = configReloader.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "usage error: -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *printConfig {
+		PrintConfigTo(os.Stdout, flag.CommandLine, fromConfig)
+		return
+	}
+
+	level, err := ParseLogLevel(*logLevelName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage error: -log-level: %v\n", err)
+		os.Exit(1)
+	}
+	SetLogLevel(level)
+
 	if *showVersion {
 		fmt.Println(VERSION)
 		return
@@ -74,26 +171,189 @@ func main() {
 		return
 	}
 
-	if *bind == "" {
-		fmt.Fprintf(os.Stderr, "usage error: missing / empty -bind\n")
-		os.Exit(1)
+	if len(binds) == 0 {
+		binds = bindsFlag{":8080"}
 	}
 
-	if *rootName == "" {
+	if len(roots) == 0 {
 		fmt.Fprintf(os.Stderr, "usage error: missing / empty -root")
 		os.Exit(1)
 	}
-	*rootName, _ = filepath.Abs(*rootName)
+	for i := range roots {
+		roots[i].Dir, _ = filepath.Abs(roots[i].Dir)
+		if err := checkRoot(roots[i].Dir); err != nil {
+			fmt.Fprintf(os.Stderr, "usage error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := CheckMounts(roots); err != nil {
+		fmt.Fprintf(os.Stderr, "usage error: -root: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *fileTypesFile != "" {
+		if err := LoadFileTypes(*fileTypesFile); err != nil {
+			fmt.Fprintf(os.Stderr, "usage error: -file-types: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *assetsDir != "" {
+		if fi, err := os.Stat(*assetsDir); err != nil {
+			fmt.Fprintf(os.Stderr, "usage error: -assets-dir: %v\n", err)
+			os.Exit(1)
+		} else if !fi.IsDir() {
+			fmt.Fprintf(os.Stderr, "usage error: -assets-dir %q is not a directory\n", *assetsDir)
+			os.Exit(1)
+		}
+	}
+
+	if *outputDir != "" {
+		*outputDir, _ = filepath.Abs(*outputDir)
+		for _, root := range roots {
+			if rel, err := filepath.Rel(root.Dir, *outputDir); err == nil && !strings.HasPrefix(rel, "..") {
+				fmt.Fprintf(os.Stderr, "usage error: -output-dir %q is inside of -root %q\n", *outputDir, root.Dir)
+				os.Exit(1)
+			}
+		}
+		if err = os.MkdirAll(*outputDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		// a relative -cache lives in -output-dir as well
+		if *cacheFileName != "" && !filepath.IsAbs(*cacheFileName) {
+			*cacheFileName = filepath.Join(*outputDir, *cacheFileName)
+		}
+	}
+
+	var cache *IpkgCache
+	if *cacheFileName != "" {
+		if cache, err = LoadIpkgCache(*cacheFileName); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	excludes := splitList(*exclude)
+	for _, glob := range excludes {
+		if _, err := path.Match(glob, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "usage error: -exclude: invalid pattern %q\n", glob)
+			os.Exit(1)
+		}
+	}
+
+	if *nworkers < 0 {
+		fmt.Fprintf(os.Stderr, "usage error: -workers must not be negative\n")
+		os.Exit(1)
+	} else if *nworkers == 0 {
+		*nworkers = runtime.NumCPU()
+	}
+
+	scanOpts := ScanOptions{
+		Workers:     NewWorkerPool(*nworkers),
+		Md5:         *addMd5,
+		Sha1:        *addSha1,
+		Sha256:      *addSha256,
+		StripFields: splitList(*stripFields),
+		Exclude:     excludes,
+		Strict:      *strict,
+		Keep:        *keepVersions,
+		BuildDate:   *buildDate,
+		Cache:       cache,
+	}
+
+	if *templateFile != "" {
+		if err := LoadIndexTemplate(*templateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -template %q: %v\n", *templateFile, err)
+			os.Exit(1)
+		}
+	}
+
+	if *rescanWorkers < 0 {
+		fmt.Fprintf(os.Stderr, "usage error: -rescan-workers must not be negative\n")
+		os.Exit(1)
+	}
+	var nrescanWorkers atomic.Int64 // changes on SIGHUP (-config)
+	nrescanWorkers.Store(int64(*rescanWorkers))
+
+	tracer, err := NewTracer(*otelEndpoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage error: -otel-endpoint: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *zstdLevel < 1 || *zstdLevel > 19 {
+		fmt.Fprintf(os.Stderr, "usage error: -zstd-level must be within 1..19\n")
+		os.Exit(1)
+	}
+	if *logCertDepth < 0 {
+		fmt.Fprintf(os.Stderr, "usage error: -log-cert-depth must be 0 or more\n")
+		os.Exit(1)
+	}
+	proxies, err := ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage error: -trusted-proxies: %v\n", err)
+		os.Exit(1)
+	}
+	if *rateLimit < 0 {
+		fmt.Fprintf(os.Stderr, "usage error: -rate must not be negative\n")
+		os.Exit(1)
+	}
+	if *rateLimit > 0 && *rateBurst < 1 {
+		fmt.Fprintf(os.Stderr, "usage error: -burst must be 1 or more\n")
+		os.Exit(1)
+	}
+	if *compressTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "usage error: -compress-timeout must not be negative\n")
+		os.Exit(1)
+	}
+	SetCompressTimeout(*compressTimeout)
+	if *maxDepth < -1 {
+		fmt.Fprintf(os.Stderr, "usage error: -max-depth must be -1 (unlimited) or more\n")
+		os.Exit(1)
+	}
+
+	if *syncMarker != "" && *watch {
+		fmt.Fprintf(os.Stderr, "usage error: -watch and -sync-marker exclude each other\n")
+		os.Exit(1)
+	}
+
+	switch *logHeaders {
+	case LogHeadersFull, LogHeadersCurated, LogHeadersNone:
+	default:
+		fmt.Fprintf(os.Stderr, "usage error: unknown -log-headers %q\n", *logHeaders)
+		os.Exit(1)
+	}
+	if *logFormat != LogFormatText && *logFormat != LogFormatJSON {
+		fmt.Fprintf(os.Stderr, "usage error: unknown -log-format %q\n", *logFormat)
+		os.Exit(1)
+	}
+	logEventFormat = *logFormat
+
+	defaultFormats, err := ParseIndexFormats(*indexFormats)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage error: -formats: %v\n", err)
+		os.Exit(1)
+	}
 
 	var logger io.Writer = os.Stderr
-	var logFile *os.File
+	var logFile *LogFile
 	if *logFileName != "" {
-		logFile, err = os.OpenFile(*logFileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+		logFile, err = OpenLogFile(*logFileName, *logGzip)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "can't create -log %q: %v", *logFileName, err)
 			os.Exit(1)
 		}
 		logger = io.MultiWriter(os.Stderr, logFile)
+
+		// lose at most a second of the log on a crash
+		if *logGzip {
+			go func() {
+				for range time.Tick(time.Second) {
+					logFile.Flush()
+				}
+			}()
+		}
 	}
 	log.SetOutput(logger)
 
@@ -104,10 +364,11 @@ func main() {
 			switch sig {
 			case syscall.SIGUSR1:
 
-				log.Printf("received USR1, recreating log file")
+				logInfof("received USR1, recreating log file")
 
-				logFile, logger = rotateLog(logFile, logger)
-				log.SetOutput(logger)
+				if logFile != nil {
+					logFile.Rotate()
+				}
 			}
 		}
 	}()
@@ -115,125 +376,617 @@ func main() {
 	// simple use-case: scan one directory and dump the created
 	// packages-list to stdout.
 	if *dumpPackageList {
-		now := time.Now()
-		log.Println("start building index from", *rootName)
+		if *dumpFormat != "packages" && *dumpFormat != "json" {
+			fmt.Fprintf(os.Stderr, "usage error: -dump-format must be packages or json\n")
+			os.Exit(1)
+		}
+		for _, root := range roots {
+			now := time.Now()
+			logDebugf("start building index from %s", root.Dir)
+
+			packages, err := ScanDirectoryForPackages(root.Dir, &scanOpts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(2)
+			}
+			logDebugf("done building index")
+			logDebugf("time to parse %d packages: %s", len(packages.Entries), time.Since(now))
 
-		packages, err := ScanDirectoryForPackages(*rootName, *nworkers, *addMd5, *addSha1)
+			if *dumpFormat == "json" {
+				packages.JSONTo(os.Stdout)
+			} else {
+				os.Stdout.WriteString(packages.String())
+			}
+		}
+		saveCache(cache)
+		return
+	}
+
+	// like -dump, but compare the index against a committed one
+	if *verifyFile != "" {
+		if len(roots) != 1 {
+			fmt.Fprintf(os.Stderr, "usage error: -verify needs exactly one -root\n")
+			os.Exit(1)
+		}
+		committed, err := os.Open(*verifyFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(2)
 		}
-		log.Println("done building index")
-		log.Printf("time to parse %d packages: %s\n", len(packages.Entries), time.Since(now))
-
-		os.Stdout.WriteString(packages.String())
+		packages, err := ScanDirectoryForPackages(roots[0].Dir, &scanOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		saveCache(cache)
+		differences, err := VerifyPackagesIndex(os.Stdout, committed, packages)
+		committed.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: -verify %q: %v\n", *verifyFile, err)
+			os.Exit(2)
+		}
+		if differences > 0 {
+			logInfof("%q differs from %q in %d packages", *verifyFile, roots[0].Dir, differences)
+			os.Exit(1)
+		}
+		logInfof("%q matches the %d packages in %q", *verifyFile, len(packages.Entries), roots[0].Dir)
 		return
 	}
 
 	// regular use-case: serve the given directory + the Packages file(s)
 	// recursively.
 	//
-	// setup the listener: either ssl or pure tcp
-	l, err := net.Listen("tcp", *bind)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: binding to %q failed: %v\n", *bind, err)
-		os.Exit(1)
+	if *pidFile != "" {
+		if err := checkPidFile(*pidFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: -pidfile: %v\n", err)
+			os.Exit(1)
+		}
 	}
-	listen = l
 
-	if *sslCert != "" || *sslKey != "" {
+	var crl *CRL
+	if *sslCRL != "" {
+		if *sslClientCas == "" {
+			fmt.Fprintf(os.Stderr, "usage error: -crl needs -ssl-client-cas\n")
+			os.Exit(1)
+		}
+		if crl, err = LoadCRL(*sslCRL, *sslClientCas); err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -crl: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-		var tlsOpts = tlsOptions{
+	// setup the listeners: either ssl or pure tcp (or unix). a SIGHUP
+	// changing -bind, -ssl-key or -ssl-cert binds them again
+	tlsOpts := func() *tlsOptions {
+		if *sslCert == "" && *sslKey == "" {
+			return nil
+		}
+		return &tlsOptions{
 			keyFileName:       *sslKey,
 			certFileName:      *sslCert,
 			requireClientCert: *sslRequireClientCert,
 			clientCasFileName: *sslClientCas,
+			crl:               crl,
 		}
+	}
+	listeners := &Listeners{Drain: *shutdownTimeout}
+	if err := listeners.Bind(binds, tlsOpts()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
 
-		if listen, err = initTLS(listen, &tlsOpts); err != nil {
-
-			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(2)
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: writing -pidfile: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
-	log.Println("listen on", listen.Addr())
-
-	gzipper := Gzipper(GzGzipPipe)
+	// without -gzip given explicitly, fall back to the native gzipper if
+	// there is no (working) 'gzip'. one which hangs (see -compress-timeout)
+	// falls back anyway.
+	gzipper := Gzipper(GzGzipPipeOrGolang)
 	if !*useGzip {
 		gzipper = GzGolang
+	} else if !isFlagGiven("gzip") {
+		if err := GzGzipPipeWorks(); err != nil {
+			logWarnf("'gzip' is not usable (%v), using the native gzipper, see -gzip", err)
+			gzipper = GzGolang
+		}
+	}
+	compressors, err := ParseCompressors(*compressList, gzipper, *zstdLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage error: -compress: %v\n", err)
+		os.Exit(1)
+	}
+	// Packages.bz2 is optional, a missing 'bzip2' is no reason to fail
+	for i, compressor := range compressors {
+		if compressor.Name != "bzip2" {
+			continue
+		}
+		if err := Bzip2PipeWorks(); err != nil {
+			logWarnf("'bzip2' is not usable (%v), not creating Packages.bz2", err)
+			compressors = append(compressors[:i], compressors[i+1:]...)
+		}
+		break
+	}
+
+	var signer *GpgSigner
+	if *gpgKey != "" {
+		signer = &GpgSigner{KeyId: *gpgKey}
+	}
+
+	var mirror *Mirror
+	if *upstream != "" {
+		if u, err := url.Parse(*upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "usage error: -upstream: expected a http:// or https:// url, got %q\n", *upstream)
+			os.Exit(1)
+		}
+		mirror = &Mirror{Upstream: *upstream, MaxSize: *upstreamMaxSize}
+	}
+
+	var downloads *DownloadCounter
+	if *countDownloads || *downloadsFile != "" {
+		if downloads, err = NewDownloadCounter(*downloadsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var metrics *Metrics
+	if *metricsBind != "" {
+		metrics = NewMetrics(nil)
+	}
+	var clientACL *ClientACL
+	if *sslClientACL != "" {
+		if *sslClientIdMuxRoot == "" {
+			fmt.Fprintf(os.Stderr, "usage error: -client-acl needs -client-map\n")
+			os.Exit(1)
+		}
+		if clientACL, err = LoadClientACL(*sslClientACL); err != nil {
+			fmt.Fprintf(os.Stderr, "error: loading -client-acl: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var dups *Duplicates
+	if *dedup {
+		if !*addSha256 {
+			fmt.Fprintf(os.Stderr, "usage error: -dedup needs -sha256\n")
+			os.Exit(1)
+		}
+		dups = &Duplicates{}
 	}
 
 	// the root-muxer is used either directly (non-ssl-client-cert case) or
 	// as a lookup-pool for ClientIdMuxer to get the real worker
 	rootMuxer := http.NewServeMux()
 
-	startTime := time.Now()
-	indices := make([]string, 0)
-	filepath.Walk(*rootName, func(path string, fi os.FileInfo, err error) error {
+	repo := &Repository{
+		Roots: roots,
+		NewFeed: func(dir, prefix string) *Feed {
+			return &Feed{
+				Dir:            dir,
+				Prefix:         prefix,
+				ScanOpts:       &scanOpts,
+				Compressors:    compressors,
+				DefaultFormats: defaultFormats,
+				Signer:         signer,
+				SplitArch:      *splitArch,
+				Downloads:      downloads,
+				Metrics:        metrics,
+				Duplicates:     dups,
+				OutputDir:      *outputDir,
+				Mirror:         mirror,
 
-		if !fi.IsDir() {
-			return nil
-		}
+				AllowUpload:    *allowUpload,
+				AllowDelete:    *allowDelete,
+				WriteNeedsCert: *sslRequireClientCert || *sslClientCas != "",
+				UploadMaxSize:  *uploadMaxSize,
 
-		var (
-			packages *PackageIndex
-			now      = time.Now()
-		)
+				UploadNeedsSignature: *uploadNeedsSig,
+			}
+		},
+		Watch:      *watch,
+		WatchDelay: *watchDelay,
+		SyncMarker: *syncMarker,
 
-		log.Printf("start building index for %q", path)
+		FollowSymlinks: *followSymlinks,
+		MaxDepth:       *maxDepth,
+		ApacheListing:  *apacheListing,
 
-		if packages, err = ScanDirectoryForPackages(path, *nworkers, *addMd5, *addSha1); err != nil {
-			log.Printf("error: %v", err)
-			return nil
-		}
+		Aggregate:   *aggregate,
+		Compressors: compressors,
+		Duplicates:  dups,
 
-		log.Printf("done building index for %q", path)
-		log.Printf("time to parse %d packages in %q: %s\n", len(packages.Entries), path, time.Since(now))
+		ScanOpts: &scanOpts,
+		Builders: NewWorkerPool(*nworkers),
+	}
+	if !*quiet {
+		repo.Progress = 5 * time.Second
+	}
+	if dups != nil {
+		dups.Feeds = repo.Feeds
+	}
+	rootMuxer.Handle("/", landingPage(repo))
+	rootMuxer.Handle("/search", searchHandler(repo))
 
-		muxPath := path[len(*rootName):]
-		if muxPath == "" {
-			muxPath = "/"
-		}
+	// Scan() saves it as well
+	if cache != nil {
+		go func() {
+			for range time.Tick(time.Minute) {
+				saveCache(cache)
+			}
+		}()
+	}
 
-		// non-package directories
-		if len(packages.Entries) == 0 {
-			rootMuxer.Handle(muxPath, http.FileServer(http.Dir(path)))
-			return nil
-		}
+	if downloads != nil {
+		rootMuxer.Handle("/downloads", downloads)
+		go func() {
+			for range time.Tick(time.Minute) {
+				if err := downloads.Save(); err != nil {
+					logErrorf("saving download counts: %v", err)
+				}
+			}
+		}()
+	}
 
-		AttachHttpHandler(rootMuxer, packages, muxPath, *rootName, gzipper)
+	// with -client-map, ClientIdMuxer answers /opkg.conf for each client
+	AttachOpkgRepoSnippet(rootMuxer, "/opkg.conf", repo.Indices, proxies)
 
-		indices = append(indices, muxPath)
+	// the flags a SIGHUP re-reads from the -config file, the others need a
+	// restart
+	if configReloader != nil {
+		configReloader.Reloadable = map[string]func(string) error{
+			"log-level": func(value string) error {
+				level, err := ParseLogLevel(value)
+				if err == nil {
+					SetLogLevel(level)
+				}
+				return err
+			},
+			"compress-timeout": func(value string) error {
+				timeout, err := time.ParseDuration(value)
+				if err == nil && timeout < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+				if err == nil {
+					SetCompressTimeout(timeout)
+				}
+				return err
+			},
+			"rescan-workers": func(value string) error {
+				n, err := strconv.Atoi(value)
+				if err == nil && n < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+				if err != nil {
+					return err
+				}
+				nrescanWorkers.Store(int64(n))
+				if repo.Ready() { // otherwise once the initial scan is done
+					if n == 0 {
+						n = *nworkers
+					}
+					scanOpts.Workers.Resize(n)
+					repo.Builders.Resize(n)
+				}
+				return nil
+			},
+			// bound again once the whole file is applied, see below
+			"bind": func(value string) error {
+				if value == "" {
+					value = ":8080"
+				}
+				var next bindsFlag
+				if err := next.Set(value); err != nil {
+					return err
+				}
+				binds = next
+				return nil
+			},
+			"ssl-key": func(value string) error {
+				*sslKey = value
+				return nil
+			},
+			"ssl-cert": func(value string) error {
+				*sslCert = value
+				return nil
+			},
+		}
+	}
 
-		return nil
-	})
-	// TODO: this is specific to non-client-id situations
-	AttachOpkgRepoSnippet(rootMuxer, "/opkg.conf", indices)
+	var (
+		inFlight int64
+		stopped  = make(chan struct{})
+	)
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				logInfof("received HUP")
+				if configReloader != nil {
+					if err := configReloader.Reload(); err != nil {
+						logErrorf("reloading -config, keeping the previous settings: %v", err)
+					} else if err := listeners.Bind(binds, tlsOpts()); err != nil {
+						logErrorf("rebinding the listeners, keeping the previous ones: %v", err)
+					}
+				}
+				if clientACL != nil {
+					if err := clientACL.Reload(); err != nil {
+						logErrorf("reloading -client-acl, keeping the old rules: %v", err)
+					}
+				}
+				if crl != nil {
+					if err := crl.Reload(); err != nil {
+						logErrorf("reloading -crl, keeping the old lists: %v", err)
+					}
+				}
+				if repo.Rescan() {
+					logInfof("rescanned %v after HUP", roots)
+				} else if repo.SyncMarker != "" {
+					logInfof("not rescanning %v after HUP, -sync-marker %q is unchanged or could not be read", roots, repo.SyncMarker)
+				}
+				continue
+			}
 
-	log.Println()
-	log.Printf("processed %d package-folders in %s", len(indices), time.Since(startTime))
+			logInfof("received %v, shutting down, %d requests in flight", sig, atomic.LoadInt64(&inFlight))
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if err := listeners.Shutdown(ctx); err != nil {
+				logErrorf("%d requests still in flight after -shutdown-timeout %s: %v",
+					atomic.LoadInt64(&inFlight), *shutdownTimeout, err)
+				listeners.Close()
+			}
+			if err := tracer.Shutdown(ctx); err != nil {
+				logErrorf("exporting the last spans: %v", err)
+			}
+			cancel()
+			close(stopped)
+			return
+		}
+	}()
 
 	var httpHandler http.Handler = rootMuxer
 	if *sslClientIdMuxRoot != "" {
 		httpHandler = &ClientIdMuxer{
 			IdRoot:    *sslClientIdMuxRoot,
 			RootMuxer: rootMuxer,
+			ACL:       clientACL,
+			Feeds:     repo.Indices,
 		}
 	}
+	if len(basicAuth) > 0 {
+		httpHandler = requireBasicAuth(httpHandler, basicAuth, *sslRequireClientCert)
+	} else if *sslRequireClientCert {
+		httpHandler = requireClientCert(httpHandler)
+	}
+	if *rateLimit > 0 {
+		httpHandler = NewRateLimiter(*rateLimit, *rateBurst, proxies).Limit(httpHandler)
+	}
 
-	httpHandler = logRequests(httpHandler)
+	if *adminToken != "" {
+		httpHandler = exemptPath("/admin/verify", requireAdminToken(verifyHandler(repo), *adminToken), httpHandler)
+	}
+	httpHandler = exemptPath("/healthz", healthzHandler(repo), httpHandler)
+	httpHandler = exemptPath("/version", versionHandler(), httpHandler)
+	assets := assetsHandler(*assetsDir)
+	httpHandler = exemptPath("/favicon.ico", assets, httpHandler)
+	httpHandler = exemptPath(AssetsPrefix, assets, httpHandler)
+	if metrics != nil {
+		httpHandler = metrics.CountRequests(httpHandler)
+	}
+	httpHandler = logRequests(httpHandler, *logHeaders, *logFormat, *logCertDepth, proxies)
+	httpHandler = tracer.Trace(httpHandler, *logCertDepth)
+	httpHandler = countInFlight(httpHandler, &inFlight)
+	if *serverHeader != "" {
+		httpHandler = setServerHeader(httpHandler, *serverHeader)
+	}
 
-	log.Println()
-	proto := "http://"
-	if *sslKey != "" {
-		proto = "https://"
+	// /metrics is served on its own address, eg. not exposed to the clients
+	if metrics != nil {
+		metrics.Feeds = repo.Feeds
+		metricsListen, err := net.Listen("tcp", *metricsBind)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: binding -metrics-bind to %q failed: %v\n", *metricsBind, err)
+			os.Exit(1)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics)
+		logInfof("serving /metrics at http://%s", metricsListen.Addr())
+		go http.Serve(metricsListen, metricsMux)
 	}
-	log.Printf("serving at %s", proto+listen.Addr().String())
-	http.Serve(listen, httpHandler)
+
+	// all listeners are bound, no need for root (eg. for port 443) anymore
+	if *runAsUser != "" || *runAsGroup != "" {
+		if err := dropPrivileges(*runAsUser, *runAsGroup); err != nil {
+			fmt.Fprintf(os.Stderr, "error: dropping privileges: %v\n", err)
+			os.Exit(1)
+		}
+		logInfof("running as uid %d, gid %d", os.Getuid(), os.Getgid())
+	}
+
+	logInfof("scanning with %d workers", *nworkers)
+
+	// serve right away, /healthz reports when the initial scan is done
+	go func() {
+		repo.Rescan()
+		if n := int(nrescanWorkers.Load()); n > 0 {
+			logInfof("initial scan done, using %d -rescan-workers from now on", n)
+			scanOpts.Workers.Resize(n)
+			repo.Builders.Resize(n)
+		}
+		if *syncMarker != "" {
+			repo.PollSyncMarker(*syncInterval)
+		}
+	}()
+
+	listeners.Handler = httpHandler
+	listeners.Serve()
+	<-stopped
+
+	saveCache(cache)
+	if downloads != nil {
+		if err := downloads.Save(); err != nil {
+			logErrorf("saving download counts: %v", err)
+		}
+	}
+	if *pidFile != "" {
+		if err := os.Remove(*pidFile); err != nil {
+			logErrorf("removing -pidfile: %v", err)
+		}
+	}
+	logInfof("shut down")
+	if logFile != nil {
+		log.SetOutput(os.Stderr)
+		logFile.Close()
+	}
+}
+
+// reports if the flag 'name' was given on the command line or in the
+// -config file
+func isFlagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) { given = given || f.Name == name })
+	return given
 }
 
-func ScanDirectoryForPackages(dir string, nworkers int, addMd5, addSha1 bool) (*PackageIndex, error) {
+// the -bind flag: "host:port" or "unix:/path", repeated or comma separated
+type bindsFlag []string
+
+func (binds *bindsFlag) String() string {
+	return strings.Join(*binds, ",")
+}
+
+func (binds *bindsFlag) Set(value string) error {
+	addrs := splitList(value)
+	if len(addrs) == 0 {
+		return fmt.Errorf("missing / empty -bind")
+	}
+	*binds = append(*binds, addrs...)
+	return nil
+}
+
+// listens at 'addr': a unix socket for "unix:/path" (a stale socket left
+// behind, which nobody answers at, is removed first), tcp otherwise
+func listenOn(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	sock := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Lstat(sock); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%q is in use", sock)
+		}
+		os.Remove(sock)
+	}
+	return net.Listen("unix", sock)
+}
+
+// the -root flag: "dir" or "dir:/prefix", repeated or comma separated
+type rootsFlag []Mount
+
+func (roots *rootsFlag) String() string {
+	values := make([]string, len(*roots))
+	for i, root := range *roots {
+		values[i] = root.String()
+	}
+	return strings.Join(values, ",")
+}
+
+func (roots *rootsFlag) Set(value string) error {
+	for _, value := range splitList(value) {
+		mount, err := ParseMount(value)
+		if err != nil {
+			return err
+		}
+		*roots = append(*roots, mount)
+	}
+	return nil
+}
+
+// checks that the -root 'dir' exists and is a directory, an empty tree
+// would be served otherwise
+func checkRoot(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("-root %q: %v", dir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("-root %q is not a directory", dir)
+	}
+	return nil
+}
+
+// controls what ScanDirectoryForPackages calculates and keeps
+type ScanOptions struct {
+	Workers     *WorkerPool // shared by all directories scanned concurrently
+	Md5         bool
+	Sha1        bool
+	Sha256      bool
+	StripFields []string   // control-fields to remove from the index
+	Exclude     []string   // globs of the filenames not to index
+	Strict      bool       // reject packages lacking a correct "Filename"
+	Keep        int        // if > 0: keep only the newest 'Keep' versions of a package
+	BuildDate   bool       // add a "Build-Date" field to the index (see Ipkg.Built())
+	Cache       *IpkgCache // optional
+
+	indexed atomic.Int64 // packages indexed so far, see Indexed()
+}
+
+// returns the number of packages indexed by ScanDirectoryForPackages()
+// with these options, ever since the start
+func (opts *ScanOptions) Indexed() int64 {
+	return opts.indexed.Load()
+}
+
+// reports if the file 'name' is not to be indexed, see -exclude
+func (opts *ScanOptions) Excluded(name string) bool {
+	for _, glob := range opts.Exclude {
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// opkg downloads a package via its "Filename" field. usually the control
+// file does not carry one and the actual filename is used. with 'Strict'
+// the control must name the file it is contained in.
+func (opts *ScanOptions) Check(name string, ipkg *Ipkg) error {
+	if !opts.Strict {
+		return nil
+	}
+	filename, ok := ipkg.Header["Filename"]
+	if !ok {
+		return fmt.Errorf("no \"Filename\" field")
+	} else if filename != name {
+		return fmt.Errorf("\"Filename\" %q does not match %q", filename, name)
+	}
+	return nil
+}
+
+// checks 'ipkg' and strips the fields not to be indexed. a "Filename" of
+// the control is always replaced by 'name', a "Size" by the size of the
+// .ipk (see ControlAndChecksumTo()).
+func (opts *ScanOptions) prepare(name string, ipkg *Ipkg) error {
+	if err := opts.Check(name, ipkg); err != nil {
+		return err
+	}
+	ipkg.StripFields(append([]string{"Filename", "Size"}, opts.StripFields...))
+	if _, ok := ipkg.Header["Build-Date"]; opts.BuildDate && !ok {
+		built := ipkg.Built().UTC().Format(time.RFC3339)
+		ipkg.Header["Build-Date"] = built
+		ipkg.Control = strings.TrimSuffix(ipkg.Control, "\n") + "\nBuild-Date: " + built + "\n"
+	}
+	return nil
+}
+
+// scans the .ipk files directly inside of 'dir'. subdirectories are not
+// descended into, each of them is a feed on its own. thus the name of a
+// package is its path relative to the feed, which is what opkg expects
+// in "Filename".
+func ScanDirectoryForPackages(dir string, opts *ScanOptions) (*PackageIndex, error) {
 
 	root, err := os.Open(dir)
 	if err != nil {
@@ -241,51 +994,146 @@ func ScanDirectoryForPackages(dir string, nworkers int, addMd5, addSha1 bool) (*
 	}
 
 	entries, err := root.Readdirnames(-1)
+	root.Close()
 	if err != nil {
 		return nil, fmt.Errorf("reading dir entries from -root %q: %v\n", dir, err)
 	}
 
 	packages := &PackageIndex{Entries: make(map[string]*Ipkg)}
-	workers := NewWorkerPool(nworkers)
+	var wg sync.WaitGroup
 
+	ipkNames := make([]string, 0, len(entries))
 	for _, entry := range entries {
-		if path.Ext(entry) != ".ipk" {
+		if path.Ext(entry) != ".ipk" || opts.Excluded(entry) {
 			continue
 		}
-		workers.Hire()
+		ipkNames = append(ipkNames, entry)
+
+		if opts.Cache != nil {
+			if ipkg, ok := opts.Cache.Lookup(entry, dir, opts); ok {
+				if err := opts.prepare(entry, ipkg); err != nil {
+					logErrorf("%q: %v\n", path.Join(dir, entry), err)
+					continue
+				}
+				packages.Add(entry, ipkg)
+				opts.indexed.Add(1)
+				continue
+			}
+		}
+
+		opts.Workers.Hire()
+		wg.Add(1)
 		go func(name string) {
-			defer workers.Release()
-			ipkg, err := NewIpkgFromFile(name, dir, addMd5, addSha1)
+			defer wg.Done()
+			defer opts.Workers.Release()
+			ipkg, err := NewIpkgFromFile(name, dir, opts.Md5, opts.Sha1, opts.Sha256)
 			if err != nil {
-				log.Printf("error: %v\n", err)
+				logErrorf("%v\n", err)
 				return
 			}
-			packages.Lock()
-			packages.Entries[name] = ipkg
-			packages.Unlock()
+			if opts.Cache != nil {
+				opts.Cache.Store(dir, ipkg)
+			}
+			if err := opts.prepare(name, ipkg); err != nil {
+				logErrorf("%q: %v\n", path.Join(dir, name), err)
+				return
+			}
+			packages.Add(name, ipkg)
+			opts.indexed.Add(1)
 		}(entry)
 	}
-	workers.Wait()
+	wg.Wait()
+
+	if opts.Cache != nil {
+		opts.Cache.Retain(dir, ipkNames) // saved by the caller, eg. Scan()
+	}
+
+	for _, collision := range packages.RemoveCollisions() {
+		logWarnf("%q and %q in %q have the same Package, Version and Architecture, omitting %q from the index",
+			collision.Kept, collision.Removed, dir, collision.Removed)
+	}
+
+	if opts.Keep > 0 {
+		for _, name := range packages.KeepNewest(opts.Keep) {
+			logDebugf("omitting %q from the index of %q, -keep %d", name, dir, opts.Keep)
+		}
+	}
+
 	return packages, nil
 }
 
+// splits a comma separated list, ignoring empty elements
+func splitList(list string) []string {
+	elems := make([]string, 0)
+	for _, elem := range strings.Split(list, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// saves the -cache (if any), logs a failure
+func saveCache(cache *IpkgCache) {
+	if cache == nil {
+		return
+	}
+	if err := cache.Save(); err != nil {
+		logErrorf("saving -cache: %v", err)
+	}
+}
+
+// emits a structured event about a (re)built index of 'feed': the
+// number of packages before and after the build and what changed in between.
+// 'prev' is nil if there was no index before (eg, at startup).
+func logIndexDelta(feed string, prev, cur *PackageIndex, took time.Duration) {
+	prevCount := 0
+	if prev != nil {
+		prevCount = len(prev.Entries)
+	}
+	added, removed := cur.Delta(prev)
+	logEvent(LogLevelInfo, "index-built", "feed", feed, "prev", prevCount, "new", len(cur.Entries),
+		"added", added, "removed", removed, "duration", took)
+}
+
+// limits the number of packages processed at the same time, across all
+// directories
 type WorkerPool struct {
-	sync.WaitGroup
-	worker chan bool
+	mu   sync.Mutex
+	idle *sync.Cond
+	size int
+	busy int
 }
 
 func NewWorkerPool(n int) *WorkerPool {
-	return &WorkerPool{worker: make(chan bool, n)}
+	pool := &WorkerPool{size: n}
+	pool.idle = sync.NewCond(&pool.mu)
+	return pool
 }
 
 // hire / block a worker from the pool
 func (pool *WorkerPool) Hire() {
-	pool.worker <- true
-	pool.Add(1)
+	pool.mu.Lock()
+	for pool.busy >= pool.size {
+		pool.idle.Wait()
+	}
+	pool.busy++
+	pool.mu.Unlock()
 }
 
 // release / unblock a blocked worker from the pool
 func (pool *WorkerPool) Release() {
-	pool.Done()
-	<-pool.worker
+	pool.mu.Lock()
+	pool.busy--
+	pool.mu.Unlock()
+	pool.idle.Signal()
+}
+
+// changes the number of workers. if it shrinks, the workers hired
+// already finish their package first.
+func (pool *WorkerPool) Resize(n int) {
+	pool.mu.Lock()
+	pool.size = n
+	pool.mu.Unlock()
+	pool.idle.Broadcast()
 }
@@ -0,0 +1,264 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a feed of 1000 packages, as eg. a nightly build produces. the packages
+// are small, the time goes into opening, parsing and hashing them.
+func BenchmarkScanDirectoryForPackages(b *testing.B) {
+	const n = 1000
+	dir := b.TempDir()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("pkg%04d", i)
+		writeIpk(b, dir, name+"_1.0_arm.ipk", testControl(name, "1.0", "arm"))
+	}
+
+	for _, bench := range []struct {
+		name              string
+		md5, sha1, sha256 bool
+	}{
+		{"plain", false, false, false},
+		{"md5", true, false, false},
+		{"md5+sha1+sha256", true, true, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			opts := &ScanOptions{
+				Workers: NewWorkerPool(runtime.NumCPU()),
+				Md5:     bench.md5,
+				Sha1:    bench.sha1,
+				Sha256:  bench.sha256,
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				packages, err := ScanDirectoryForPackages(dir, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(packages.Entries) != n {
+					b.Fatalf("got %d packages, expected %d", len(packages.Entries), n)
+				}
+			}
+		})
+	}
+}
+
+func TestLogIndexDelta(t *testing.T) {
+	dir := t.TempDir()
+	writeIpk(t, dir, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	writeIpk(t, dir, "bar_1.0_arm.ipk", testControl("bar", "1.0", "arm"))
+	feed := testFeed(dir, "/arm")
+
+	buf := captureLog(t)
+	logEventFormat = LogFormatJSON
+	defer func() { logEventFormat = LogFormatText }()
+
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "bar_1.0_arm.ipk")); err != nil {
+		t.Fatal(err)
+	}
+	writeIpk(t, dir, "baz_1.0_arm.ipk", testControl("baz", "1.0", "arm"))
+	writeIpk(t, dir, "qux_1.0_arm.ipk", testControl("qux", "1.0", "arm"))
+	if err := feed.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	type delta struct {
+		Event, Level, Feed        string
+		Prev, New, Added, Removed int
+	}
+	expected := []delta{
+		{"index-built", "info", dir, 0, 2, 2, 0},
+		{"index-built", "info", dir, 2, 3, 2, 1},
+	}
+	var got []delta
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event delta
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		got = append(got, event)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got the events %v, expected %v", got, expected)
+	}
+}
+
+func TestScanFilename(t *testing.T) {
+	control := testControl("foo", "1.0", "arm")
+	for _, test := range []struct {
+		control  string
+		strict   bool
+		expected string // the Filename indexed, "": skipped
+	}{
+		{control, false, "foo_1.0_arm.ipk"},
+		{control + "Filename: foo_1.0_arm.ipk\n", false, "foo_1.0_arm.ipk"},
+		{control + "Filename: other.ipk\n", false, "foo_1.0_arm.ipk"},
+		{control, true, ""},
+		{control + "Filename: foo_1.0_arm.ipk\n", true, "foo_1.0_arm.ipk"},
+		{control + "Filename: other.ipk\n", true, ""},
+	} {
+		dir := t.TempDir()
+		writeIpk(t, dir, "foo_1.0_arm.ipk", test.control)
+		packages, err := ScanDirectoryForPackages(dir, &ScanOptions{Workers: NewWorkerPool(1), Strict: test.strict})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index := bytes.NewBuffer(nil)
+		packages.StringTo(index)
+		var filenames []string
+		for _, line := range strings.Split(index.String(), "\n") {
+			if strings.HasPrefix(line, "Filename: ") {
+				filenames = append(filenames, strings.TrimPrefix(line, "Filename: "))
+			}
+		}
+		if test.expected == "" {
+			if len(packages.Entries) != 0 {
+				t.Errorf("strict=%v %q: expected the package to be skipped, got %q", test.strict, test.control, index)
+			}
+		} else if len(filenames) != 1 || filenames[0] != test.expected {
+			t.Errorf("strict=%v %q: got the Filenames %q, expected %q", test.strict, test.control, filenames, test.expected)
+		}
+	}
+}
+
+// hires a worker of 'pool' in the background, closes the channel returned
+// once hired
+func hires(pool *WorkerPool) <-chan struct{} {
+	hired := make(chan struct{})
+	go func() {
+		pool.Hire()
+		close(hired)
+	}()
+	return hired
+}
+
+// reports if the worker is hired within a short time
+func isHired(hired <-chan struct{}) bool {
+	select {
+	case <-hired:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+// shrinking the pool lets the workers hired already finish, a new one is
+// hired once the busy ones fit the new size
+func TestWorkerPoolResize(t *testing.T) {
+	pool := NewWorkerPool(3)
+	for i := 0; i < 3; i++ {
+		pool.Hire()
+	}
+	hired := hires(pool)
+	if isHired(hired) {
+		t.Fatal("Hire(): hired a 4th of 3 workers")
+	}
+
+	pool.Resize(1)
+	pool.Release()
+	pool.Release()
+	if isHired(hired) {
+		t.Fatal("Hire(): hired a 2nd of 1 worker")
+	}
+	pool.Release()
+	if !isHired(hired) {
+		t.Fatal("Hire(): not hired with 0 of 1 workers busy")
+	}
+
+	pool.Resize(2)
+	if !isHired(hires(pool)) {
+		t.Fatal("Hire(): not hired with 1 of 2 workers busy after growing")
+	}
+}
+
+// the packages scanned at the same time at most, sampled while scanning
+func peakBusy(pool *WorkerPool, scan func()) int {
+	var (
+		done = make(chan struct{})
+		peak = make(chan int)
+	)
+	go func() {
+		max := 0
+		for {
+			pool.mu.Lock()
+			if pool.busy > max {
+				max = pool.busy
+			}
+			pool.mu.Unlock()
+			select {
+			case <-done:
+				peak <- max
+				return
+			default:
+				runtime.Gosched()
+			}
+		}
+	}()
+	scan()
+	close(done)
+	return <-peak
+}
+
+// with -rescan-workers the rescans of a live server scan fewer packages
+// at once than the initial scan
+func TestRescanWorkers(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("pkg%02d", i)
+		writeIpk(t, dir, name+"_1.0_arm.ipk", testControl(name, "1.0", "arm"))
+	}
+	opts := &ScanOptions{Workers: NewWorkerPool(8), Md5: true, Sha1: true, Sha256: true}
+	scan := func() {
+		if _, err := ScanDirectoryForPackages(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if peak := peakBusy(opts.Workers, scan); peak > 8 {
+		t.Errorf("initial scan: %d packages at once, expected at most 8", peak)
+	}
+	opts.Workers.Resize(1) // like main() after the initial scan
+	if peak := peakBusy(opts.Workers, scan); peak > 1 {
+		t.Errorf("rescan: %d packages at once, expected at most 1 (-rescan-workers)", peak)
+	}
+}
+
+func TestCheckRoot(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	writeTestFile(t, file, "")
+	for _, test := range []struct {
+		dir      string
+		expected string // "": ok
+	}{
+		{dir, ""},
+		{filepath.Join(dir, "missing"), "no such file or directory"},
+		{file, "is not a directory"},
+	} {
+		err := checkRoot(test.dir)
+		if (err == nil) != (test.expected == "") || (err != nil && !strings.Contains(err.Error(), test.expected)) {
+			t.Errorf("checkRoot(%q): got %v, expected %q", test.dir, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collects the numbers exposed at /metrics, in the text format of
+// prometheus (https://prometheus.io/docs/instrumenting/exposition_formats/)
+type Metrics struct {
+	Feeds func() []*Feed // the feeds to report the number of packages of
+
+	mu       sync.Mutex
+	requests map[int]uint64 // by status code
+	bytes    uint64         // of all response bodies
+	builds   map[string]*buildMetrics
+}
+
+type buildMetrics struct {
+	count   uint64
+	seconds float64 // sum over all builds
+	last    float64 // duration of the last build
+}
+
+func NewMetrics(feeds func() []*Feed) *Metrics {
+	return &Metrics{
+		Feeds:    feeds,
+		requests: make(map[int]uint64),
+		builds:   make(map[string]*buildMetrics),
+	}
+}
+
+// counts the requests handled by 'handler', by status code, and the
+// bytes it sends
+func (m *Metrics) CountRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := logStatusCode{ResponseWriter: w}
+		handler.ServeHTTP(&sw, r)
+		if sw.Code == 0 {
+			sw.Code = 200
+		}
+		m.mu.Lock()
+		m.requests[sw.Code]++
+		m.bytes += uint64(sw.Bytes)
+		m.mu.Unlock()
+	})
+}
+
+// records that the index of 'feed' was built in 'took'
+func (m *Metrics) ObserveBuild(feed string, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.builds[feed]
+	if b == nil {
+		b = &buildMetrics{}
+		m.builds[feed] = b
+	}
+	b.count++
+	b.seconds += took.Seconds()
+	b.last = took.Seconds()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.TextTo(w)
+}
+
+func (m *Metrics) TextTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP kellner_http_requests_total Requests handled, by status code.")
+	fmt.Fprintln(w, "# TYPE kellner_http_requests_total counter")
+	codes := make([]int, 0, len(m.requests))
+	for code := range m.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "kellner_http_requests_total{code=\"%d\"} %d\n", code, m.requests[code])
+	}
+
+	fmt.Fprintln(w, "# HELP kellner_http_response_bytes_total Bytes sent in response bodies.")
+	fmt.Fprintln(w, "# TYPE kellner_http_response_bytes_total counter")
+	fmt.Fprintf(w, "kellner_http_response_bytes_total %d\n", m.bytes)
+
+	feeds := make([]string, 0, len(m.builds))
+	for feed := range m.builds {
+		feeds = append(feeds, feed)
+	}
+	sort.Strings(feeds)
+	fmt.Fprintln(w, "# HELP kellner_index_build_seconds Time spent building the index of a feed.")
+	fmt.Fprintln(w, "# TYPE kellner_index_build_seconds summary")
+	for _, feed := range feeds {
+		b := m.builds[feed]
+		fmt.Fprintf(w, "kellner_index_build_seconds_sum{feed=\"%s\"} %g\n", promLabel(feed), b.seconds)
+		fmt.Fprintf(w, "kellner_index_build_seconds_count{feed=\"%s\"} %d\n", promLabel(feed), b.count)
+	}
+	fmt.Fprintln(w, "# HELP kellner_index_last_build_seconds Duration of the last build of the index of a feed.")
+	fmt.Fprintln(w, "# TYPE kellner_index_last_build_seconds gauge")
+	for _, feed := range feeds {
+		fmt.Fprintf(w, "kellner_index_last_build_seconds{feed=\"%s\"} %g\n", promLabel(feed), m.builds[feed].last)
+	}
+
+	fmt.Fprintln(w, "# HELP kellner_feed_packages Packages in the index of a feed.")
+	fmt.Fprintln(w, "# TYPE kellner_feed_packages gauge")
+	if m.Feeds != nil {
+		for _, feed := range m.Feeds() {
+			fmt.Fprintf(w, "kellner_feed_packages{feed=\"%s\"} %d\n", promLabel(feed.Prefix), len(feed.Packages().Entries))
+		}
+	}
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapes 'value' for use as a label value
+func promLabel(value string) string {
+	return promLabelEscaper.Replace(value)
+}
@@ -0,0 +1,346 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the packages a Mirror fetched into a feed-directory, one name per
+// line, oldest first
+const MirrorRecordFile = ".kellner-upstream"
+
+// how long the Packages index of an upstream feed is used before it is
+// fetched again
+const upstreamIndexMaxAge = time.Minute
+
+var upstreamClient = &http.Client{Timeout: 10 * time.Minute}
+
+// the requested package is not listed by the upstream feed
+var errNotUpstream = errors.New("not listed upstream")
+
+// fetches packages missing in a feed from the feed at the same url-path
+// below 'Upstream': a request for "<prefix>/name.ipk" which is not in the
+// index of the feed is looked up in the upstream "<prefix>/Packages". if
+// it is listed there, it is downloaded into the feed-directory, checked
+// against the upstream Size / SHA256 / MD5sum and the feed is rebuilt
+// before the request is answered.
+//
+// the fetched packages are recorded in MirrorRecordFile. with 'MaxSize',
+// the oldest fetched ones are removed once those of a feed would take
+// more than 'MaxSize' bytes. packages put into the feed otherwise are
+// never removed.
+type Mirror struct {
+	Upstream string // base url, eg. "http://upstream:8080"
+	MaxSize  int64  // of the fetched packages per feed, 0: unlimited
+
+	mu       sync.Mutex
+	indices  map[string]*upstreamIndex // by feed prefix
+	inFlight map[string]*mirrorFetch   // by url-path of the package
+}
+
+type upstreamIndex struct {
+	fetched  time.Time
+	packages map[string]upstreamPackage // by name of the .ipk
+}
+
+type upstreamPackage struct {
+	filename string // relative to the upstream feed
+	size     int64  // -1: not listed
+	md5      string
+	sha256   string
+}
+
+type mirrorFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// fetches the package 'name' from upstream into 'feed' and rebuilds the
+// feed. concurrent requests for the same package wait for the first one.
+// returns errNotUpstream if upstream does not list 'name'.
+func (mirror *Mirror) Fetch(feed *Feed, name string) error {
+	key := path.Join(feed.Prefix, name)
+
+	mirror.mu.Lock()
+	if call, ok := mirror.inFlight[key]; ok {
+		mirror.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	if mirror.inFlight == nil {
+		mirror.inFlight = make(map[string]*mirrorFetch)
+	}
+	call := &mirrorFetch{done: make(chan struct{})}
+	mirror.inFlight[key] = call
+	mirror.mu.Unlock()
+
+	call.err = mirror.fetch(feed, name)
+
+	mirror.mu.Lock()
+	delete(mirror.inFlight, key)
+	mirror.mu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+func (mirror *Mirror) fetch(feed *Feed, name string) error {
+	pkg, err := mirror.lookup(feed.Prefix, name)
+	if err != nil {
+		return err
+	}
+	if mirror.MaxSize > 0 && pkg.size > mirror.MaxSize {
+		return fmt.Errorf("%q has %d bytes, more than -upstream-max-size", name, pkg.size)
+	}
+
+	url := mirror.feedURL(feed.Prefix) + path.Clean("/"+pkg.filename)
+	resp, err := upstreamClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	tmpFile, err := ioutil.TempFile(feed.Dir, "."+name+".upstream-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName) // no-op once the package is moved in place
+
+	var (
+		body     io.Reader = resp.Body
+		md5er              = md5.New()
+		sha256er           = sha256.New()
+	)
+	if mirror.MaxSize > 0 {
+		body = io.LimitReader(body, mirror.MaxSize+1)
+	}
+	n, err := io.Copy(io.MultiWriter(tmpFile, md5er, sha256er), body)
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+
+	switch {
+	case pkg.size >= 0 && n != pkg.size:
+		return fmt.Errorf("GET %s: got %d bytes, upstream lists %d", url, n, pkg.size)
+	case mirror.MaxSize > 0 && n > mirror.MaxSize:
+		return fmt.Errorf("GET %s: more than -upstream-max-size", url)
+	case pkg.sha256 != "" && hex.EncodeToString(sha256er.Sum(nil)) != pkg.sha256:
+		return fmt.Errorf("GET %s: sha256 mismatch", url)
+	case pkg.md5 != "" && hex.EncodeToString(md5er.Sum(nil)) != pkg.md5:
+		return fmt.Errorf("GET %s: md5 mismatch", url)
+	}
+
+	ipkg, err := NewIpkgFromFile(filepath.Base(tmpName), feed.Dir, false, false, false)
+	if err == nil {
+		err = feed.ScanOpts.Check(name, ipkg)
+	}
+	if err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+
+	if err = mirror.makeRoom(feed.Dir, n); err != nil {
+		return err
+	}
+	// link() fails if the package appeared meanwhile, keep that one
+	if err = os.Link(tmpName, filepath.Join(feed.Dir, name)); err != nil && !os.IsExist(err) {
+		return err
+	} else if err == nil {
+		if err = mirror.record(feed.Dir, name); err != nil {
+			logErrorf("recording %q in %q: %v", name, MirrorRecordFile, err)
+		}
+		logInfof("fetched %q from %s", name, url)
+	}
+
+	return feed.Build()
+}
+
+// returns the base url of the upstream feed served at 'prefix'
+func (mirror *Mirror) feedURL(prefix string) string {
+	return strings.TrimSuffix(mirror.Upstream, "/") + strings.TrimSuffix(path.Clean("/"+prefix), "/")
+}
+
+// returns what the upstream Packages of the feed at 'prefix' lists about
+// the package 'name'. the index is fetched again once it is older than
+// upstreamIndexMaxAge.
+func (mirror *Mirror) lookup(prefix, name string) (upstreamPackage, error) {
+	mirror.mu.Lock()
+	index := mirror.indices[prefix]
+	mirror.mu.Unlock()
+
+	if index == nil || time.Since(index.fetched) > upstreamIndexMaxAge {
+		url := mirror.feedURL(prefix) + "/Packages"
+		packages, err := fetchUpstreamIndex(url)
+		if err != nil {
+			return upstreamPackage{}, fmt.Errorf("GET %s: %v", url, err)
+		}
+		index = &upstreamIndex{fetched: time.Now(), packages: packages}
+
+		mirror.mu.Lock()
+		if mirror.indices == nil {
+			mirror.indices = make(map[string]*upstreamIndex)
+		}
+		mirror.indices[prefix] = index
+		mirror.mu.Unlock()
+	}
+
+	pkg, ok := index.packages[name]
+	if !ok {
+		return upstreamPackage{}, errNotUpstream
+	}
+	return pkg, nil
+}
+
+// reads the Packages index at 'url', returns its packages by name
+func fetchUpstreamIndex(url string) (map[string]upstreamPackage, error) {
+	resp, err := upstreamClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	stanzas, err := ParsePackagesIndex(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make(map[string]upstreamPackage)
+	for _, stanza := range stanzas {
+		filename := stanza["Filename"]
+		if filename == "" {
+			continue
+		}
+		pkg := upstreamPackage{
+			filename: filename,
+			size:     -1,
+			md5:      strings.ToLower(stanza["MD5sum"]),
+			sha256:   strings.ToLower(stanza["SHA256"]),
+		}
+		if size, err := strconv.ParseInt(stanza["Size"], 10, 64); err == nil {
+			pkg.size = size
+		}
+		packages[path.Base(filename)] = pkg
+	}
+	return packages, nil
+}
+
+// removes the oldest packages fetched into 'dir' until another 'n' bytes
+// fit into -upstream-max-size
+func (mirror *Mirror) makeRoom(dir string, n int64) error {
+	if mirror.MaxSize <= 0 {
+		return nil
+	}
+
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+
+	names, err := readMirrorRecord(dir)
+	if err != nil {
+		return err
+	}
+	var (
+		sizes = make([]int64, len(names))
+		total int64
+	)
+	for i, name := range names {
+		if fi, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+
+	removed := 0
+	for ; removed < len(names) && total+n > mirror.MaxSize; removed++ {
+		if err := os.Remove(filepath.Join(dir, names[removed])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		logInfof("removed %q from %q, -upstream-max-size is reached", names[removed], dir)
+		total -= sizes[removed]
+	}
+	if removed == 0 {
+		return nil
+	}
+	return writeMirrorRecord(dir, names[removed:])
+}
+
+// appends 'name' to the MirrorRecordFile in 'dir'
+func (mirror *Mirror) record(dir, name string) error {
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+
+	names, err := readMirrorRecord(dir)
+	if err != nil {
+		return err
+	}
+	kept := names[:0]
+	for _, known := range names {
+		if known != name {
+			kept = append(kept, known)
+		}
+	}
+	return writeMirrorRecord(dir, append(kept, name))
+}
+
+func readMirrorRecord(dir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(dir, MirrorRecordFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	names := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, scanner.Err()
+}
+
+func writeMirrorRecord(dir string, names []string) error {
+	var (
+		name    = filepath.Join(dir, MirrorRecordFile)
+		tmpName = name + ".tmp"
+		content = ""
+	)
+	for _, pkg := range names {
+		content += pkg + "\n"
+	}
+	if err := ioutil.WriteFile(tmpName, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
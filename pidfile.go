@@ -0,0 +1,50 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// fails if the -pidfile 'name' names a process which is still running. a
+// stale file (the process is gone, or the content is garbage) is fine.
+func checkPidFile(name string) error {
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return nil
+	}
+	if process, err := os.FindProcess(pid); err == nil {
+		// signal 0 only checks for the process. EPERM: it exists, but
+		// belongs to somebody else
+		if err = process.Signal(syscall.Signal(0)); err == nil || err == syscall.EPERM {
+			return fmt.Errorf("%q: kellner is running already, pid %d", name, pid)
+		}
+	}
+	return nil
+}
+
+// writes the pid of this process to 'name'
+func writePidFile(name string) error {
+	tmpName := name + ".tmp"
+	if err := ioutil.WriteFile(tmpName, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
@@ -0,0 +1,17 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os/exec"
+
+// only the process itself is killed, see exec.CommandContext()
+func killOnCancel(cmd *exec.Cmd) {}
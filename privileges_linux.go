@@ -0,0 +1,64 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// switches to 'userName' and / or 'groupName' (names or numeric ids), eg.
+// once the listeners are bound to privileged ports. without 'groupName'
+// the primary group of 'userName' is used. the supplementary groups are
+// dropped.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, notId := strconv.Atoi(userName); err != nil && notId == nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return fmt.Errorf("-user: %v", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, notId := strconv.Atoi(groupName); err != nil && notId == nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return fmt.Errorf("-group: %v", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// the group first, without root privileges it can not be changed
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups(%d): %v", gid, err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid(%d): %v", gid, err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid(%d): %v", uid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// the reverse-proxies (-trusted-proxies) whose "X-Forwarded-For" and
+// "X-Forwarded-Proto" are believed, see RemoteAddr() and requestScheme()
+type TrustedProxies []*net.IPNet
+
+// parses a comma separated list of CIDRs (eg, "10.0.0.0/8,::1/128"), a
+// plain address is a network of its own
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0)
+	for _, elem := range splitList(list) {
+		if !strings.Contains(elem, "/") {
+			ip := net.ParseIP(elem)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", elem)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(elem)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (proxies TrustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reports if the peer of 'r' is one of the trusted proxies
+func (proxies TrustedProxies) trustsPeer(r *http.Request) bool {
+	if len(proxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	return err == nil && proxies.trusts(host)
+}
+
+// returns the address of the client 'r' originates from: r.RemoteAddr,
+// unless the peer is one of the trusted proxies. then "X-Forwarded-For" is
+// walked from the right (the entry added by the peer) to the left, the
+// first address not being a trusted proxy is the client. everything left
+// of it is what the client sent itself and might be forged.
+func (proxies TrustedProxies) RemoteAddr(r *http.Request) string {
+	if !proxies.trustsPeer(r) {
+		return r.RemoteAddr
+	}
+
+	forwarded := make([]string, 0)
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	client := ""
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break // garbage, do not look any further
+		}
+		client = addr
+		if !proxies.trusts(addr) {
+			break
+		}
+	}
+	if client == "" {
+		return r.RemoteAddr
+	}
+	return client
+}
@@ -0,0 +1,98 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected []string // the networks, nil: an error
+	}{
+		{"", []string{}},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}},
+		{"10.1.2.3/8, 192.168.1.1 ,::1", []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128"}},
+		{"fd00::/8", []string{"fd00::/8"}},
+		{"proxy.example.com", nil},
+		{"10.0.0.0/33", nil},
+		{"10.0.0.256", nil},
+	} {
+		proxies, err := ParseTrustedProxies(test.list)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("ParseTrustedProxies(%q): expected an error, got %v", test.list, proxies)
+			}
+			continue
+		}
+		got := make([]string, len(proxies))
+		for i, network := range proxies {
+			got[i] = network.String()
+		}
+		if err != nil || len(got) != len(test.expected) {
+			t.Errorf("ParseTrustedProxies(%q): got %v %v, expected %v", test.list, got, err, test.expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expected[i] {
+				t.Errorf("ParseTrustedProxies(%q): got %v, expected %v", test.list, got, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remoteAddr string
+		forwarded  []string // the X-Forwarded-For headers
+		expected   string
+	}{
+		// untrusted peers cannot spoof their address
+		{"192.0.2.1:1234", nil, "192.0.2.1:1234"},
+		{"192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1:1234"},
+		{"[2001:db8::1]:1234", []string{"198.51.100.7"}, "[2001:db8::1]:1234"},
+		// a trusted proxy
+		{"10.1.2.3:1234", nil, "10.1.2.3:1234"},
+		{"10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"[::1]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		// the entries left of the first untrusted one are forgeable
+		{"10.1.2.3:1234", []string{"203.0.113.9, 198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+		{"10.1.2.3:1234", []string{"203.0.113.9, 198.51.100.7", "10.9.9.9"}, "198.51.100.7"},
+		// proxies all the way: the leftmost one
+		{"10.1.2.3:1234", []string{"10.5.5.5, 10.9.9.9"}, "10.5.5.5"},
+		// garbage stops the walk
+		{"10.1.2.3:1234", []string{"unknown"}, "10.1.2.3:1234"},
+		{"10.1.2.3:1234", []string{"203.0.113.9, unknown, 10.9.9.9"}, "10.9.9.9"},
+		{"10.1.2.3:1234", []string{""}, "10.1.2.3:1234"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := proxies.RemoteAddr(r); got != test.expected {
+			t.Errorf("RemoteAddr(%s, %q): got %q, expected %q", test.remoteAddr, test.forwarded, got, test.expected)
+		}
+	}
+
+	// no -trusted-proxies: X-Forwarded-For is ignored
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if got := TrustedProxies(nil).RemoteAddr(r); got != r.RemoteAddr {
+		t.Errorf("RemoteAddr() without proxies: got %q, expected %q", got, r.RemoteAddr)
+	}
+}
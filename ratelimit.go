@@ -0,0 +1,111 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how many clients a RateLimiter keeps track of at most
+const rateLimitMaxClients = 10000
+
+// a token bucket per client (-rate, -burst): a client may make up to
+// 'Burst' requests at once, 'Rate' per second on average. the buckets of
+// the clients seen least recently are dropped once there are more than
+// 'MaxClients'. a bucket of an idle client is full anyway, so dropping it
+// changes nothing.
+type RateLimiter struct {
+	Rate       float64 // requests per second
+	Burst      int
+	MaxClients int
+	Proxies    TrustedProxies // the client behind them is limited, see rateLimitKey()
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element // of *tokenBucket
+	lru     *list.List               // the most recently used bucket in front
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time // of the last refill
+}
+
+func NewRateLimiter(rate float64, burst int, proxies TrustedProxies) *RateLimiter {
+	return &RateLimiter{
+		Rate:       rate,
+		Burst:      burst,
+		MaxClients: rateLimitMaxClients,
+		Proxies:    proxies,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// takes a token from the bucket of 'key', reports false if it is empty
+func (rl *RateLimiter) Allow(key string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	elem, ok := rl.buckets[key]
+	if ok {
+		rl.lru.MoveToFront(elem)
+	} else {
+		for rl.lru.Len() > 0 && rl.lru.Len() >= rl.MaxClients {
+			oldest := rl.lru.Back()
+			delete(rl.buckets, rl.lru.Remove(oldest).(*tokenBucket).key)
+		}
+		elem = rl.lru.PushFront(&tokenBucket{key: key, tokens: float64(rl.Burst), last: now})
+		rl.buckets[key] = elem
+	}
+
+	bucket := elem.Value.(*tokenBucket)
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens = math.Min(float64(rl.Burst), bucket.tokens+elapsed.Seconds()*rl.Rate)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// the client a request is accounted to: the client-id of its certificate,
+// the remote address otherwise (without the port, behind -trusted-proxies
+// the one of the actual client)
+func (rl *RateLimiter) rateLimitKey(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cert " + clientIdByName(&r.TLS.PeerCertificates[0].Subject)
+	}
+	addr := rl.Proxies.RemoteAddr(r)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "addr " + addr
+}
+
+// wraps 'handler': requests of a client exceeding the limit yield 429
+func (rl *RateLimiter) Limit(handler http.Handler) http.Handler {
+	retry := strconv.Itoa(int(math.Max(1, math.Ceil(1/rl.Rate))))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rl.Allow(rl.rateLimitKey(r), time.Now()) {
+			w.Header().Set("Retry-After", retry)
+			writeError(http.StatusTooManyRequests, w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
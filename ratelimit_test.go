@@ -0,0 +1,141 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := NewRateLimiter(2, 3, nil)
+	start := time.Unix(1600000000, 0)
+	for _, test := range []struct {
+		key      string
+		after    time.Duration // since 'start'
+		expected bool
+	}{
+		// the burst, then nothing
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, false},
+		// another client has a bucket of its own
+		{"b", 0, true},
+		// a token every 500ms
+		{"a", 499 * time.Millisecond, false},
+		{"a", 500 * time.Millisecond, true},
+		{"a", 500 * time.Millisecond, false},
+		// refilled up to the burst only
+		{"a", 10 * time.Second, true},
+		{"a", 10 * time.Second, true},
+		{"a", 10 * time.Second, true},
+		{"a", 10 * time.Second, false},
+		// a clock going backwards refills nothing
+		{"a", 9 * time.Second, false},
+	} {
+		if got := rl.Allow(test.key, start.Add(test.after)); got != test.expected {
+			t.Errorf("Allow(%q) after %v: got %v, expected %v", test.key, test.after, got, test.expected)
+		}
+	}
+}
+
+// the buckets of the clients seen least recently are dropped
+func TestRateLimiterMaxClients(t *testing.T) {
+	rl := NewRateLimiter(1, 1, nil)
+	rl.MaxClients = 2
+	now := time.Unix(1600000000, 0)
+	for _, test := range []struct {
+		key      string
+		expected bool
+	}{
+		{"a", true},
+		{"b", true},
+		{"a", false}, // "a" seen more recently than "b"
+		{"c", true},  // drops "b"
+		{"a", false},
+		{"b", true}, // a new bucket, drops "c"
+		{"c", true},
+	} {
+		if got := rl.Allow(test.key, now); got != test.expected {
+			t.Errorf("Allow(%q): got %v, expected %v", test.key, got, test.expected)
+		}
+		if len(rl.buckets) > rl.MaxClients || rl.lru.Len() != len(rl.buckets) {
+			t.Fatalf("Allow(%q): %d buckets, %d in the lru, expected at most %d", test.key, len(rl.buckets), rl.lru.Len(), rl.MaxClients)
+		}
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := NewRateLimiter(1, 1, proxies)
+	cert := testCertificate(t, pkix.Name{CommonName: "box-1"})
+	for _, test := range []struct {
+		r          *http.Request
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{httptest.NewRequest("GET", "/", nil), "192.0.2.1:1234", "", "addr 192.0.2.1"},
+		{httptest.NewRequest("GET", "/", nil), "[2001:db8::1]:1234", "", "addr 2001:db8::1"},
+		{httptest.NewRequest("GET", "/", nil), "192.0.2.1:1234", "198.51.100.7", "addr 192.0.2.1"},
+		{httptest.NewRequest("GET", "/", nil), "10.1.2.3:1234", "198.51.100.7", "addr 198.51.100.7"},
+		{clientRequest("/", cert), "10.1.2.3:1234", "198.51.100.7", "cert CN=box-1"},
+		{clientRequest("/", nil), "192.0.2.1:1234", "", "addr 192.0.2.1"},
+	} {
+		test.r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			test.r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := rl.rateLimitKey(test.r); got != test.expected {
+			t.Errorf("rateLimitKey(%s, %q): got %q, expected %q", test.remoteAddr, test.forwarded, got, test.expected)
+		}
+	}
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	for _, test := range []struct {
+		rate       float64
+		retryAfter string
+	}{
+		{2, "1"},
+		{0.25, "4"},
+	} {
+		handler := NewRateLimiter(test.rate, 2, nil).Limit(bodyHandler("feed"))
+		for i, expected := range []struct {
+			remoteAddr string
+			code       int
+		}{
+			{"192.0.2.1:1000", http.StatusOK},
+			{"192.0.2.1:1001", http.StatusOK},
+			{"192.0.2.1:1002", http.StatusTooManyRequests},
+			{"192.0.2.2:1000", http.StatusOK},
+		} {
+			r := httptest.NewRequest("GET", "/arm/Packages", nil)
+			r.RemoteAddr = expected.remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != expected.code {
+				t.Errorf("-rate %v, request %d from %s: got %d, expected %d", test.rate, i+1, expected.remoteAddr, w.Code, expected.code)
+			}
+			retryAfter := w.Header().Get("Retry-After")
+			if w.Code == http.StatusTooManyRequests && retryAfter != test.retryAfter {
+				t.Errorf("-rate %v: got Retry-After %q, expected %q", test.rate, retryAfter, test.retryAfter)
+			} else if w.Code == http.StatusOK && retryAfter != "" {
+				t.Errorf("-rate %v: got Retry-After %q on a 200", test.rate, retryAfter)
+			}
+		}
+	}
+}
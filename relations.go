@@ -0,0 +1,96 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "strings"
+
+// a package relation as found in "Depends", "Provides", "Conflicts" or
+// "Replaces", eg. "libc (>= 1.2.3)". the json field names are relied upon
+// by external tools, keep them stable.
+//
+// see https://www.debian.org/doc/debian-policy/ch-relationships.html
+type Relation struct {
+	Name    string `json:"name"`              // might carry an arch-qualifier, eg "python3:any"
+	Op      string `json:"op,omitempty"`      // one of <<, <=, =, >=, >> (or the obsolete <, >)
+	Version string `json:"version,omitempty"` // "" if not constrained
+}
+
+// the relations of a package, parsed from its control-fields
+type Relations struct {
+	Depends   [][]Relation `json:"depends,omitempty"` // each entry: the alternatives, "a | b"
+	Provides  []Relation   `json:"provides,omitempty"`
+	Conflicts []Relation   `json:"conflicts,omitempty"`
+	Replaces  []Relation   `json:"replaces,omitempty"`
+}
+
+func relationsOf(header map[string]string) Relations {
+	return Relations{
+		Depends:   parseDepends(header["Depends"]),
+		Provides:  parseRelations(header["Provides"]),
+		Conflicts: parseRelations(header["Conflicts"]),
+		Replaces:  parseRelations(header["Replaces"]),
+	}
+}
+
+// parses "a (>= 1), b | c" into [[a >= 1], [b, c]]
+func parseDepends(field string) [][]Relation {
+	var depends [][]Relation
+	for _, entry := range strings.Split(field, ",") {
+		var alternatives []Relation
+		for _, alternative := range strings.Split(entry, "|") {
+			if relation, ok := parseRelation(alternative); ok {
+				alternatives = append(alternatives, relation)
+			}
+		}
+		if len(alternatives) > 0 {
+			depends = append(depends, alternatives)
+		}
+	}
+	return depends
+}
+
+// parses "a (= 1), b" into [a = 1, b]
+func parseRelations(field string) []Relation {
+	var relations []Relation
+	for _, entry := range strings.Split(field, ",") {
+		if relation, ok := parseRelation(entry); ok {
+			relations = append(relations, relation)
+		}
+	}
+	return relations
+}
+
+// parses "name", "name (op version)" or "name(opversion)". a malformed
+// constraint is kept as the version, with "" as op. an arch-restriction
+// ("[amd64]") is ignored.
+func parseRelation(text string) (Relation, bool) {
+	if i := strings.IndexByte(text, '['); i != -1 {
+		text = text[:i]
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return Relation{}, false
+	}
+
+	open := strings.IndexByte(text, '(')
+	if open == -1 {
+		return Relation{Name: strings.Join(strings.Fields(text), " ")}, true
+	}
+	relation := Relation{Name: strings.TrimSpace(text[:open])}
+	constraint := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text[open+1:]), ")"))
+	for _, op := range []string{"<<", "<=", ">=", ">>", "=", "<", ">"} {
+		if strings.HasPrefix(constraint, op) {
+			relation.Op = op
+			constraint = constraint[len(op):]
+			break
+		}
+	}
+	relation.Version = strings.TrimSpace(constraint)
+	return relation, relation.Name != ""
+}
@@ -0,0 +1,132 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// signs content with the gpg-key 'KeyId' by piping it through 'gpg'
+type GpgSigner struct {
+	KeyId string
+}
+
+// create a detached, ascii-armored signature of 'r' (Release.gpg)
+func (signer *GpgSigner) DetachSign(w io.Writer, r io.Reader) error {
+	return signer.pipe(w, r, "--detach-sign")
+}
+
+// create a clearsigned variant of 'r' (InRelease)
+func (signer *GpgSigner) ClearSign(w io.Writer, r io.Reader) error {
+	return signer.pipe(w, r, "--clearsign")
+}
+
+func (signer *GpgSigner) pipe(w io.Writer, r io.Reader, mode string) error {
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.Command("gpg", "--batch", "--yes", "--armor", "--local-user", signer.KeyId, mode)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gpg %s with key %q: %v: %s", mode, signer.KeyId, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// verifies 'sig', a detached signature (binary or ascii-armored) of the
+// file 'fileName', against the keys in the keyring of the user running
+// kellner, the one holding the -gpg-key. returns the fingerprint of the key
+// which made the signature. expired or revoked keys do not count.
+func GpgVerifyDetached(sig []byte, fileName string) (string, error) {
+	sigFile, err := ioutil.TempFile("", ".kellner-sig-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(sigFile.Name())
+	_, err = sigFile.Write(sig)
+	if cerr := sigFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	cmd := exec.Command("gpg", "--batch", "--status-fd", "1", "--verify", sigFile.Name(), fileName)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+
+	// see doc/DETAILS of gnupg: GOODSIG only for a good signature of a
+	// valid key, VALIDSIG carries the fingerprint
+	var good bool
+	var fingerprint string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "GOODSIG":
+			good = true
+		case "VALIDSIG":
+			fingerprint = fields[2]
+		}
+	}
+	if err == nil && good && fingerprint != "" {
+		return fingerprint, nil
+	} else if err == nil {
+		err = fmt.Errorf("no good signature")
+	}
+	return "", fmt.Errorf("gpg --verify: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+}
+
+// a generated index file, eg. listed in the Release file
+type indexFile struct {
+	name    string
+	content []byte
+}
+
+// write a Release file, as described in
+// https://wiki.debian.org/RepositoryFormat#A.22Release.22_files
+// listing the md5/sha1/sha256 and the sizes of 'files'
+func ReleaseTo(w io.Writer, date time.Time, files []indexFile) {
+
+	fmt.Fprintf(w, "Date: %s\n", date.UTC().Format(time.RFC1123))
+
+	sums := []struct {
+		field  string
+		hasher func() hash.Hash
+	}{
+		{"MD5Sum", md5.New},
+		{"SHA1", sha1.New},
+		{"SHA256", sha256.New},
+	}
+
+	for _, sum := range sums {
+		fmt.Fprintf(w, "%s:\n", sum.field)
+		for _, file := range files {
+			h := sum.hasher()
+			h.Write(file.content)
+			fmt.Fprintf(w, " %s %d %s\n", hex.EncodeToString(h.Sum(nil)), len(file.content), file.name)
+		}
+	}
+}
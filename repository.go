@@ -0,0 +1,509 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a directory tree served below the url-path 'Prefix' ("" for "/")
+type Mount struct {
+	Dir    string
+	Prefix string
+}
+
+// parses "dir" or "dir:/prefix"
+func ParseMount(value string) (Mount, error) {
+	mount := Mount{Dir: value}
+	if i := strings.LastIndexByte(value, ':'); i != -1 && strings.HasPrefix(value[i+1:], "/") {
+		mount.Dir, mount.Prefix = value[:i], path.Clean(value[i+1:])
+		if mount.Prefix == "/" {
+			mount.Prefix = ""
+		}
+	}
+	if mount.Dir == "" {
+		return mount, fmt.Errorf("missing directory in %q", value)
+	}
+	return mount, nil
+}
+
+func (mount Mount) String() string {
+	if mount.Prefix == "" {
+		return mount.Dir
+	}
+	return mount.Dir + ":" + mount.Prefix
+}
+
+// checks that no two 'mounts' are served at the same url-path: each prefix
+// is used once, and none is the url-path of a directory below another
+// mount (eg. "-root r1 -root r2:/arm" with a directory r1/arm).
+func CheckMounts(mounts []Mount) error {
+	for i, mount := range mounts {
+		for _, other := range mounts[:i] {
+			if mount.Prefix == other.Prefix {
+				return fmt.Errorf("prefix %q used more than once", mount.Prefix+"/")
+			}
+		}
+		for j, other := range mounts {
+			if i == j || !strings.HasPrefix(mount.Prefix, other.Prefix+"/") {
+				continue
+			}
+			dir := filepath.Join(other.Dir, filepath.FromSlash(mount.Prefix[len(other.Prefix):]))
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return fmt.Errorf("prefix %q of %q is the url-path of %q as well", mount.Prefix+"/", mount.Dir, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// the Repository is the set of directory trees given via 'Roots'. each
+// directory containing packages is a Feed, all the other directories are
+// served as they are. Scan() walks the trees, (re)builds all feeds and swaps
+// the muxer serving them at once.
+type Repository struct {
+	Roots      []Mount
+	NewFeed    func(dir, prefix string) *Feed // creates the feed for 'dir'
+	Watch      bool                           // watch newly found feeds
+	WatchDelay time.Duration
+	SyncMarker string // optional, see Rescan()
+
+	FollowSymlinks bool // walk into symlinked directories, see walkDirs()
+	MaxDepth       int  // of the directories below a root, -1: unlimited
+	ApacheListing  bool // list non-package directories like apache, see ApacheListing()
+
+	Aggregate   bool         // serve "/Packages" listing the packages of all feeds
+	Compressors []Compressor // of the aggregated index
+	Duplicates  *Duplicates  // optional, searched after each scan
+
+	Progress time.Duration // interval of the progress reports of Scan(), 0: none
+	ScanOpts *ScanOptions  // optional, its packages are counted in the reports, its Cache is saved
+
+	// bounds how many directories Scan() builds at once, nil: unbounded.
+	// not ScanOpts.Workers: Feed.Build() hires those for its packages and
+	// would wait for itself.
+	Builders *WorkerPool
+
+	scanning sync.Mutex // serializes Scan()
+
+	mu      sync.RWMutex
+	mux     *http.ServeMux
+	feeds   map[string]*Feed // by directory, kept between scans
+	indices []string         // url-paths of the feeds containing packages
+	ready   bool             // the first Scan() is done
+	marker  string           // state of 'SyncMarker' at the last Scan()
+
+	aggregate *aggregateIndex
+}
+
+// walks 'repo.Roots' and rebuilds the index of every directory found.
+// the feeds of directories which were already known are rebuilt in place
+// (keeping their watches), new directories get a new Feed. the watches of
+// directories gone are stopped.
+func (repo *Repository) Scan() {
+
+	repo.scanning.Lock()
+	defer repo.scanning.Unlock()
+
+	var (
+		startTime = time.Now()
+		mux       = http.NewServeMux()
+		feeds     = make(map[string]*Feed)
+		indices   = make([]string, 0)
+	)
+
+	// during the initial scan there is nothing to serve yet: publish the
+	// new muxer right away, each feed becomes available as soon as it is
+	// built. later scans swap the muxer once they are done.
+	repo.mu.Lock()
+	known := repo.feeds
+	if repo.mux == nil {
+		repo.mux = mux
+	}
+	if repo.Aggregate && repo.aggregate == nil {
+		repo.aggregate = &aggregateIndex{repo: repo, compressors: repo.Compressors}
+	}
+	repo.mu.Unlock()
+
+	if repo.aggregate != nil {
+		for _, name := range repo.aggregate.names() {
+			mux.Handle("/"+name, repo.aggregate)
+		}
+	}
+
+	// collect the directories first, then build them concurrently. the
+	// packages of all feeds share the workers of ScanOptions, so this
+	// mostly overlaps the reading of directories and the creation of
+	// the index files.
+	type dir struct {
+		path    string
+		muxPath string
+		isRoot  bool // the top directory of the mount
+	}
+	dirs := make([]dir, 0)
+
+	// two directories served at the same url-path would make the ServeMux
+	// panic. CheckMounts() catches most of these at startup, the trees
+	// might have changed since: the first one walked wins.
+	servedBy := make(map[string]string)
+	if repo.aggregate != nil {
+		for _, name := range repo.aggregate.names() {
+			servedBy["/"+name] = "the aggregated index"
+		}
+	}
+
+	for _, mount := range repo.Roots {
+		mount := mount
+		walkDirs(mount.Dir, repo.FollowSymlinks, repo.MaxDepth, func(path string) {
+			muxPath := mount.Prefix + filepath.ToSlash(path[len(mount.Dir):])
+			if muxPath == "" {
+				muxPath = "/"
+			}
+			if other, ok := servedBy[muxPath]; ok {
+				logErrorf("%q and %q are both served at %q, skipping %q", other, path, muxPath, path)
+				return
+			}
+			servedBy[muxPath] = path
+			dirs = append(dirs, dir{path, muxPath, path == mount.Dir})
+		})
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results sync.Mutex // guards mux, feeds and indices
+		done    atomic.Int64
+	)
+	stopProgress := repo.reportProgress(len(dirs), &done)
+	for _, d := range dirs {
+		if repo.Builders != nil {
+			repo.Builders.Hire()
+		}
+		wg.Add(1)
+		go func(path, muxPath string, isRoot bool) {
+			defer wg.Done()
+			defer done.Add(1)
+			if repo.Builders != nil {
+				defer repo.Builders.Release()
+			}
+
+			feed, isKnown := known[path]
+			if !isKnown {
+				feed = repo.NewFeed(path, muxPath)
+			}
+
+			if err := feed.Build(); err != nil {
+				logErrorf("%v", err)
+				return
+			}
+
+			// non-package directories. the top directory of a mount also
+			// serves everything below it which is not a feed. with a
+			// Mirror, every directory below "/" is a feed, packages might
+			// be fetched into it.
+			if len(feed.Packages().Entries) == 0 && (feed.Mirror == nil || muxPath == "/") {
+				results.Lock()
+				feeds[path] = feed
+				if isRoot && muxPath != "/" {
+					mux.Handle(muxPath+"/", http.StripPrefix(muxPath, repo.fileServer(path)))
+				} else {
+					mux.Handle(muxPath, repo.fileServer(path))
+				}
+				results.Unlock()
+				return
+			}
+
+			if repo.Watch && !feed.Watching() {
+				if err := feed.Watch(repo.WatchDelay); err != nil {
+					logErrorf("%v", err)
+				}
+			}
+
+			results.Lock()
+			feeds[path] = feed
+			mux.Handle(muxPath+"/", feed)
+			indices = append(indices, muxPath)
+			results.Unlock()
+		}(d.path, d.muxPath, d.isRoot)
+	}
+	wg.Wait()
+	stopProgress()
+	sort.Strings(indices)
+
+	// feeds of the previous scan which are gone (or failed to build) are
+	// not served anymore, nor watched
+	for path, feed := range known {
+		if _, ok := feeds[path]; !ok {
+			feed.StopWatching()
+		}
+	}
+
+	repo.mu.Lock()
+	repo.mux, repo.feeds, repo.indices = mux, feeds, indices
+	repo.ready = true
+	repo.mu.Unlock()
+
+	if repo.Duplicates != nil {
+		repo.Duplicates.current() // logs new duplicates
+	}
+	if repo.ScanOpts != nil {
+		saveCache(repo.ScanOpts.Cache) // once for all the feeds
+	}
+
+	logInfof("processed %d package-folders in %s", len(indices), time.Since(startTime))
+}
+
+// logs every 'Progress' how many of the 'total' directories of a Scan()
+// are 'done' and how many packages were indexed meanwhile, until the
+// returned func is called. a scan done within 'Progress' logs nothing.
+func (repo *Repository) reportProgress(total int, done *atomic.Int64) (stop func()) {
+	if repo.Progress <= 0 {
+		return func() {}
+	}
+	var indexedBefore int64
+	if repo.ScanOpts != nil {
+		indexedBefore = repo.ScanOpts.Indexed()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(repo.Progress)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-ticker.C:
+			}
+			if repo.ScanOpts != nil {
+				logInfof("scan in progress: %d of %d directories done, %d packages indexed so far",
+					done.Load(), total, repo.ScanOpts.Indexed()-indexedBefore)
+			} else {
+				logInfof("scan in progress: %d of %d directories done", done.Load(), total)
+			}
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// like Scan(), but if 'SyncMarker' is set the repository is only scanned
+// if the marker file changed (mtime, size or content) since the last scan.
+//
+// this allows several kellner instances to serve the same (shared) tree:
+// the publisher first puts all the packages in place and then touches the
+// marker. the instances rescan the tree only after that, so none of them
+// picks up a half-published state the others do not see, and all of them
+// serve the state the marker points to.
+//
+// reports if the repository was scanned.
+func (repo *Repository) Rescan() bool {
+	if repo.SyncMarker == "" {
+		repo.Scan()
+		return true
+	}
+
+	marker, err := readSyncMarker(repo.SyncMarker)
+	if err != nil {
+		logErrorf("reading -sync-marker: %v", err)
+		return false
+	}
+
+	repo.mu.RLock()
+	unchanged := repo.ready && marker == repo.marker
+	repo.mu.RUnlock()
+	if unchanged {
+		return false
+	}
+
+	logInfof("sync-marker %q changed, rescanning %v", repo.SyncMarker, repo.Roots)
+	repo.Scan()
+
+	repo.mu.Lock()
+	repo.marker = marker
+	repo.mu.Unlock()
+	return true
+}
+
+// calls Rescan() every 'interval'
+func (repo *Repository) PollSyncMarker(interval time.Duration) {
+	for range time.Tick(interval) {
+		repo.Rescan()
+	}
+}
+
+// returns the state of the marker-file 'name'. a missing marker
+// is a valid state as well.
+func readSyncMarker(name string) (string, error) {
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %d %s", fi.ModTime().UnixNano(), fi.Size(), content), nil
+}
+
+// returns the url-paths of all feeds containing packages
+func (repo *Repository) Indices() []string {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return repo.indices
+}
+
+// reports if the initial Scan() has completed
+func (repo *Repository) Ready() bool {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return repo.ready
+}
+
+func (repo *Repository) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo.mu.RLock()
+	mux, ready := repo.mux, repo.ready
+	repo.mu.RUnlock()
+	if mux == nil {
+		writeError(http.StatusServiceUnavailable, w, r)
+		return
+	}
+	// the initial scan is in progress: the requested feed might just not
+	// be built yet. (the top directory of a mount catches everything below
+	// it.)
+	if _, pattern := mux.Handler(r); !ready && (pattern == "" || repo.isMountPattern(pattern) && r.URL.Path != pattern) {
+		writeError(http.StatusServiceUnavailable, w, r)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// reports if 'pattern' is the one of the top directory of a mount
+func (repo *Repository) isMountPattern(pattern string) bool {
+	for _, mount := range repo.Roots {
+		if pattern == mount.Prefix+"/" {
+			return true
+		}
+	}
+	return false
+}
+
+// serves the non-package directory 'dir'
+func (repo *Repository) fileServer(dir string) http.Handler {
+	if repo.ApacheListing {
+		return withFileTypes(ApacheListing(dir))
+	}
+	return withFileTypes(http.FileServer(http.Dir(dir)))
+}
+
+// calls 'fn' for 'root' and every directory below it. filepath.Walk does
+// not follow symlinks (a symlinked directory is reported as a
+// non-directory), so cyclic links cannot make the walk loop.
+//
+// with 'follow', symlinks to directories are followed as well, but only
+// if they point into 'root'. the real paths of the directories walked into
+// are tracked: a link back to one of them is a loop and skipped with a
+// warning. 'fn' gets the path via the link.
+//
+// with 'maxDepth' >= 0, directories more than 'maxDepth' levels below
+// 'root' are not walked into (0: only 'root' itself).
+func walkDirs(root string, follow bool, maxDepth int, fn func(path string)) {
+	if !follow {
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil
+			}
+			fn(path)
+			if maxDepth >= 0 && dirDepth(root, path) >= maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		return
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		logErrorf("%v", err)
+		return
+	}
+	walking := make(map[string]bool) // the real paths of 'path' and its parents
+
+	var walk func(path, real string, depth int)
+	walk = func(path, real string, depth int) {
+		if walking[real] {
+			logWarnf("not following %q, it loops back to %q", path, real)
+			return
+		}
+		walking[real] = true
+		defer delete(walking, real)
+		fn(path)
+		if maxDepth >= 0 && depth >= maxDepth {
+			return
+		}
+
+		dir, err := os.Open(path)
+		if err != nil {
+			logErrorf("%v", err)
+			return
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			logErrorf("%v", err)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			child := filepath.Join(path, name)
+			fi, err := os.Lstat(child)
+			if err != nil {
+				continue
+			}
+			childReal := filepath.Join(real, name)
+			if fi.Mode()&os.ModeSymlink != 0 {
+				target, err := filepath.EvalSymlinks(child)
+				if err != nil {
+					continue // dangling
+				}
+				if fi, err = os.Stat(target); err != nil || !fi.IsDir() {
+					continue
+				}
+				if rel, err := filepath.Rel(realRoot, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+					logWarnf("not following %q, it points outside of %q", child, root)
+					continue
+				}
+				childReal = target
+			} else if !fi.IsDir() {
+				continue
+			}
+			walk(child, childReal, depth+1)
+		}
+	}
+	walk(root, realRoot, 0)
+}
+
+// returns how many levels 'path' is below 'root', 0 for 'root' itself
+func dirDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
@@ -0,0 +1,136 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a feed is served as soon as it is built, while another one is still
+// being built: reading its "package", a fifo, blocks until it is opened
+// for writing.
+func TestScanServesEarlyFeeds(t *testing.T) {
+	root := mkdirs(t, "fast", "slow")
+	writeIpk(t, filepath.Join(root, "fast"), "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	fifo := filepath.Join(root, "slow", "bar_1.0_arm.ipk")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := testRepository(Mount{root, ""})
+	scanned := make(chan struct{})
+	go func() {
+		repo.Scan()
+		close(scanned)
+	}()
+	var opened sync.Once
+	unblock := func() {
+		opened.Do(func() {
+			if w, err := os.OpenFile(fifo, os.O_WRONLY, 0); err == nil {
+				w.Close()
+			}
+		})
+	}
+	defer func() {
+		unblock()
+		<-scanned
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for getStatus(repo, "/fast/Packages") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("/fast/Packages is not served while /slow is built")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if repo.Ready() {
+		t.Errorf("Ready(): expected false while /slow is built")
+	}
+	if code := getStatus(repo, "/slow/Packages"); code != http.StatusServiceUnavailable {
+		t.Errorf("GET /slow/Packages: got %d while it is built, expected 503", code)
+	}
+
+	unblock()
+	select {
+	case <-scanned:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scan() did not finish")
+	}
+	if !repo.Ready() {
+		t.Errorf("Ready(): expected true after the scan")
+	}
+}
+
+// the inotify descriptors open in this process
+func inotifyFds(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	n := 0
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && target == "anon_inode:inotify" {
+			n++
+		}
+	}
+	return n
+}
+
+// a feed gone since the previous scan is not watched anymore
+func TestScanStopsWatchingGoneFeeds(t *testing.T) {
+	root := mkdirs(t, "arm", "mips")
+	for _, arch := range []string{"arm", "mips"} {
+		writeIpk(t, filepath.Join(root, arch), "foo_1.0_"+arch+".ipk", testControl("foo", "1.0", arch))
+	}
+
+	before := inotifyFds(t)
+	repo := testRepository(Mount{root, ""})
+	repo.Watch, repo.WatchDelay = true, 10*time.Millisecond
+	repo.Scan()
+	feeds := make(map[string]*Feed)
+	for _, feed := range repo.Feeds() {
+		feeds[filepath.Base(feed.Dir)] = feed
+	}
+	arm, mips := feeds["arm"], feeds["mips"]
+	if arm == nil || mips == nil || !arm.Watching() || !mips.Watching() {
+		t.Fatalf("expected /arm and /mips to be watched, got %v", feeds)
+	}
+	defer arm.StopWatching()
+	if got := inotifyFds(t) - before; got != 2 {
+		t.Errorf("got %d inotify fds after the scan, expected 2", got)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "mips")); err != nil {
+		t.Fatal(err)
+	}
+	repo.Scan()
+	if mips.Watching() {
+		t.Errorf("/mips is gone but still watched")
+	}
+	if !arm.Watching() {
+		t.Errorf("/arm is not watched anymore")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for inotifyFds(t)-before != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d inotify fds after /mips is gone, expected 1", inotifyFds(t)-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,306 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// creates the directories 'dirs' below a new temporary directory
+func mkdirs(t *testing.T, dirs ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestCheckMounts(t *testing.T) {
+	root := mkdirs(t, "r1/arm", "r2", "r3")
+	r1, r2, r3 := filepath.Join(root, "r1"), filepath.Join(root, "r2"), filepath.Join(root, "r3")
+
+	for _, test := range []struct {
+		mounts []Mount
+		ok     bool
+	}{
+		{[]Mount{{r1, ""}}, true},
+		{[]Mount{{r1, ""}, {r2, "/mips"}}, true},
+		{[]Mount{{r1, "/a"}, {r2, "/b"}, {r3, "/a/b"}}, true},
+		{[]Mount{{r1, ""}, {r2, ""}}, false},
+		{[]Mount{{r1, "/x"}, {r2, "/x"}}, false},
+		{[]Mount{{r1, ""}, {r2, "/arm"}}, false},
+		{[]Mount{{r2, "/arm"}, {r1, ""}}, false},
+		{[]Mount{{r1, "/x"}, {r2, "/x/arm"}}, false},
+	} {
+		if err := CheckMounts(test.mounts); (err == nil) != test.ok {
+			t.Errorf("CheckMounts(%v): got %v, expected ok=%v", test.mounts, err, test.ok)
+		}
+	}
+}
+
+func testRepository(roots ...Mount) *Repository {
+	opts := &ScanOptions{Workers: NewWorkerPool(2)}
+	return &Repository{
+		Roots:    roots,
+		MaxDepth: -1,
+		NewFeed: func(dir, prefix string) *Feed {
+			feed := testFeed(dir, prefix)
+			feed.ScanOpts = opts
+			return feed
+		},
+		ScanOpts: opts,
+	}
+}
+
+// the trees changed after CheckMounts(): a directory of one root is served
+// at the prefix of another. the first one walked wins, Scan() must not panic.
+func TestScanOverlappingRoots(t *testing.T) {
+	root := mkdirs(t, "r1/arm", "r2/sub")
+	for name, content := range map[string]string{"r1/arm/one.txt": "r1", "r2/two.txt": "r2", "r2/sub/three.txt": "r2"} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := testRepository(Mount{filepath.Join(root, "r1"), ""}, Mount{filepath.Join(root, "r2"), "/arm"})
+	repo.Scan()
+
+	for _, test := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/arm/one.txt", http.StatusOK, "r1"}, // r1/arm is walked first
+		{"/arm/two.txt", http.StatusNotFound, ""},
+		{"/arm/sub/three.txt", http.StatusNotFound, ""}, // served by the root of r2
+	} {
+		w := httptest.NewRecorder()
+		repo.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("GET %s: got %d %q, expected %d %q", test.path, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+}
+
+// with a single builder and a single worker for the packages every
+// directory is built after another: Feed.Build() must not wait for a
+// worker held by Scan() itself.
+func TestScanBoundedBuilders(t *testing.T) {
+	archs := []string{"arm", "mips", "x86", "ppc", "riscv"}
+	root := mkdirs(t, archs...)
+	for _, arch := range archs {
+		writeIpk(t, filepath.Join(root, arch), "foo_1.0_"+arch+".ipk", testControl("foo", "1.0", arch))
+	}
+
+	repo := testRepository(Mount{root, ""})
+	repo.ScanOpts.Workers.Resize(1)
+	repo.Builders = NewWorkerPool(1)
+
+	scanned := make(chan struct{})
+	go func() {
+		repo.Scan()
+		close(scanned)
+	}()
+	select {
+	case <-scanned:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scan() did not finish")
+	}
+	if indices := repo.Indices(); len(indices) != len(archs) {
+		t.Errorf("got the feeds %q, expected %d", indices, len(archs))
+	}
+}
+
+func TestRescanSyncMarker(t *testing.T) {
+	root := mkdirs(t, "arm")
+	marker := filepath.Join(t.TempDir(), "marker")
+	repo := testRepository(Mount{root, ""})
+	repo.SyncMarker = marker
+
+	previous := ""
+	for _, test := range []struct {
+		marker  string // "": missing
+		scanned bool
+	}{
+		{"", true}, // the first scan, whatever the marker
+		{"", false},
+		{"1", true},
+		{"1", false}, // not touched
+		{"22", true},
+	} {
+		if test.marker != previous {
+			writeTestFile(t, marker, test.marker)
+			previous = test.marker
+		}
+		if scanned := repo.Rescan(); scanned != test.scanned {
+			t.Errorf("Rescan() with the marker %q: got %v, expected %v", test.marker, scanned, test.scanned)
+		}
+	}
+
+	repo.SyncMarker = ""
+	if !repo.Rescan() {
+		t.Errorf("Rescan() without a marker: expected a scan")
+	}
+}
+
+// two instances serving the same tree only pick up what was published
+// before the marker was touched
+func TestSyncMarkerInstances(t *testing.T) {
+	root := mkdirs(t, "arm")
+	marker := filepath.Join(t.TempDir(), "marker")
+	instances := []*Repository{testRepository(Mount{root, ""}), testRepository(Mount{root, ""})}
+	for _, repo := range instances {
+		repo.SyncMarker = marker
+		repo.Rescan()
+	}
+
+	// published, the marker is not touched yet
+	writeIpk(t, filepath.Join(root, "arm"), "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	for i, repo := range instances {
+		repo.Rescan()
+		if n := len(repo.Indices()); n != 0 {
+			t.Errorf("instance %d: got %d feeds before the marker changed, expected 0", i, n)
+		}
+	}
+
+	writeTestFile(t, marker, "1")
+	for i, repo := range instances {
+		if !repo.Rescan() {
+			t.Errorf("instance %d: did not rescan after the marker changed", i)
+		}
+		if indices := repo.Indices(); len(indices) != 1 || indices[0] != "/arm" {
+			t.Errorf("instance %d: got the feeds %q, expected [/arm]", i, indices)
+		}
+	}
+}
+
+// creates the symlinks 'links' (name: target) below 'root'
+func symlinks(t *testing.T, root string, links map[string]string) {
+	t.Helper()
+	for name, target := range links {
+		if err := os.Symlink(filepath.FromSlash(target), filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWalkDirs(t *testing.T) {
+	tmp := mkdirs(t, "root/a/b", "outside")
+	root := filepath.Join(tmp, "root")
+	symlinks(t, tmp, map[string]string{
+		"root/link-a":   "a",
+		"root/a/b/loop": "../..",
+		"root/a/self":   ".",
+		"root/out":      "../outside",
+		"root/abs-out":  filepath.Join(tmp, "outside"),
+		"root/dangling": "missing",
+	})
+	if err := os.WriteFile(filepath.Join(tmp, "outside", "foo.ipk"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	symlinks(t, tmp, map[string]string{"root/a/foo.ipk": "../../outside/foo.ipk"})
+
+	for _, test := range []struct {
+		follow   bool
+		expected []string
+	}{
+		{false, []string{"", "a", "a/b"}},
+		// the loops, the links out of the root and to files are skipped
+		{true, []string{"", "a", "a/b", "link-a", "link-a/b"}},
+	} {
+		walked := []string{}
+		walkDirs(root, test.follow, -1, func(path string) {
+			rel, _ := filepath.Rel(root, path)
+			walked = append(walked, strings.TrimPrefix(filepath.ToSlash(rel), "."))
+		})
+		if !reflect.DeepEqual(walked, test.expected) {
+			t.Errorf("walkDirs(follow: %v): got %q, expected %q", test.follow, walked, test.expected)
+		}
+	}
+}
+
+// a symlinked directory is served at the path via the link
+func TestScanFollowSymlinks(t *testing.T) {
+	tmp := mkdirs(t, "root/arm", "outside")
+	root := filepath.Join(tmp, "root")
+	writeIpk(t, filepath.Join(root, "arm"), "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+	writeIpk(t, filepath.Join(tmp, "outside"), "bar_1.0_arm.ipk", testControl("bar", "1.0", "arm"))
+	symlinks(t, tmp, map[string]string{"root/armv7": "arm", "root/bar": "../outside"})
+
+	for _, test := range []struct {
+		follow bool
+		codes  map[string]int
+	}{
+		{false, map[string]int{"/arm/Packages": http.StatusOK, "/armv7/Packages": http.StatusNotFound, "/bar/Packages": http.StatusNotFound}},
+		{true, map[string]int{"/arm/Packages": http.StatusOK, "/armv7/Packages": http.StatusOK, "/bar/Packages": http.StatusNotFound}},
+	} {
+		repo := testRepository(Mount{root, ""})
+		repo.FollowSymlinks = test.follow
+		repo.Scan()
+		for path, code := range test.codes {
+			if got := getStatus(repo, path); got != code {
+				t.Errorf("follow: %v, GET %s: got %d, expected %d", test.follow, path, got, code)
+			}
+		}
+	}
+}
+
+// a feed below another one is a feed on its own, the Filename fields are
+// relative to the directory of each
+func TestScanNestedFeeds(t *testing.T) {
+	for _, test := range []struct {
+		rootPackage bool
+		prefix      string
+		filenames   map[string][]string // by feed
+	}{
+		{false, "", map[string][]string{"/feed/sub": {"x_1.0_arm.ipk"}}},
+		{true, "", map[string][]string{"/feed": {"y_1.0_arm.ipk"}, "/feed/sub": {"x_1.0_arm.ipk"}}},
+		{true, "/dist", map[string][]string{"/dist/feed": {"y_1.0_arm.ipk"}, "/dist/feed/sub": {"x_1.0_arm.ipk"}}},
+	} {
+		root := mkdirs(t, "feed/sub")
+		writeIpk(t, filepath.Join(root, "feed", "sub"), "x_1.0_arm.ipk", testControl("x", "1.0", "arm"))
+		if test.rootPackage {
+			writeIpk(t, filepath.Join(root, "feed"), "y_1.0_arm.ipk", testControl("y", "1.0", "arm"))
+		}
+
+		repo := testRepository(Mount{root, test.prefix})
+		repo.Scan()
+		for feed, expected := range test.filenames {
+			var filenames []string
+			for _, line := range strings.Split(string(getBody(t, repo, feed+"/Packages")), "\n") {
+				if strings.HasPrefix(line, "Filename: ") {
+					filenames = append(filenames, strings.TrimPrefix(line, "Filename: "))
+				}
+			}
+			if !reflect.DeepEqual(filenames, expected) {
+				t.Errorf("package at the root: %v, GET %s/Packages: got the Filenames %q, expected %q", test.rootPackage, feed, filenames, expected)
+			}
+			for _, filename := range expected {
+				if got := getStatus(repo, feed+"/"+filename); got != http.StatusOK {
+					t.Errorf("package at the root: %v, GET %s/%s: got %d", test.rootPackage, feed, filename, got)
+				}
+			}
+		}
+		if !test.rootPackage {
+			if got := getStatus(repo, "/feed/Packages"); got != http.StatusNotFound {
+				t.Errorf("no package at the root: GET /feed/Packages: got %d, expected %d", got, http.StatusNotFound)
+			}
+		}
+	}
+}
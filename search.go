@@ -0,0 +1,69 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// a package found by /search. the json field names are relied upon by
+// external tools, keep them stable.
+type searchResult struct {
+	Feed         string `json:"feed"` // prefix of the feed
+	Name         string `json:"name"` // filename of the .ipk
+	Package      string `json:"package"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	Size         int64  `json:"size"`
+}
+
+// answers /search?q=substr&arch=... with a json-array of the packages of
+// all feeds of 'repo' whose name contains 'q' (ignoring the case),
+// optionally only those of architecture 'arch'. the results are sorted
+// by feed and filename.
+func searchHandler(repo *Repository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !repo.Ready() {
+			writeError(http.StatusServiceUnavailable, w, r)
+			return
+		}
+
+		var (
+			query   = strings.ToLower(r.URL.Query().Get("q"))
+			arch    = r.URL.Query().Get("arch")
+			results = make([]searchResult, 0)
+		)
+		for _, feed := range repo.Feeds() {
+			packages := feed.Packages()
+			for _, name := range packages.SortedNames() {
+				ipkg := packages.Entries[name]
+				if !strings.Contains(strings.ToLower(ipkg.Header["Package"]), query) {
+					continue
+				}
+				if arch != "" && ipkg.Header["Architecture"] != arch {
+					continue
+				}
+				results = append(results, searchResult{
+					Feed:         feed.Prefix,
+					Name:         name,
+					Package:      ipkg.Header["Package"],
+					Version:      ipkg.Header["Version"],
+					Architecture: ipkg.Header["Architecture"],
+					Size:         ipkg.FileInfo.Size(),
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(results)
+	})
+}
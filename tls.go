@@ -13,7 +13,6 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 
 	// enforce linking of several crypto-hashes
@@ -26,6 +25,7 @@ type tlsOptions struct {
 	certFileName      string
 	clientCasFileName string
 	requireClientCert bool
+	crl               *CRL // optional, rejects revoked client-certs
 }
 
 func initTLS(listener net.Listener, opts *tlsOptions) (net.Listener, error) {
@@ -64,19 +64,26 @@ func initTLS(listener net.Listener, opts *tlsOptions) (net.Listener, error) {
 			return listener, fmt.Errorf("adding ca-certs from %q to the pool failed.", opts.clientCasFileName)
 		}
 
-		log.Printf("added %d certs from %q to ca-certs", len(tlsConfig.ClientCAs.Subjects()), opts.clientCasFileName)
+		logInfof("added %d certs from %q to ca-certs", len(tlsConfig.ClientCAs.Subjects()), opts.clientCasFileName)
 	}
 
+	// NOTE: the presence of a client-cert is enforced by requireClientCert()
+	// on the http-level, otherwise unauthenticated paths like /healthz
+	// would not be reachable. a given cert is still verified here.
 	if opts.requireClientCert {
-		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		tlsConfig.ClientAuth = tls.RequestClientCert
 
 		// user gave a list of client-cas. this indicates that she wants
 		// to check the http-client-certs
 		if tlsConfig.ClientCAs != nil {
-			log.Println("tls.RequireAndVerifyClientCert")
-			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			logDebugf("tls.VerifyClientCertIfGiven")
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 		}
 	}
 
+	if opts.crl != nil {
+		tlsConfig.VerifyPeerCertificate = opts.crl.VerifyPeerCertificate
+	}
+
 	return tls.NewListener(listener, tlsConfig), nil
 }
@@ -0,0 +1,117 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exports a span per request via OTLP/HTTP (-otel-endpoint)
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// returns the Tracer exporting to 'endpoint', eg. "http://localhost:4318",
+// nil if it is empty
+func NewTracer(endpoint string) (*Tracer, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("expected a http:// or https:// url, got %q", endpoint)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return newTracer(sdktrace.NewBatchSpanProcessor(exporter)), nil
+}
+
+func newTracer(processor sdktrace.SpanProcessor) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "kellner"),
+			attribute.String("service.version", VERSION),
+		)),
+	)
+	return &Tracer{provider: provider, tracer: provider.Tracer("kellner")}
+}
+
+// wraps 'handler': each request gets a span carrying its route, status,
+// the bytes written and the client-id (of the certificate at 'certDepth',
+// see logRequests()). a "traceparent" sent along is continued.
+func (tracer *Tracer) Trace(handler http.Handler, certDepth int) http.Handler {
+	if tracer == nil {
+		return handler
+	}
+	propagator := propagation.TraceContext{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := requestRoute(r.URL.Path)
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		status := logStatusCode{ResponseWriter: w}
+		handler.ServeHTTP(&status, r.WithContext(ctx))
+		if status.Code == 0 {
+			status.Code = 200
+		}
+
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.Int("http.response.status_code", status.Code),
+			attribute.Int64("http.response.body.size", status.Bytes),
+		)
+		if r.TLS != nil {
+			if id := clientIdOfChain(r.TLS, certDepth); id != "" {
+				span.SetAttributes(attribute.String("kellner.client_id", id))
+			}
+		}
+		if status.Code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status.Code))
+		}
+	})
+}
+
+// flushes the spans not exported yet
+func (tracer *Tracer) Shutdown(ctx context.Context) error {
+	if tracer == nil {
+		return nil
+	}
+	return tracer.provider.Shutdown(ctx)
+}
+
+// the route of a request, names its span: the url-path with the name of a
+// package replaced ("/arm/foo_1.0_arm.ipk" becomes "/arm/*.ipk"). the
+// index files of a feed keep their names.
+func requestRoute(urlPath string) string {
+	if path.Ext(urlPath) == ".ipk" {
+		return path.Join(path.Dir(urlPath), "*.ipk")
+	}
+	return urlPath
+}
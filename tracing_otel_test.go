@@ -0,0 +1,67 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracerTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := newTracer(sdktrace.NewSimpleSpanProcessor(exporter))
+
+	handler := tracer.Trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/arm/foo_1.0_arm.ipk" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}), 0)
+
+	for _, path := range []string{"/arm/foo_1.0_arm.ipk", "/arm/Packages"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, expected 2", len(spans))
+	}
+	for i, expected := range []struct {
+		name   string
+		status int64
+		bytes  int64
+	}{
+		{"GET /arm/*.ipk", 200, 5},
+		{"GET /arm/Packages", 404, 19},
+	} {
+		span := spans[i]
+		if span.Name != expected.name {
+			t.Errorf("span %d: got the name %q, expected %q", i, span.Name, expected.name)
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, attr := range span.Attributes {
+			attrs[attr.Key] = attr.Value
+		}
+		if got := attrs["http.response.status_code"].AsInt64(); got != expected.status {
+			t.Errorf("%s: got the status %d, expected %d", span.Name, got, expected.status)
+		}
+		if got := attrs["http.response.body.size"].AsInt64(); got != expected.bytes {
+			t.Errorf("%s: got %d bytes, expected %d", span.Name, got, expected.bytes)
+		}
+	}
+}
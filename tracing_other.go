@@ -0,0 +1,37 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !otel
+// +build !otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// tracing needs the opentelemetry sdk, which is not vendored: it is only
+// built with "-tags otel", see tracing_otel.go
+type Tracer struct{}
+
+func NewTracer(endpoint string) (*Tracer, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("kellner was built without tracing (go build -tags otel)")
+}
+
+func (tracer *Tracer) Trace(handler http.Handler, certDepth int) http.Handler {
+	return handler
+}
+
+func (tracer *Tracer) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !otel
+// +build !otel
+
+package main
+
+import "testing"
+
+// without the otel tag an -otel-endpoint is a usage error, not ignored
+func TestNewTracer(t *testing.T) {
+	if tracer, err := NewTracer(""); tracer != nil || err != nil {
+		t.Errorf("NewTracer(\"\"): got %v, %v", tracer, err)
+	}
+	if _, err := NewTracer("http://localhost:4318"); err == nil {
+		t.Errorf("NewTracer(): expected an error")
+	}
+}
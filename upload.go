@@ -0,0 +1,238 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// accepts an .ipk via PUT or POST to "<prefix>/name.ipk":
+//
+// the body is written to a temporary file inside the feed-directory, parsed
+// via NewIpkgFromFile() and then moved in place. an existing package is only
+// replaced if the request carries "X-Overwrite: true". afterwards the feed
+// is rebuilt.
+//
+// with UploadNeedsSignature, the request has to carry the detached
+// gpg-signature of the package, see verifyUploadSignature().
+//
+// with "?validate=1" the upload is only checked, see serveValidation(). it
+// might then go to "<prefix>/" as well, the package is named after its
+// control ("package_version_arch.ipk").
+func (feed *Feed) serveUpload(w http.ResponseWriter, r *http.Request) {
+
+	if feed.WriteNeedsCert && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+		writeError(http.StatusUnauthorized, w, r)
+		return
+	}
+
+	validate := r.URL.Query().Get("validate") == "1"
+	name := path.Base(r.URL.Path)
+	if validate && strings.HasSuffix(r.URL.Path, "/") && path.Clean(r.URL.Path) == path.Clean(feed.Prefix) {
+		name = "" // see below
+	} else if path.Dir(r.URL.Path) != path.Clean(feed.Prefix) || path.Ext(name) != ".ipk" || strings.HasPrefix(name, ".") {
+		writeError(http.StatusBadRequest, w, r)
+		return
+	}
+
+	// a validated upload never touches the feed-directory
+	tmpDir := feed.Dir
+	if validate {
+		tmpDir = ""
+	}
+	tmpFile, err := ioutil.TempFile(tmpDir, "."+name+".upload-")
+	if err != nil {
+		logErrorf("upload of %q: %v", r.URL.Path, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName) // no-op once the upload is moved in place
+
+	body := r.Body
+	if feed.UploadMaxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, feed.UploadMaxSize)
+	}
+	_, err = io.Copy(tmpFile, body)
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logErrorf("upload of %q: %v", r.URL.Path, err)
+		writeError(http.StatusBadRequest, w, r)
+		return
+	}
+
+	var signedBy string
+	if feed.UploadNeedsSignature {
+		if signedBy, err = verifyUploadSignature(r, tmpName); err != nil {
+			writeUnprocessable(w, r, err)
+			return
+		}
+	}
+
+	opts := feed.ScanOpts
+	ipkg, err := NewIpkgFromFile(filepath.Base(tmpName), filepath.Dir(tmpName), opts.Md5, opts.Sha1, opts.Sha256)
+	if err == nil && name == "" {
+		name = fmt.Sprintf("%s_%s_%s.ipk", ipkg.Header["Package"], ipkg.Header["Version"], ipkg.Header["Architecture"])
+	}
+	if err == nil {
+		err = opts.Check(name, ipkg)
+	}
+	if err != nil {
+		writeUnprocessable(w, r, err)
+		return
+	}
+
+	if validate {
+		feed.serveValidation(w, r, name, ipkg)
+		return
+	}
+
+	fullName := filepath.Join(feed.Dir, name)
+	code := http.StatusCreated
+	if r.Header.Get("X-Overwrite") == "true" {
+		if _, err := os.Lstat(fullName); err == nil {
+			code = http.StatusOK
+		}
+		err = os.Rename(tmpName, fullName)
+	} else {
+		// link() fails if 'fullName' exists, rename() would silently replace it
+		err = os.Link(tmpName, fullName)
+	}
+	if os.IsExist(err) {
+		writeError(http.StatusConflict, w, r)
+		return
+	} else if err != nil {
+		logErrorf("upload of %q: %v", r.URL.Path, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+
+	if signedBy != "" {
+		logInfof("uploaded %q to %q, signed by %s", name, feed.Dir, signedBy)
+	} else {
+		logInfof("uploaded %q to %q", name, feed.Dir)
+	}
+	if err = feed.Build(); err != nil {
+		logErrorf("rebuilding %q after upload: %v", feed.Dir, err)
+	}
+
+	ipkg.Name = name
+	w.WriteHeader(code)
+	ipkg.ControlAndChecksumTo(w)
+}
+
+// checks the "X-Signature" of an upload: the base64 encoded, detached
+// gpg-signature of the package written to 'fileName'. returns the
+// fingerprint of the signing key, see GpgVerifyDetached().
+func verifyUploadSignature(r *http.Request, fileName string) (string, error) {
+	value := r.Header.Get("X-Signature")
+	if value == "" {
+		return "", fmt.Errorf("missing the detached gpg-signature (\"X-Signature\")")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("\"X-Signature\": %v", err)
+	}
+	return GpgVerifyDetached(sig, fileName)
+}
+
+// answers an upload with "?validate=1": the index entry 'ipkg' would get
+// as 'name', or 422 if a rescan would not index it. to this end the rules
+// of ScanDirectoryForPackages() (-exclude, the stripped fields, colliding
+// packages and -keep) are applied to a copy of the current index plus the
+// upload. an existing package yields 409 unless "X-Overwrite: true" is
+// given, just like the actual upload.
+func (feed *Feed) serveValidation(w http.ResponseWriter, r *http.Request, name string, ipkg *Ipkg) {
+
+	opts := feed.ScanOpts
+	if opts.Excluded(name) {
+		writeUnprocessable(w, r, fmt.Errorf("%q is excluded by -exclude", name))
+		return
+	}
+	if _, err := os.Lstat(filepath.Join(feed.Dir, name)); err == nil && r.Header.Get("X-Overwrite") != "true" {
+		writeError(http.StatusConflict, w, r)
+		return
+	}
+	ipkg.Name = name
+	if err := opts.prepare(name, ipkg); err != nil {
+		writeUnprocessable(w, r, err)
+		return
+	}
+
+	index := &PackageIndex{Entries: make(map[string]*Ipkg)}
+	if current := feed.Packages(); current != nil {
+		for _, other := range current.SortedNames() {
+			index.Add(other, current.Entries[other])
+		}
+	}
+	index.Add(name, ipkg)
+	for _, collision := range index.RemoveCollisions() {
+		if collision.Removed == name {
+			writeUnprocessable(w, r, fmt.Errorf("same Package, Version and Architecture as %q", collision.Kept))
+			return
+		}
+	}
+	if opts.Keep > 0 {
+		for _, removed := range index.KeepNewest(opts.Keep) {
+			if removed == name {
+				writeUnprocessable(w, r, fmt.Errorf("not one of the newest versions, omitted by -keep %d", opts.Keep))
+				return
+			}
+		}
+	}
+
+	ipkg.ControlAndChecksumTo(w)
+}
+
+// like writeError(), with the reason why the upload was rejected
+func writeUnprocessable(w http.ResponseWriter, r *http.Request, err error) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	fmt.Fprintf(w, "%d %q for %s: %v\n\n", http.StatusUnprocessableEntity,
+		http.StatusText(http.StatusUnprocessableEntity), r.URL.Path, err)
+}
+
+// removes the package "<prefix>/name.ipk" from disk and rebuilds the
+// feed. only packages listed in the index of the feed can be removed.
+func (feed *Feed) serveDelete(w http.ResponseWriter, r *http.Request) {
+
+	if feed.WriteNeedsCert && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+		writeError(http.StatusUnauthorized, w, r)
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	ipkg, ok := feed.Packages().Entries[name]
+	if !ok || path.Dir(r.URL.Path) != path.Clean(feed.Prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := os.Remove(filepath.Join(feed.Dir, name)); err != nil && !os.IsNotExist(err) {
+		logErrorf("deleting %q: %v", r.URL.Path, err)
+		writeError(http.StatusInternalServerError, w, r)
+		return
+	}
+
+	logInfof("deleted %q from %q", name, feed.Dir)
+	if err := feed.Build(); err != nil {
+		logErrorf("rebuilding %q after delete: %v", feed.Dir, err)
+	}
+
+	ipkg.ControlAndChecksumTo(w)
+}
@@ -0,0 +1,127 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// runs gpg with a keyring of its own holding a fresh key, kellner uses
+// it as well (via GNUPGHOME). returns a func signing a file.
+func testGpgHome(t *testing.T) (sign func(fileName string) []byte) {
+	t.Helper()
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is missing")
+	}
+	home, err := os.MkdirTemp("", "gpg") // short, the agent's socket lives in there
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNUPGHOME", home)
+	t.Cleanup(func() {
+		exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+
+	gpg := func(args ...string) []byte {
+		t.Helper()
+		stderr := bytes.NewBuffer(nil)
+		cmd := exec.Command("gpg", append([]string{"--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...)
+		cmd.Stderr = stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("gpg %q: %v: %s", args, err, stderr)
+		}
+		return out
+	}
+	gpg("--quick-gen-key", "kellner test <test@kellner.invalid>", "default", "default", "never")
+	return func(fileName string) []byte {
+		return gpg("--detach-sign", "--output", "-", fileName)
+	}
+}
+
+func TestUploadSignature(t *testing.T) {
+	sign := testGpgHome(t)
+
+	var (
+		tmp   = t.TempDir()
+		pkg   = writeIpk(t, tmp, "foo_1.0_arm.ipk", testControl("foo", "1.0", "arm"))
+		other = writeIpk(t, tmp, "bar_1.0_arm.ipk", testControl("bar", "1.0", "arm"))
+		good  = base64.StdEncoding.EncodeToString(sign(pkg))
+		bad   = base64.StdEncoding.EncodeToString(sign(other))
+	)
+	data, err := os.ReadFile(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		signature string
+		code      int
+	}{
+		{"unsigned", "", http.StatusUnprocessableEntity},
+		{"not base64", "###", http.StatusUnprocessableEntity},
+		{"signature of another file", bad, http.StatusUnprocessableEntity},
+		{"signed", good, http.StatusCreated},
+	} {
+		dir := t.TempDir()
+		feed := testFeed(dir, "/arm")
+		feed.AllowUpload, feed.UploadNeedsSignature = true, true
+
+		r := httptest.NewRequest("PUT", "/arm/foo_1.0_arm.ipk", bytes.NewReader(data))
+		if test.signature != "" {
+			r.Header.Set("X-Signature", test.signature)
+		}
+		w := httptest.NewRecorder()
+		feed.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d %q, expected %d", test.name, w.Code, w.Body.String(), test.code)
+		}
+
+		_, err := os.Stat(filepath.Join(dir, "foo_1.0_arm.ipk"))
+		if published := err == nil; published != (test.code == http.StatusCreated) {
+			t.Errorf("%s: the package was published: %v", test.name, published)
+		}
+	}
+}
+
+func TestUploadStrict(t *testing.T) {
+	tmp := t.TempDir()
+	control := testControl("foo", "1.0", "arm")
+	for _, test := range []struct {
+		control string
+		code    int
+	}{
+		{control, http.StatusUnprocessableEntity},
+		{control + "Filename: other.ipk\n", http.StatusUnprocessableEntity},
+		{control + "Filename: foo_1.0_arm.ipk\n", http.StatusCreated},
+	} {
+		data, err := os.ReadFile(writeIpk(t, tmp, "foo_1.0_arm.ipk", test.control))
+		if err != nil {
+			t.Fatal(err)
+		}
+		feed := testFeed(t.TempDir(), "/arm")
+		feed.AllowUpload = true
+		feed.ScanOpts.Strict = true
+
+		w := httptest.NewRecorder()
+		feed.ServeHTTP(w, httptest.NewRequest("PUT", "/arm/foo_1.0_arm.ipk", bytes.NewReader(data)))
+		if w.Code != test.code {
+			t.Errorf("-strict %q: got %d %q, expected %d", test.control, w.Code, w.Body.String(), test.code)
+		}
+	}
+}
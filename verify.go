@@ -0,0 +1,126 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// parses the stanzas of a Packages index. the names of the checksum
+// fields are normalized ("MD5Sum" to "MD5sum", "SHA256sum" to "SHA256"),
+// kellner and opkg-make-index spell them differently.
+func ParsePackagesIndex(r io.Reader) ([]map[string]string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	stanzas := make([]map[string]string, 0)
+	for _, stanza := range strings.Split(string(content), "\n\n") {
+		if strings.TrimSpace(stanza) == "" {
+			continue
+		}
+		ipkg := &Ipkg{Header: make(map[string]string)}
+		if err := ipkg.ControlToHeader(strings.TrimLeft(stanza, "\n") + "\n"); err != nil {
+			return nil, err
+		}
+		fields := make(map[string]string, len(ipkg.Header))
+		for name, value := range ipkg.Header {
+			switch strings.ToLower(name) {
+			case "md5sum":
+				name = "MD5sum"
+			case "sha256", "sha256sum":
+				name = "SHA256"
+			case "sha1":
+				name = "SHA1"
+			}
+			fields[name] = value
+		}
+		stanzas = append(stanzas, fields)
+	}
+	return stanzas, nil
+}
+
+// compares the Packages index 'committed' against 'packages' (as scanned)
+// and writes a line per difference to 'w':
+//
+//	missing foo_1.0_arm.ipk          listed, but not scanned
+//	extra bar_2.0_arm.ipk            scanned, but not listed
+//	mismatch baz_1.0_arm.ipk: Size, SHA256
+//
+// only the fields present in both are compared, eg. a committed index
+// without SHA256 is not a mismatch for a scan calculating it. returns the
+// number of differences.
+func VerifyPackagesIndex(w io.Writer, committed io.Reader, packages *PackageIndex) (int, error) {
+	listed, err := ParsePackagesIndex(committed)
+	if err != nil {
+		return 0, err
+	}
+	scannedIndex := bytes.NewBuffer(nil)
+	packages.StringTo(scannedIndex)
+	scanned, err := ParsePackagesIndex(scannedIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	byName := func(stanzas []map[string]string) map[string]map[string]string {
+		named := make(map[string]map[string]string, len(stanzas))
+		for _, stanza := range stanzas {
+			if stanza["Filename"] != "" {
+				named[path.Base(stanza["Filename"])] = stanza
+			}
+		}
+		return named
+	}
+	var (
+		listedByName  = byName(listed)
+		scannedByName = byName(scanned)
+		names         = make([]string, 0, len(listedByName)+len(scannedByName))
+		differences   int
+	)
+	for name := range listedByName {
+		names = append(names, name)
+	}
+	for name := range scannedByName {
+		if _, ok := listedByName[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		was, is := listedByName[name], scannedByName[name]
+		switch {
+		case is == nil:
+			fmt.Fprintf(w, "missing %s\n", name)
+		case was == nil:
+			fmt.Fprintf(w, "extra %s\n", name)
+		default:
+			fields := make([]string, 0)
+			for field, value := range was {
+				if other, ok := is[field]; ok && other != value {
+					fields = append(fields, field)
+				}
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			sort.Strings(fields)
+			fmt.Fprintf(w, "mismatch %s: %s\n", name, strings.Join(fields, ", "))
+		}
+		differences++
+	}
+	return differences, nil
+}
@@ -0,0 +1,112 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// compares two package versions the way dpkg (and opkg) do, see
+// https://www.debian.org/doc/debian-policy/ch-controlfields.html#version
+//
+//	[epoch:]upstream_version[-debian_revision]
+//
+// returns <0 if a is older than b, 0 if both are equal and >0 if a is newer.
+func CompareVersions(a, b string) int {
+	aEpoch, aUpstream, aRevision := splitVersion(a)
+	bEpoch, bUpstream, bRevision := splitVersion(b)
+
+	if aEpoch != bEpoch {
+		if aEpoch < bEpoch {
+			return -1
+		}
+		return 1
+	}
+	if c := compareVersionPart(aUpstream, bUpstream); c != 0 {
+		return c
+	}
+	return compareVersionPart(aRevision, bRevision)
+}
+
+func splitVersion(version string) (epoch int, upstream, revision string) {
+	if i := strings.IndexByte(version, ':'); i != -1 {
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+	upstream = version
+	if i := strings.LastIndexByte(version, '-'); i != -1 {
+		upstream, revision = version[:i], version[i+1:]
+	}
+	return epoch, upstream, revision
+}
+
+// the 'verrevcmp' of dpkg: alternating non-digit and digit parts are
+// compared. non-digits are compared char by char where '~' sorts before
+// everything (even the end of the part), letters sort before non-letters.
+// digits are compared numerically.
+func compareVersionPart(a, b string) int {
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			ac, bc := 0, 0
+			if a != "" && !isDigit(a[0]) {
+				ac = versionCharOrder(a[0])
+			}
+			if b != "" && !isDigit(b[0]) {
+				bc = versionCharOrder(b[0])
+			}
+			if ac != bc {
+				return ac - bc
+			}
+			a, b = a[1:], b[1:]
+		}
+
+		for a != "" && a[0] == '0' {
+			a = a[1:]
+		}
+		for b != "" && b[0] == '0' {
+			b = b[1:]
+		}
+
+		firstDiff := 0
+		for a != "" && isDigit(a[0]) && b != "" && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(a[0]) {
+			return 1
+		}
+		if b != "" && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
+
+func versionCharOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case isDigit(c):
+		return 0
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,85 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "testing"
+
+// the sign of a comparison
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.01", "1.1", 0},
+		{"1.0", "1.0.1", -1},
+		{"", "0", 0},
+		// letters sort before non-letters
+		{"1.0a", "1.0+", -1},
+		{"1.0a", "1.0b", -1},
+		{"1.0", "1.0a", -1},
+		// '~' sorts before everything, even the end
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		// epochs
+		{"1:1.0", "2.0", 1},
+		{"0:1.0", "1.0", 0},
+		{"1:1.0", "2:0.1", -1},
+		// revisions, split at the last '-'
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.0", "1.0-0", 0},
+		{"1.0-1", "1.0", 1},
+		{"1.0-rc-1", "1.0-rc-2", -1},
+		{"2.0-1", "10.0-1", -1},
+		// openwrt style
+		{"2023-01-15-abc123-1", "2023-01-15-abc123-2", -1},
+		{"1.36.1-r1", "1.36.1-r10", -1},
+	} {
+		if got := sign(CompareVersions(test.a, test.b)); got != test.expected {
+			t.Errorf("CompareVersions(%q, %q): got %d, expected %d", test.a, test.b, got, test.expected)
+		}
+		if got := sign(CompareVersions(test.b, test.a)); got != -test.expected {
+			t.Errorf("CompareVersions(%q, %q): got %d, expected %d", test.b, test.a, got, -test.expected)
+		}
+	}
+}
+
+func TestSplitVersion(t *testing.T) {
+	for _, test := range []struct {
+		version            string
+		epoch              int
+		upstream, revision string
+	}{
+		{"1.0", 0, "1.0", ""},
+		{"2:1.0-r1", 2, "1.0", "r1"},
+		{"1.0-rc-1", 0, "1.0-rc", "1"},
+		{"x:1.0", 0, "1.0", ""},
+	} {
+		epoch, upstream, revision := splitVersion(test.version)
+		if epoch != test.epoch || upstream != test.upstream || revision != test.revision {
+			t.Errorf("splitVersion(%q): got %d %q %q, expected %d %q %q",
+				test.version, epoch, upstream, revision, test.epoch, test.upstream, test.revision)
+		}
+	}
+}
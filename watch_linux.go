@@ -0,0 +1,103 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// files created, removed, renamed or completely written
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_DELETE | syscall.IN_ATTRIB
+
+// uses inotify to watch 'dir' for changes of .ipk files (or of
+// FeedFormatsFile). 'changed' is called once no further event was seen
+// for 'delay', so a burst (eg, a big rsync) leads to only one call. the
+// returned func stops watching (eg. once 'dir' is gone).
+func watchDirectory(dir string, delay time.Duration, changed func()) (func(), error) {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init for %q: %v", dir, err)
+	}
+	if _, err = syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("inotify_add_watch for %q: %v", dir, err)
+	}
+	// non-blocking, so Close() interrupts a pending Read()
+	inotify := os.NewFile(uintptr(fd), "inotify")
+
+	var stopped atomic.Bool
+	go func() {
+		defer inotify.Close()
+
+		var (
+			buf   = make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+			timer *time.Timer
+		)
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+
+		for {
+			n, err := inotify.Read(buf)
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			if err != nil || n <= 0 {
+				logErrorf("watching %q stopped: %v", dir, err)
+				return
+			}
+
+			relevant := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				name := string(bytes.TrimRight(nameBytes, "\x00"))
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				if event.Mask&syscall.IN_Q_OVERFLOW != 0 || path.Ext(name) == ".ipk" || name == FeedFormatsFile {
+					relevant = true
+				}
+			}
+
+			if !relevant {
+				continue
+			}
+			if timer == nil {
+				timer = time.AfterFunc(delay, func() {
+					if !stopped.Load() {
+						changed()
+					}
+				})
+			} else {
+				timer.Reset(delay)
+			}
+		}
+	}()
+
+	stop := func() {
+		stopped.Store(true)
+		inotify.Close()
+	}
+	return stop, nil
+}
@@ -0,0 +1,21 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func watchDirectory(dir string, delay time.Duration, changed func()) (func(), error) {
+	return nil, fmt.Errorf("watching %q: not supported on this platform", dir)
+}
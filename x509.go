@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 )
 
 // returns a "normalized" variant of the pkix.Name
@@ -18,9 +21,31 @@ func clientIdByName(name *pkix.Name) string {
 	return string(nameBytes)
 }
 
+// returns the client-id of the certificate at 'depth' of the client's
+// chain: 0 is the client-cert itself, 1 its issuer and so on. the chain as
+// verified against the -ssl-client-cas is preferred to the one the client
+// sent. for a shorter chain the topmost certificate is used, "" without a
+// client-cert.
+func clientIdOfChain(state *tls.ConnectionState, depth int) string {
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+	if len(chain) == 0 {
+		return ""
+	}
+	if depth >= len(chain) {
+		depth = len(chain) - 1
+	}
+	return clientIdByName(&chain[depth].Subject)
+}
+
+// prints the client-id of the certificate in 'certFile'. a file with
+// several certificates (eg, a chain) gets a line per certificate, the id and
+// the subject separated by a tab.
 func printClientIdTo(w io.Writer, certFile string) error {
 	var (
-		cert          *x509.Certificate
+		certs         []*x509.Certificate
 		block         *pem.Block
 		rawBytes, err = ioutil.ReadFile(certFile)
 	)
@@ -38,19 +63,24 @@ func printClientIdTo(w io.Writer, certFile string) error {
 			continue
 		}
 
-		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
-			return nil
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("cert file %q, certificate %d: %v", certFile, len(certs)+1, err)
 		}
-
-		break
+		certs = append(certs, cert)
 	}
 
-	if cert == nil {
+	if len(certs) == 0 {
 		return fmt.Errorf("cert file %q does not contain a certificate", certFile)
 	}
 
-	clientId := clientIdByName(&cert.Subject)
-	fmt.Fprintf(w, "%s\n", clientId)
+	if len(certs) == 1 {
+		fmt.Fprintf(w, "%s\n", clientIdByName(&certs[0].Subject))
+		return nil
+	}
+	for _, cert := range certs {
+		fmt.Fprintf(w, "%s\t%s\n", clientIdByName(&cert.Subject), cert.Subject)
+	}
 
 	return nil
 }
@@ -59,44 +89,61 @@ func printClientIdTo(w io.Writer, certFile string) error {
 // the values are taken from http://golang.org/src/crypto/x509/pkix/pkix.go, see
 // oidCountry, oidCommonName etc.
 var oidToKeys = [...]struct {
-	oid [4]int
+	oid asn1.ObjectIdentifier
 	key string
 }{
-	{[4]int{2, 5, 4, 6}, "C"},   // country
-	{[4]int{2, 5, 4, 10}, "O"},  // organization
-	{[4]int{2, 5, 4, 11}, "OU"}, // organizational unit
-	{[4]int{2, 5, 4, 3}, "CN"},  // common name
-	{[4]int{2, 5, 4, 5}, "SN"},  // serial number
-	{[4]int{2, 5, 4, 7}, "L"},   // locality
-	{[4]int{2, 5, 4, 8}, "P"},   // province
-	{[4]int{2, 5, 4, 9}, "S"},   // street // TODO: check correct key
-	{[4]int{2, 5, 4, 17}, "PC"}, // postal code // TODO: check correct key
+	{asn1.ObjectIdentifier{2, 5, 4, 6}, "C"},   // country
+	{asn1.ObjectIdentifier{2, 5, 4, 10}, "O"},  // organization
+	{asn1.ObjectIdentifier{2, 5, 4, 11}, "OU"}, // organizational unit
+	{asn1.ObjectIdentifier{2, 5, 4, 3}, "CN"},  // common name
+	{asn1.ObjectIdentifier{2, 5, 4, 5}, "SN"},  // serial number
+	{asn1.ObjectIdentifier{2, 5, 4, 7}, "L"},   // locality
+	{asn1.ObjectIdentifier{2, 5, 4, 8}, "P"},   // province
+	{asn1.ObjectIdentifier{2, 5, 4, 9}, "S"},   // street // TODO: check correct key
+	{asn1.ObjectIdentifier{2, 5, 4, 17}, "PC"}, // postal code // TODO: check correct key
+
+	// not in crypto/x509/pkix, see rfc 4519 and rfc 2985
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}, "E"},        // email address
+	{asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, "DC"}, // domain component
+	{asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, "UID"}, // user id
 }
 
 // returns a serialized version of 'name' for each known
-// asn1.object-identifier ("key") in the form:
+// asn1.object-identifier ("key"), ordered as in oidToKeys. several values
+// of one key (eg, "OU") are sorted, duplicates dropped: the same identity
+// yields the same id, no matter how the subject is encoded. in the form:
 //  key1=value1,key2=value2,key3=value3...
 //
 func typeValsToBytes(names []pkix.AttributeTypeAndValue, cleanValues bool) []byte {
 
-	buf := bytes.NewBuffer(nil)
+	type keyVal struct {
+		order int // index in oidToKeys
+		key   string
+		val   string
+	}
+	keyVals := make([]keyVal, 0, len(names))
 	for i := range names {
 
 		entry := &names[i]
-		key := ""
 		for j := 0; j < len(oidToKeys); j++ {
-			if len(entry.Type) == 4 &&
-				entry.Type[0] == oidToKeys[j].oid[0] &&
-				entry.Type[1] == oidToKeys[j].oid[1] &&
-				entry.Type[2] == oidToKeys[j].oid[2] &&
-				entry.Type[3] == oidToKeys[j].oid[3] {
+			if entry.Type.Equal(oidToKeys[j].oid) {
 
-				key = oidToKeys[j].key
+				keyVals = append(keyVals, keyVal{j, oidToKeys[j].key, fmt.Sprint(entry.Value)})
 				break
 			}
 		}
+	}
+	sort.SliceStable(keyVals, func(i, j int) bool {
+		if keyVals[i].order != keyVals[j].order {
+			return keyVals[i].order < keyVals[j].order
+		}
+		return keyVals[i].val < keyVals[j].val
+	})
+
+	buf := bytes.NewBuffer(nil)
+	for i, kv := range keyVals {
 
-		if key == "" {
+		if i > 0 && kv == keyVals[i-1] {
 			continue
 		}
 
@@ -105,9 +152,9 @@ func typeValsToBytes(names []pkix.AttributeTypeAndValue, cleanValues bool) []byt
 		}
 
 		oldLen := len(buf.Bytes())
-		fmt.Fprintf(buf, "%s=%s", key, entry.Value)
+		fmt.Fprintf(buf, "%s=%s", kv.key, kv.val)
 		if cleanValues {
-			cleanPkixNameBytes(buf.Bytes()[oldLen+len(key)+1:])
+			cleanPkixNameBytes(buf.Bytes()[oldLen+len(kv.key)+1:])
 		}
 	}
 
@@ -0,0 +1,183 @@
+// This file is part of *kellner*
+//
+// Copyright (C) 2015, Travelping GmbH <copyright@travelping.com>
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	oidC  = asn1.ObjectIdentifier{2, 5, 4, 6}
+	oidO  = asn1.ObjectIdentifier{2, 5, 4, 10}
+	oidOU = asn1.ObjectIdentifier{2, 5, 4, 11}
+	oidCN = asn1.ObjectIdentifier{2, 5, 4, 3}
+	oidDC = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}
+	oidE  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+)
+
+func TestTypeValsToBytes(t *testing.T) {
+	attr := func(oid asn1.ObjectIdentifier, value string) pkix.AttributeTypeAndValue {
+		return pkix.AttributeTypeAndValue{Type: oid, Value: value}
+	}
+	for _, test := range []struct {
+		names    []pkix.AttributeTypeAndValue
+		expected string
+	}{
+		{nil, ""},
+		{[]pkix.AttributeTypeAndValue{attr(oidCN, "box 1"), attr(oidC, "DE")}, "C=DE,CN=box_1"},
+		{[]pkix.AttributeTypeAndValue{attr(oidC, "DE"), attr(oidCN, "box 1")}, "C=DE,CN=box_1"},
+		// several values of a key are sorted, duplicates dropped
+		{[]pkix.AttributeTypeAndValue{attr(oidOU, "b"), attr(oidO, "tp"), attr(oidOU, "a"), attr(oidOU, "b")}, "O=tp,OU=a,OU=b"},
+		{[]pkix.AttributeTypeAndValue{attr(oidOU, "a"), attr(oidOU, "b"), attr(oidO, "tp")}, "O=tp,OU=a,OU=b"},
+		// the keys not in crypto/x509/pkix come last, unknown ones are dropped
+		{[]pkix.AttributeTypeAndValue{attr(oidDC, "example"), attr(asn1.ObjectIdentifier{1, 2, 3}, "x"), attr(oidCN, "box")}, "CN=box,DC=example"},
+	} {
+		if got := string(typeValsToBytes(test.names, true)); got != test.expected {
+			t.Errorf("typeValsToBytes(%v): got %q, expected %q", test.names, got, test.expected)
+		}
+	}
+}
+
+// a certificate for 'subject', self-signed
+func testCertificate(t *testing.T, subject pkix.Name) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// the same identity, encoded in different attribute orders, has the same
+// client-id
+func TestClientIdByNameOrder(t *testing.T) {
+	expected := "C=DE,O=Travelping,OU=lab,OU=qa,CN=box-1"
+	for _, order := range [][]pkix.AttributeTypeAndValue{
+		{{Type: oidC, Value: "DE"}, {Type: oidO, Value: "Travelping"}, {Type: oidOU, Value: "lab"}, {Type: oidOU, Value: "qa"}, {Type: oidCN, Value: "box-1"}},
+		{{Type: oidCN, Value: "box-1"}, {Type: oidOU, Value: "qa"}, {Type: oidOU, Value: "lab"}, {Type: oidO, Value: "Travelping"}, {Type: oidC, Value: "DE"}},
+		{{Type: oidOU, Value: "qa"}, {Type: oidC, Value: "DE"}, {Type: oidCN, Value: "box-1"}, {Type: oidO, Value: "Travelping"}, {Type: oidOU, Value: "lab"}},
+	} {
+		cert := testCertificate(t, pkix.Name{ExtraNames: order})
+		if got := clientIdByName(&cert.Subject); got != expected {
+			t.Errorf("clientIdByName(%v): got %q, expected %q", cert.Subject, got, expected)
+		}
+	}
+}
+
+// the attributes used by email- and ldap-based subjects are part of the
+// client-id
+func TestClientIdByNameEmail(t *testing.T) {
+	oidUID := asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+	for _, test := range []struct {
+		subject  pkix.Name
+		expected string
+	}{
+		{pkix.Name{ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidE, Value: "box-1@example.com"}}}, "E=box-1_example_com"},
+		{pkix.Name{CommonName: "box-1", ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidE, Value: "ops@example.com"}}},
+			"CN=box-1,E=ops_example_com"},
+		{pkix.Name{CommonName: "box-1", SerialNumber: "0042"}, "CN=box-1,SN=0042"},
+		{pkix.Name{ExtraNames: []pkix.AttributeTypeAndValue{
+			{Type: oidUID, Value: "jdoe"}, {Type: oidDC, Value: "com"}, {Type: oidDC, Value: "example"},
+		}}, "DC=com,DC=example,UID=jdoe"},
+	} {
+		cert := testCertificate(t, test.subject)
+		if got := clientIdByName(&cert.Subject); got != test.expected {
+			t.Errorf("clientIdByName(%v): got %q, expected %q", cert.Subject, got, test.expected)
+		}
+	}
+}
+
+func TestPrintClientIdTo(t *testing.T) {
+	box := testCertificate(t, pkix.Name{CommonName: "box-1"})
+	ca := testCertificate(t, pkix.Name{CommonName: "kellner ca", Organization: []string{"tp"}})
+	certPEM := func(der []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	dir := t.TempDir()
+	for _, test := range []struct {
+		content  string
+		expected string // "": an error
+	}{
+		{certPEM(box.Raw), "CN=box-1\n"},
+		{certPEM(box.Raw) + certPEM(ca.Raw), "CN=box-1\tCN=box-1\nO=tp,CN=kellner_ca\tCN=kellner ca,O=tp\n"},
+		// other blocks are skipped
+		{string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})) + certPEM(box.Raw), "CN=box-1\n"},
+		{certPEM([]byte("not a certificate")), ""},
+		{certPEM(box.Raw) + certPEM(box.Raw[:len(box.Raw)/2]), ""},
+		{"", ""},
+		{"not pem at all\n", ""},
+	} {
+		name := filepath.Join(dir, "client.pem")
+		writeTestFile(t, name, test.content)
+		out := bytes.NewBuffer(nil)
+		err := printClientIdTo(out, name)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("printClientIdTo(%q): expected an error, got %q", test.content, out)
+			}
+			continue
+		}
+		if err != nil || out.String() != test.expected {
+			t.Errorf("printClientIdTo(%q): got %q %v, expected %q", test.content, out, err, test.expected)
+		}
+	}
+	if err := printClientIdTo(bytes.NewBuffer(nil), filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("printClientIdTo(): expected an error for a missing file")
+	}
+}
+
+// -client-id-for exits non-zero for a corrupt certificate. main() runs in
+// a child process, the test binary started again.
+func TestClientIdForExit(t *testing.T) {
+	if certFile := os.Getenv("KELLNER_TEST_CLIENT_ID_FOR"); certFile != "" {
+		os.Args = []string{"kellner", "-client-id-for", certFile}
+		main()
+		os.Exit(0)
+	}
+
+	certFile := filepath.Join(t.TempDir(), "corrupt.pem")
+	writeTestFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("corrupt")})))
+	cmd := exec.Command(os.Args[0], "-test.run=^TestClientIdForExit$")
+	cmd.Env = append(os.Environ(), "KELLNER_TEST_CLIENT_ID_FOR="+certFile)
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("got %v, expected the exit code 1:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "error: cert file") {
+		t.Errorf("the error is not printed:\n%s", out)
+	}
+}